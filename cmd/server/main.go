@@ -12,8 +12,10 @@ import (
 	"go-im/internal/auth"
 	"go-im/internal/cache"
 	"go-im/internal/config"
+	"go-im/internal/infrastructure/adapters/external"
 	"go-im/internal/metrics"
 	"go-im/internal/models"
+	"go-im/internal/moderation"
 	"go-im/internal/mq"
 	"go-im/internal/ratelimit"
 	"go-im/internal/services"
@@ -52,6 +54,7 @@ func main() {
 
 	// 根据配置选择消息存储：mysql、tidb 或 mongodb
 	var msgStore store.MessageStoreInterface
+	var searchIndex store.SearchIndex
 	switch cfg.MessageDB {
 	case "mongodb":
 		mongoDB, err := mongostore.Connect(cfg.MongoURI)
@@ -59,12 +62,15 @@ func main() {
 			panic(fmt.Sprintf("MongoDB connection failed: %v", err))
 		}
 		msgStore = store.NewMongoMessageStore(mongoDB)
+		searchIndex = store.NewMongoSearchIndex(mongoDB)
 	case "tidb":
 		messageDB := mustOpen(cfg.TiDBDSN)
 		msgStore = store.NewMessageStore(messageDB)
+		searchIndex = store.NewSQLSearchIndex(messageDB)
 	default: // mysql
 		messageDB := mustOpen(cfg.MySQLDSN)
 		msgStore = store.NewMessageStore(messageDB)
+		searchIndex = store.NewSQLSearchIndex(messageDB)
 	}
 
 	_ = sqlstore.Stores{Primary: primaryDB, Message: nil} // Message 现在通过接口访问
@@ -74,11 +80,61 @@ func main() {
 	groupStore := store.NewGroupStore(primaryDB)
 	receiptStore := store.NewReceiptStore(primaryDB)
 	convStore := store.NewConversationStore(primaryDB)
+	readSvc := services.NewReceiptService(receiptStore, msgStore, groupStore)
 	msgSvc := services.NewMessageService(msgStore)
 	msgSvc.ConvStore = convStore
 	msgSvc.GroupStore = groupStore
+	msgSvc.SeqGen = external.NewSequenceGeneratorAdapter(cache.Client(), primaryDB, msgStore)
 	msgSvc.GroupBatchSize = cfg.GroupBatchSize
 	msgSvc.GroupBatchSleep = time.Duration(cfg.GroupBatchSleepMS) * time.Millisecond
+	msgSvc.EditWindow = time.Duration(cfg.MessageEditWindowSec) * time.Second
+	msgSvc.Receipts = receiptStore
+	msgSvc.RecallWindow = time.Duration(cfg.MessageRecallWindowSec) * time.Second
+	msgSvc.Search = services.NewSearchService(searchIndex, msgStore)
+	msgSvc.Search.ConvStore = convStore
+	msgSvc.Search.GroupStore = groupStore
+
+	// 文件服务（注入配置，支持 OSS 直传）
+	fileService := services.NewFileService(&sqlstore.Stores{Primary: primaryDB}, "./uploads", "http://localhost:8080/files", int64(cfg.OSSMaxSizeMB)*1024*1024).WithConfig(cfg)
+
+	// 消息载荷校验：按类型校验必填字段与大小，附件 URL 须为发送者上传成功的文件
+	msgSvc.Payloads = services.NewPayloadRegistry()
+	msgSvc.Payloads.FileOwner = fileService.OwnsURL
+	msgSvc.Payloads.MaxFileSize = fileService.MaxSize
+
+	// 链接预览：文本消息发送/编辑后异步抓取链接元数据，回填后推送 message_updated
+	if cfg.LinkPreviewEnabled {
+		msgSvc.Unfurl = services.NewUnfurlService(msgStore, time.Duration(cfg.LinkPreviewTimeoutMS)*time.Millisecond)
+		msgSvc.Unfurl.Groups = groupStore
+		// 预览图转存到上传目录下，经 /files 静态服务访问
+		msgSvc.Unfurl.MediaDir = fileService.UploadDir + "/previews"
+		msgSvc.Unfurl.MediaBaseURL = fileService.BaseURL + "/previews"
+	}
+
+	// 敏感词过滤：词典文件按 ModerationReloadSec 热加载；群级覆盖与人工审核队列存主库（关闭过滤时后台仍可处理已有审核）
+	modDict := moderation.NewDictionary(cfg.ModerationDictPath)
+	if _, err := modDict.Reload(true); err != nil {
+		panic(fmt.Sprintf("Moderation dictionary load failed: %v", err))
+	}
+	go modDict.Watch(time.Duration(cfg.ModerationReloadSec)*time.Second, nil)
+	modSvc := services.NewModerationService(modDict, store.NewModerationStore(primaryDB), msgSvc, cfg.ModerationAction)
+
+	// 发送拦截器链（各阶段按注册顺序执行）：WS/HTTP/转发/定时消息的发送均经过此链
+	pipeline := services.NewSendPipeline()
+	pipeline.Use(services.StageBeforePersist, "permission", services.SendPermissionHook(friendStore.IsFriend, groupStore.IsMember))
+	pipeline.Use(services.StageBeforePersist, "mute", services.GroupMuteHook(groupStore))
+	if cfg.ModerationEnabled {
+		msgSvc.Moderation = modSvc
+		pipeline.Use(services.StageBeforePersist, "moderation", modSvc.BeforePersist)
+		pipeline.Use(services.StageAfterPersist, "moderation", modSvc.AfterPersist)
+	}
+	pipeline.Use(services.StageBeforeDeliver, "mentions", services.MentionHook())
+	pipeline.Use(services.StageBeforeDeliver, "metrics", services.SendMetricsHook())
+	if cfg.MessageWebhookURL != "" {
+		webhook := services.NewSendWebhook(cfg.MessageWebhookURL, cfg.MessageWebhookSecret, time.Duration(cfg.MessageWebhookTimeoutMS)*time.Millisecond)
+		pipeline.Use(services.StageBeforeDeliver, "webhook", webhook.Hook)
+	}
+	msgSvc.Pipeline = pipeline
 
 	// 定时自毁清理任务（每分钟一次）；Mongo 侧通常由 TTL 索引自动处理，此任务作为兜底
 	go func() {
@@ -89,8 +145,41 @@ func main() {
 		}
 	}()
 
-	// 文件服务（注入配置，支持 OSS 直传）
-	fileService := services.NewFileService(&sqlstore.Stores{Primary: primaryDB}, "./uploads", "http://localhost:8080/files", int64(cfg.OSSMaxSizeMB)*1024*1024).WithConfig(cfg)
+	// 定时消息调度（每 5 秒一次）；Redis 分布式锁保证多实例下同一时刻仅一个实例发送
+	schedSvc := services.NewScheduleService(store.NewScheduledStore(primaryDB), msgSvc)
+	schedSvc.IsFriend = friendStore.IsFriend
+	schedSvc.IsMember = groupStore.IsMember
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			_ = schedSvc.Dispatch(context.Background(), time.Now())
+		}
+	}()
+
+	// 消息保留策略（每 RetentionIntervalMin 分钟一次，<=0 关闭定时执行）；超期消息按策略归档为压缩文件或直接删除
+	retentionSvc := services.NewRetentionService(store.NewRetentionStore(primaryDB), msgStore, cfg.RetentionArchiveDir)
+	retentionSvc.Default = models.RetentionPolicy{Scope: models.RetentionScopeGlobal, Days: cfg.MessageRetentionDays, Action: cfg.MessageRetentionAction}
+	retentionSvc.Search = msgSvc.Search
+	if cfg.RetentionIntervalMin > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.RetentionIntervalMin) * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				_, _ = retentionSvc.Run(context.Background(), time.Now())
+			}
+		}()
+	}
+
+	// 会话导出（聊天记录 JSONL/HTML/文本 + 本地附件打包为 zip，文件保留 24 小时）
+	exportSvc := services.NewExportService(msgStore, userStore, groupStore, fileService, cfg.ExportDir)
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			exportSvc.Cleanup(time.Now())
+		}
+	}()
 
 	// 收藏服务
 	favoriteService := services.NewFavoriteService(&sqlstore.Stores{Primary: primaryDB, Message: nil})
@@ -242,6 +331,40 @@ func main() {
 		}
 		c.Status(204)
 	})
+	r.GET("/api/conversations/:id/pins", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		pins, err := msgSvc.ListPins(c, uid, c.Param("id"))
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, gin.H{"pins": pins})
+	})
+	r.POST("/api/conversations/:id/pins", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			ServerMsgID string `json:"serverMsgId"`
+			Pinned      bool   `json:"pinned"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		evt, err := msgSvc.Pin(c, uid, c.Param("id"), req.ServerMsgID, req.Pinned)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, evt)
+	})
 	r.POST("/api/conversations/:id/mute", func(c *gin.Context) {
 		uid, ok := authn(c)
 		if !ok {
@@ -414,7 +537,7 @@ func main() {
 
 	// 消息：撤回、会话删除、水位、已读
 	r.POST("/api/messages/recall", func(c *gin.Context) {
-		_, ok := authn(c)
+		uid, ok := authn(c)
 		if !ok {
 			return
 		}
@@ -423,12 +546,165 @@ func main() {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		if err := msgSvc.Recall(c, req.ConvID, req.ServerMsgID); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if _, err := msgSvc.Recall(c, uid, req.ConvID, req.ServerMsgID); err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
 			return
 		}
 		c.Status(204)
 	})
+	r.POST("/api/messages/edit", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			ConvID      string          `json:"convId"`
+			ServerMsgID string          `json:"serverMsgId"`
+			Payload     json.RawMessage `json:"payload"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		evt, err := msgSvc.Edit(c, uid, req.ConvID, req.ServerMsgID, req.Payload)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code, "field": services.PayloadErrorField(err)})
+			return
+		}
+		c.JSON(200, evt)
+	})
+	r.GET("/api/messages/thread", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		convID := c.Query("convId")
+		var fromSeq int64
+		if v := c.Query("fromSeq"); v != "" {
+			_, _ = fmt.Sscan(v, &fromSeq)
+		}
+		limit := parseIntQuery(c, "limit", 50)
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
+		root, replies, err := msgSvc.ListThread(c, uid, convID, c.Query("rootId"), fromSeq, limit)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		msgSvc.AttachReactions(c, uid, convID, append([]*models.Message{root}, replies...))
+		nextCursor := fromSeq
+		if len(replies) > 0 {
+			nextCursor = replies[len(replies)-1].Seq
+		}
+		c.JSON(200, gin.H{"root": root, "replies": replies, "nextCursor": nextCursor, "hasMore": len(replies) == limit})
+	})
+	r.GET("/api/messages/revisions", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		revs, err := msgSvc.ListRevisions(c, uid, c.Query("convId"), c.Query("serverMsgId"))
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, revs)
+	})
+	// 定时消息：创建/列表/编辑/取消（仅 pending 可编辑或取消）
+	r.POST("/api/messages/scheduled", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req services.ScheduleRequest
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		req.ConvType = services.ToConvType(string(req.ConvType))
+		m, err := schedSvc.Create(c, uid, &req)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code, "field": services.PayloadErrorField(err)})
+			return
+		}
+		c.JSON(200, m)
+	})
+	r.GET("/api/messages/scheduled", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		items, err := schedSvc.List(c, uid, c.Query("status"), limit)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"items": items})
+	})
+	r.PUT("/api/messages/scheduled/:id", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			Payload  json.RawMessage `json:"payload"`
+			SendAtMs int64           `json:"sendAtMs"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		m, err := schedSvc.Update(c, uid, c.Param("id"), req.Payload, req.SendAtMs)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code, "field": services.PayloadErrorField(err)})
+			return
+		}
+		c.JSON(200, m)
+	})
+	r.DELETE("/api/messages/scheduled/:id", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		if err := schedSvc.Cancel(c, uid, c.Param("id")); err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, gin.H{"ok": true})
+	})
+	// 消息全文检索：q 必填，convId/from/startMs/endMs 可选过滤
+	r.GET("/api/messages/search", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		params := &services.SearchParams{UserID: uid, Query: c.Query("q"), ConvID: c.Query("convId"), From: c.Query("from")}
+		if v, err := strconv.ParseInt(c.Query("startMs"), 10, 64); err == nil && v > 0 {
+			params.Start = time.UnixMilli(v)
+		}
+		if v, err := strconv.ParseInt(c.Query("endMs"), 10, 64); err == nil && v > 0 {
+			params.End = time.UnixMilli(v)
+		}
+		params.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "20"))
+		params.Offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+		hits, hasMore, err := msgSvc.Search.Search(c, params)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, gin.H{"results": hits, "hasMore": hasMore, "nextOffset": params.Offset + params.Limit})
+	})
+	// 删除会话：清空本人历史并从会话列表隐藏（有新消息时重新出现）
 	r.POST("/api/conversations/delete", func(c *gin.Context) {
 		uid, ok := authn(c)
 		if !ok {
@@ -445,6 +721,73 @@ func main() {
 		}
 		c.Status(204)
 	})
+	// 清空聊天记录：仅隐藏本人视角的历史，会话保留在列表中
+	r.POST("/api/conversations/clear", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req struct{ ConvID string }
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := msgSvc.ClearHistory(c, uid, req.ConvID); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(204)
+	})
+	// 会话导出：创建任务（异步执行），formats 为空时导出全部格式
+	r.POST("/api/conversations/export", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			ConvID  string   `json:"convId"`
+			Formats []string `json:"formats"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := exportSvc.Start(c, uid, req.ConvID, req.Formats, false)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(202, job)
+	})
+	// 会话导出：查询任务状态
+	r.GET("/api/conversations/export/:id", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		job, err := exportSvc.Get(c, uid, c.Param("id"), false)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, job)
+	})
+	// 会话导出：下载 zip（仅任务创建者）
+	r.GET("/api/conversations/export/:id/download", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		p, name, err := exportSvc.File(c, uid, c.Param("id"), false)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.FileAttachment(p, name)
+	})
 	r.POST("/api/messages/read", func(c *gin.Context) {
 		uid, ok := authn(c)
 		if !ok {
@@ -458,13 +801,28 @@ func main() {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		if err := receiptStore.UpsertReadSeq(c, uid, req.ConvID, req.Seq); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
+		if err := readSvc.MarkRead(c, uid, req.ConvID, req.Seq); err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
 			return
 		}
-		cache.Client().Set(c, fmt.Sprintf("im:readseq:%s:%s", uid, req.ConvID), req.Seq, 10*time.Minute)
 		c.Status(204)
 	})
+	// 群消息已读详情：已读/未读成员与 N/M（仅发送者可查看）
+	r.GET("/api/messages/read_by", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		seq, _ := strconv.ParseInt(c.Query("seq"), 10, 64)
+		res, err := readSvc.ReadBy(c, uid, c.Query("convId"), seq)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, res)
+	})
 
 	// 历史消息
 	r.GET("/api/messages/history", func(c *gin.Context) {
@@ -472,7 +830,6 @@ func main() {
 		if !ok {
 			return
 		}
-		_ = uid
 		convID := c.Query("convId")
 		var fromSeq int64
 		if v := c.Query("fromSeq"); v != "" {
@@ -482,12 +839,51 @@ func main() {
 		if v := c.Query("limit"); v != "" {
 			_, _ = fmt.Sscan(v, &limit)
 		}
-		msgs, err := msgSvc.List(c, convID, fromSeq, limit)
+		// direction 缺省时保持旧行为（按 fromSeq 向后拉取，直接返回数组）
+		direction := c.Query("direction")
+		if direction == "" {
+			msgs, err := msgSvc.List(c, uid, convID, fromSeq, limit)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			msgSvc.AttachReactions(c, uid, convID, msgs)
+			c.JSON(200, msgs)
+			return
+		}
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
+		var msgs []*models.Message
+		var err error
+		var nextCursor int64
+		switch direction {
+		case "forward":
+			msgs, err = msgSvc.List(c, uid, convID, fromSeq, limit)
+			nextCursor = fromSeq
+			if len(msgs) > 0 {
+				nextCursor = msgs[len(msgs)-1].Seq
+			}
+		case "backward":
+			// beforeSeq 为空或 0 表示从最新消息开始向上翻
+			var beforeSeq int64
+			if v := c.Query("beforeSeq"); v != "" {
+				_, _ = fmt.Sscan(v, &beforeSeq)
+			}
+			msgs, err = msgSvc.ListBefore(c, uid, convID, beforeSeq, limit)
+			if len(msgs) > 0 {
+				nextCursor = msgs[0].Seq
+			}
+		default:
+			c.JSON(400, gin.H{"error": "direction must be forward or backward"})
+			return
+		}
 		if err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, msgs)
+		msgSvc.AttachReactions(c, uid, convID, msgs)
+		c.JSON(200, gin.H{"messages": msgs, "nextCursor": nextCursor, "hasMore": len(msgs) == limit})
 	})
 
 	// 会话列表（带未读）
@@ -528,9 +924,79 @@ func main() {
 	webrtcSvc := services.NewWebRTCService(cfg.WebRTCSTUNServers, cfg.WebRTCTURNServers, cfg.WebRTCTURNUser, cfg.WebRTCTURNPass, cfg.WebRTCEnabled)
 	wsServer := &ws.Server{JWTSecret: cfg.JWTSecret, MsgSvc: msgSvc, WebRTCSvc: webrtcSvc, SendQPS: cfg.WSSendQPS, SendBurst: cfg.WSSendBurst, Limiter: limiter}
 	wsServer.Receipt = receiptStore
+	wsServer.ReadSvc = readSvc
+	wsServer.AckTimeout = time.Duration(cfg.WSAckTimeoutMS) * time.Millisecond
+	wsServer.AckMaxRetries = cfg.WSAckMaxRetries
+	wsServer.AckWindow = cfg.WSAckWindow
+	wsServer.PingInterval = time.Duration(cfg.WSPingIntervalSec) * time.Second
+	wsServer.PongWait = time.Duration(cfg.WSPongWaitSec) * time.Second
+	wsServer.PresenceTTL = time.Duration(cfg.PresenceTTLSec) * time.Second
+	wsServer.SendQueueSize = cfg.WSSendQueueSize
+	wsServer.SendBatchMax = cfg.WSSendBatchMax
+	wsServer.SlowConsumerPolicy = cfg.WSSlowConsumerPolicy
+	// 节点注册表：整个节点只订阅一个节点投递通道（群消息也按成员路由投递到该通道），在本地扇出到各连接
+	wsServer.Hub = ws.NewHub(cfg.NodeID)
+	go wsServer.Hub.Run(context.Background())
 	wsServer.IsFriend = friendStore.IsFriend
 	wsServer.IsMember = groupStore.IsMember
 	r.GET("/ws", wsServer.Handle)
+	// 在线状态清理（每 PresenceSweepSec 秒一次，<=0 关闭）：心跳过期的设备（节点崩溃、断网等未正常下线）移出在线集合
+	if cfg.PresenceSweepSec > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.PresenceSweepSec) * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				_, _ = cache.SweepStaleDevices(context.Background(), time.Now(), 1000)
+			}
+		}()
+	}
+	// HTTP 发送消息（请求体同 WS send 的 data，与 WS 共用发送拦截器链）
+	r.POST("/api/messages/send", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		qps, burst := wsServer.SendRate()
+		if allowed, _, _ := limiter.Allow(c, "im:tb:http:send:"+uid, qps, burst); !allowed {
+			c.JSON(429, gin.H{"error": "rate limited", "code": "RATE_LIMIT"})
+			return
+		}
+		var p ws.SendPayload
+		if err := c.BindJSON(&p); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		d, err := msgSvc.Send(c, p.Request(uid))
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code, "field": services.PayloadErrorField(err)})
+			return
+		}
+		c.JSON(200, d)
+	})
+	// 消息转发（目标会话权限复用 WS 的 IsFriend/IsMember 回调）
+	r.POST("/api/messages/forward", func(c *gin.Context) {
+		uid, ok := authn(c)
+		if !ok {
+			return
+		}
+		var req services.ForwardRequest
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		req.From = uid
+		for i := range req.Targets {
+			req.Targets[i].ConvType = services.ToConvType(string(req.Targets[i].ConvType))
+		}
+		results, err := msgSvc.Forward(c, &req, wsServer.AuthorizeSend)
+		if err != nil {
+			code, status := services.MessageErrorCode(err)
+			c.JSON(status, gin.H{"error": err.Error(), "code": code})
+			return
+		}
+		c.JSON(200, gin.H{"results": results})
+	})
 
 	// 文件上传 API
 	r.POST("/api/files/upload", func(c *gin.Context) {
@@ -834,7 +1300,7 @@ func main() {
 		// 推送群通知
 		notify := gin.H{"action": "group_notice", "data": gin.H{"id": nid, "groupId": gid, "title": req.Title, "content": req.Content, "createdBy": uid, "createdAt": time.Now().UnixMilli()}}
 		b, _ := json.Marshal(notify)
-		cache.Client().Publish(c, cache.DeliverChannel(gid), b)
+		_ = services.DeliverToGroup(c, groupStore, gid, b)
 		c.JSON(200, gin.H{"id": nid})
 	})
 	r.GET("/api/groups/:id/notices", func(c *gin.Context) {
@@ -855,7 +1321,11 @@ func main() {
 	// TCP 服务（可选）
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go (&tcp.Server{Addr: cfg.TCPAddr, JWTSecret: cfg.JWTSecret}).Start(ctx)
+	tcpServer := &tcp.Server{Addr: cfg.TCPAddr, JWTSecret: cfg.JWTSecret, Gateway: wsServer}
+	tcpServer.Heartbeat = time.Duration(cfg.TCPHeartbeatSec) * time.Second
+	tcpServer.IdleTimeout = time.Duration(cfg.TCPIdleTimeoutSec) * time.Second
+	tcpServer.MaxBody = cfg.TCPMaxFrameKB * 1024
+	go tcpServer.Start(ctx)
 
 	// 管理后台 API
 	adminGroup := r.Group("/api/admin")
@@ -1016,12 +1486,182 @@ func main() {
 			c.JSON(200, activities)
 		})
 
+		// 消息保留策略：列表（含当前生效的全局策略）
+		adminGroup.GET("/retention", func(c *gin.Context) {
+			list, global, err := retentionSvc.ListPolicies(c)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"global": global, "policies": list})
+		})
+
+		// 新增/更新保留策略：{scope: global|group|c2c, targetId, days, action: archive|delete}
+		adminGroup.PUT("/retention", func(c *gin.Context) {
+			var p models.RetentionPolicy
+			if err := c.ShouldBindJSON(&p); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			p.UpdatedBy = c.GetString("adminUserID")
+			if err := retentionSvc.SetPolicy(c, &p); err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(200, p)
+		})
+
+		// 删除保留策略（回退到上一级策略）
+		adminGroup.DELETE("/retention", func(c *gin.Context) {
+			if err := retentionSvc.DeletePolicy(c, c.Query("scope"), c.Query("targetId")); err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"ok": true})
+		})
+
+		// 立即执行一轮保留策略
+		adminGroup.POST("/retention/run", func(c *gin.Context) {
+			stats, err := retentionSvc.Run(c, time.Now())
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, stats)
+		})
+
+		// 合规导出：导出会话完整历史（不受用户删除水位影响）
+		adminGroup.POST("/exports", func(c *gin.Context) {
+			var req struct {
+				ConvID  string   `json:"convId"`
+				Formats []string `json:"formats"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := exportSvc.Start(c, c.GetString("adminUserID"), req.ConvID, req.Formats, true)
+			if err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(202, job)
+		})
+
+		// 合规导出：查询任务状态
+		adminGroup.GET("/exports/:id", func(c *gin.Context) {
+			job, err := exportSvc.Get(c, "", c.Param("id"), true)
+			if err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(200, job)
+		})
+
+		// 合规导出：下载 zip
+		adminGroup.GET("/exports/:id/download", func(c *gin.Context) {
+			p, name, err := exportSvc.File(c, "", c.Param("id"), true)
+			if err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.FileAttachment(p, name)
+		})
+
+		// 敏感词审核队列：?status=pending|approved|deleted&limit=&offset=
+		adminGroup.GET("/moderation/reviews", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+			offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+			list, err := modSvc.ListReviews(c, c.Query("status"), limit, offset)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"reviews": list})
+		})
+
+		// 审核通过：消息保持原样
+		adminGroup.POST("/moderation/reviews/:id/approve", func(c *gin.Context) {
+			r, err := modSvc.Approve(c, c.Param("id"), c.GetString("adminUserID"))
+			if err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(200, r)
+		})
+
+		// 审核删除：强制撤回消息并广播 recalled
+		adminGroup.POST("/moderation/reviews/:id/delete", func(c *gin.Context) {
+			r, err := modSvc.Delete(c, c.Param("id"), c.GetString("adminUserID"))
+			if err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(200, r)
+		})
+
+		// 群级敏感词处理方式覆盖：列表
+		adminGroup.GET("/moderation/groups", func(c *gin.Context) {
+			list, err := modSvc.ListGroupPolicies(c)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"default": modSvc.DefaultAction, "enabled": cfg.ModerationEnabled, "policies": list})
+		})
+
+		// 设置群级处理方式：{action: none|mask|review|reject}
+		adminGroup.PUT("/moderation/groups/:groupId", func(c *gin.Context) {
+			var p models.ModerationGroupPolicy
+			if err := c.ShouldBindJSON(&p); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			p.GroupID = c.Param("groupId")
+			p.UpdatedBy = c.GetString("adminUserID")
+			if err := modSvc.SetGroupPolicy(c, &p); err != nil {
+				code, status := services.MessageErrorCode(err)
+				c.JSON(status, gin.H{"error": err.Error(), "code": code})
+				return
+			}
+			c.JSON(200, p)
+		})
+
+		// 删除群级覆盖（回退到全局默认处理方式）
+		adminGroup.DELETE("/moderation/groups/:groupId", func(c *gin.Context) {
+			if err := modSvc.DeleteGroupPolicy(c, c.Param("groupId")); err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"ok": true})
+		})
+
+		// 立即重新加载敏感词词典
+		adminGroup.POST("/moderation/reload", func(c *gin.Context) {
+			n, err := modDict.Reload(true)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"words": n})
+		})
+
 		// 获取系统设置
 		adminGroup.GET("/settings", func(c *gin.Context) {
+			retentionDays := cfg.MessageRetentionDays
+			if _, global, err := retentionSvc.ListPolicies(c); err == nil {
+				retentionDays = global.Days
+			}
 			settings := gin.H{
 				"systemName":           "Go-IM",
 				"maxGroupMembers":      500,
-				"messageRetentionDays": 30,
+				"messageRetentionDays": retentionDays,
 				"enableRegistration":   true,
 			}
 			c.JSON(200, settings)
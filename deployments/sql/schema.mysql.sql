@@ -85,12 +85,84 @@ CREATE TABLE IF NOT EXISTS user_conversations (
   pinned TINYINT(1) NOT NULL DEFAULT 0,
   muted TINYINT(1) NOT NULL DEFAULT 0,
   draft TEXT NULL,
+  hidden TINYINT(1) NOT NULL DEFAULT 0 COMMENT '已删除会话（有新消息时恢复显示）',
   updated_at DATETIME NOT NULL,
   PRIMARY KEY(user_id, conv_id),
   KEY idx_user (user_id),
   KEY idx_conv (conv_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Conversation pins（会话内置顶消息，summary 为置顶时的消息摘要）
+CREATE TABLE IF NOT EXISTS conversation_pins (
+  conv_id VARCHAR(128) NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  seq BIGINT NOT NULL,
+  msg_type VARCHAR(32) NOT NULL,
+  summary VARCHAR(255) NOT NULL DEFAULT '',
+  pinned_by VARCHAR(64) NOT NULL,
+  pinned_at DATETIME NOT NULL,
+  PRIMARY KEY(conv_id, server_msg_id),
+  KEY idx_conv_time (conv_id, pinned_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Scheduled messages（定时消息，status: pending/sending/sent/canceled/failed）
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+  id VARCHAR(64) PRIMARY KEY,
+  user_id VARCHAR(64) NOT NULL,
+  conv_id VARCHAR(128) NOT NULL,
+  conv_type VARCHAR(16) NOT NULL,
+  to_user_id VARCHAR(64) NOT NULL DEFAULT '',
+  group_id VARCHAR(64) NOT NULL DEFAULT '',
+  type VARCHAR(32) NOT NULL,
+  payload LONGBLOB,
+  send_at DATETIME NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'pending',
+  server_msg_id VARCHAR(64) NOT NULL DEFAULT '',
+  error VARCHAR(255) NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  KEY idx_status_send_at (status, send_at),
+  KEY idx_user_status (user_id, status, send_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Retention policies（消息保留策略，scope: global/group/c2c；global 的 target_id 为空串）
+CREATE TABLE IF NOT EXISTS retention_policies (
+  scope VARCHAR(16) NOT NULL,
+  target_id VARCHAR(128) NOT NULL DEFAULT '',
+  days INT NOT NULL DEFAULT 0,
+  action VARCHAR(16) NOT NULL DEFAULT 'archive',
+  updated_by VARCHAR(64) NOT NULL DEFAULT '',
+  updated_at DATETIME NOT NULL,
+  PRIMARY KEY(scope, target_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Moderation group policies（群级敏感词处理方式覆盖：none/mask/review/reject）
+CREATE TABLE IF NOT EXISTS moderation_group_policies (
+  group_id VARCHAR(64) PRIMARY KEY,
+  action VARCHAR(16) NOT NULL,
+  updated_by VARCHAR(64) NOT NULL DEFAULT '',
+  updated_at DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Moderation reviews（敏感词人工审核队列，status: pending/approved/deleted）
+CREATE TABLE IF NOT EXISTS moderation_reviews (
+  id VARCHAR(64) PRIMARY KEY,
+  conv_id VARCHAR(128) NOT NULL,
+  conv_type VARCHAR(16) NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  seq BIGINT NOT NULL DEFAULT 0,
+  from_user_id VARCHAR(64) NOT NULL,
+  group_id VARCHAR(64) NOT NULL DEFAULT '',
+  content TEXT NOT NULL,
+  words TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'pending',
+  reviewed_by VARCHAR(64) NOT NULL DEFAULT '',
+  reviewed_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  KEY idx_status_created(status, created_at),
+  KEY idx_msg(conv_id, server_msg_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 -- Messages（适配 MySQL，含幂等与检索索引）
 CREATE TABLE IF NOT EXISTS messages (
   server_msg_id VARCHAR(64) PRIMARY KEY,
@@ -107,10 +179,20 @@ CREATE TABLE IF NOT EXISTS messages (
   recalled TINYINT(1) NOT NULL DEFAULT 0,
   expire_at DATETIME NULL,
   burn_after_read TINYINT(1) NOT NULL DEFAULT 0,
+  edited TINYINT(1) NOT NULL DEFAULT 0,
+  version INT NOT NULL DEFAULT 0,
+  edited_at DATETIME NULL,
+  reply_to VARCHAR(64) NOT NULL DEFAULT '',
+  thread_root VARCHAR(64) NOT NULL DEFAULT '',
+  quote BLOB NULL,
+  forward_from BLOB NULL,
+  previews BLOB NULL,
   UNIQUE KEY uniq_conv_client (conv_id, client_msg_id),
-  KEY idx_conv_seq (conv_id, seq),
+  UNIQUE KEY uniq_conv_seq (conv_id, seq),
+  KEY idx_conv_thread (conv_id, thread_root, seq),
   KEY idx_expire_at (expire_at),
-  KEY idx_from_time (from_user_id, timestamp)
+  KEY idx_from_time (from_user_id, timestamp),
+  KEY idx_timestamp (timestamp)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 -- 会话删除水位表
@@ -121,6 +203,40 @@ CREATE TABLE IF NOT EXISTS conv_deletes (
     PRIMARY KEY (owner_id, conv_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='会话删除水位表';
 
+-- 消息编辑历史（编辑前的载荷，version 为被替换时的版本号）
+CREATE TABLE IF NOT EXISTS message_revisions (
+  server_msg_id VARCHAR(64) NOT NULL,
+  conv_id VARCHAR(128) NOT NULL,
+  version INT NOT NULL,
+  payload LONGBLOB,
+  edited_by VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(server_msg_id, version),
+  KEY idx_conv (conv_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 表情回应（每人每表情一条，按消息聚合计数）
+CREATE TABLE IF NOT EXISTS message_reactions (
+  conv_id VARCHAR(128) NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  emoji VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  user_id VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(conv_id, server_msg_id, emoji, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 消息全文检索倒排索引（词项：CJK 单字+二元组、拉丁词小写）
+CREATE TABLE IF NOT EXISTS message_search_index (
+  term VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  conv_id VARCHAR(128) NOT NULL,
+  seq BIGINT NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  from_user_id VARCHAR(64) NOT NULL,
+  ts DATETIME NOT NULL,
+  PRIMARY KEY(term, conv_id, seq),
+  KEY idx_conv_msg (conv_id, server_msg_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 -- 收藏表
 CREATE TABLE IF NOT EXISTS favorites (
     id VARCHAR(32) NOT NULL PRIMARY KEY COMMENT '收藏ID',
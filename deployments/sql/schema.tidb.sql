@@ -49,10 +49,20 @@ CREATE TABLE IF NOT EXISTS messages (
   recalled TINYINT(1) NOT NULL DEFAULT 0,
   expire_at DATETIME NULL,
   burn_after_read TINYINT(1) NOT NULL DEFAULT 0,
+  edited TINYINT(1) NOT NULL DEFAULT 0,
+  version INT NOT NULL DEFAULT 0,
+  edited_at DATETIME NULL,
+  reply_to VARCHAR(64) NOT NULL DEFAULT '',
+  thread_root VARCHAR(64) NOT NULL DEFAULT '',
+  quote BLOB NULL,
+  forward_from BLOB NULL,
+  previews BLOB NULL,
   UNIQUE KEY uniq_conv_client (conv_id, client_msg_id),
-  KEY idx_conv_seq (conv_id, seq),
+  UNIQUE KEY uniq_conv_seq (conv_id, seq),
+  KEY idx_conv_thread (conv_id, thread_root, seq),
   KEY idx_expire_at (expire_at),
-  KEY idx_from_time (from_user_id, timestamp)
+  KEY idx_from_time (from_user_id, timestamp),
+  KEY idx_timestamp (timestamp)
 ) /*T! SHARD_ROW_ID_BITS=4 PRE_SPLIT_REGIONS=8 */ DEFAULT CHARSET=utf8mb4;
 
 -- Per-user conversation delete watermark
@@ -63,6 +73,40 @@ CREATE TABLE IF NOT EXISTS conv_deletes (
   PRIMARY KEY(owner_id, conv_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Message revisions（编辑前的历史载荷，version 为被替换时的版本号）
+CREATE TABLE IF NOT EXISTS message_revisions (
+  server_msg_id VARCHAR(64) NOT NULL,
+  conv_id VARCHAR(128) NOT NULL,
+  version INT NOT NULL,
+  payload BLOB,
+  edited_by VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(server_msg_id, version),
+  KEY idx_conv (conv_id)
+) DEFAULT CHARSET=utf8mb4;
+
+-- 表情回应（每人每表情一条，按消息聚合计数）
+CREATE TABLE IF NOT EXISTS message_reactions (
+  conv_id VARCHAR(128) NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  emoji VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  user_id VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(conv_id, server_msg_id, emoji, user_id)
+) DEFAULT CHARSET=utf8mb4;
+
+-- 消息全文检索倒排索引（词项：CJK 单字+二元组、拉丁词小写）
+CREATE TABLE IF NOT EXISTS message_search_index (
+  term VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+  conv_id VARCHAR(128) NOT NULL,
+  seq BIGINT NOT NULL,
+  server_msg_id VARCHAR(64) NOT NULL,
+  from_user_id VARCHAR(64) NOT NULL,
+  ts DATETIME NOT NULL,
+  PRIMARY KEY(term, conv_id, seq),
+  KEY idx_conv_msg (conv_id, server_msg_id)
+) DEFAULT CHARSET=utf8mb4;
+
 -- 收藏表
 CREATE TABLE IF NOT EXISTS favorites (
     id VARCHAR(32) NOT NULL PRIMARY KEY COMMENT '收藏ID',
@@ -0,0 +1,30 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// 分布式锁：SET NX PX 加锁，持有者令牌校验后释放，避免误删他人持有的锁。
+var unlockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+// LockKey 返回分布式锁键
+func LockKey(name string) string { return "im:lock:" + name }
+
+// TryLock 尝试获取锁，成功返回持有者令牌；锁被占用时返回 ok=false。
+func TryLock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	token := uuid.NewString()
+	ok, err := redisClient.SetNX(ctx, LockKey(name), token, ttl).Result()
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// Unlock 释放锁（仅当令牌匹配时）。
+func Unlock(ctx context.Context, name, token string) error {
+	return unlockScript.Run(ctx, redisClient, []string{LockKey(name)}, token).Err()
+}
@@ -3,6 +3,10 @@ package cache
 import (
 	"context"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -10,7 +14,9 @@ import (
 // 本包封装了 Redis 客户端与常用的在线状态/通道键：
 // - 在线集合：im:presence:online
 // - 用户设备集合：im:presence:devices:<userId>
-// - 投递通道：im:deliver:<userId>
+// - 设备心跳键：im:presence:alive:<userId>:<deviceId>（值为当前连接令牌，带 TTL，心跳续期）
+// - 设备到期索引：im:presence:expiry（ZSET，供清理任务扫描心跳过期的设备）
+// - 投递路由表与节点通道：见 route.go
 // 提供多设备上线/下线的原子更新，以及便捷的在线查询接口。
 var (
 	redisClient *redis.Client
@@ -26,12 +32,22 @@ func InitRedis(addr, pass string, db int) {
 
 func Client() *redis.Client { return redisClient }
 
-// PresenceKey 返回用户在线键；OnlineUsersKey 返回全局在线集合键；DeliverChannel 返回用户投递通道。
+// PresenceKey 返回用户在线键；OnlineUsersKey 返回全局在线集合键。
 func PresenceKey(userID string) string       { return fmt.Sprintf("im:presence:%s", userID) }
 func OnlineUsersKey() string                 { return "im:presence:online" }
-func DeliverChannel(userID string) string    { return fmt.Sprintf("im:deliver:%s", userID) }
 func DevicePresenceKey(userID string) string { return fmt.Sprintf("im:presence:devices:%s", userID) }
 
+// DeviceAliveKey 返回设备心跳键；PresenceExpiryKey 返回设备到期索引（member 为 userId|deviceId，score 为到期毫秒时间戳）。
+func DeviceAliveKey(userID, deviceID string) string {
+	return fmt.Sprintf("im:presence:alive:%s:%s", userID, deviceID)
+}
+func PresenceExpiryKey() string { return "im:presence:expiry" }
+
+// DefaultPresenceTTL 设备在线状态默认 TTL（未收到心跳续期即由清理任务下线）
+const DefaultPresenceTTL = 90 * time.Second
+
+func presenceMember(userID, deviceID string) string { return userID + "|" + deviceID }
+
 // 兼容旧接口（不再直接使用，用于降级）
 func SetOnline(ctx context.Context, userID string) error {
 	return redisClient.SAdd(ctx, OnlineUsersKey(), userID).Err()
@@ -41,27 +57,40 @@ func SetOffline(ctx context.Context, userID string) error {
 }
 
 // SetDeviceOnline/SetDeviceOffline 维护多设备在线状态：
-// - 上线：写入用户设备集合 + 全局在线集合
-// - 下线：从设备集合移除；若集合为空，则从全局在线集合移除
-func SetDeviceOnline(ctx context.Context, userID, deviceID string) error {
+// - 上线/心跳续期：写入用户设备集合 + 全局在线集合，设备心跳键（值为连接令牌）与到期索引按 ttl 续期
+// - 下线：仅当心跳键仍为该连接的令牌时从设备集合移除（设备已重连到新连接时不影响新连接）；若集合为空，则从全局在线集合移除
+// - 节点崩溃等未正常下线的设备，心跳键过期后由 SweepStaleDevices 清理
+func SetDeviceOnline(ctx context.Context, userID, deviceID, token string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultPresenceTTL
+	}
+	now := time.Now()
 	pipe := redisClient.TxPipeline()
 	pipe.SAdd(ctx, DevicePresenceKey(userID), deviceID)
 	pipe.SAdd(ctx, OnlineUsersKey(), userID)
+	pipe.Set(ctx, DeviceAliveKey(userID, deviceID), token, ttl)
+	pipe.ZAdd(ctx, PresenceExpiryKey(), redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: presenceMember(userID, deviceID)})
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func SetDeviceOffline(ctx context.Context, userID, deviceID string) error {
-	// 先移除设备，再根据剩余设备决定是否从全局在线集合移除
-	if err := redisClient.SRem(ctx, DevicePresenceKey(userID), deviceID).Err(); err != nil {
-		return err
-	}
-	if n, err := redisClient.SCard(ctx, DevicePresenceKey(userID)).Result(); err == nil {
-		if n == 0 {
-			_ = redisClient.SRem(ctx, OnlineUsersKey(), userID).Err()
-		}
-	}
-	return nil
+// offlineDeviceScript 原子下线一个设备（仅当心跳键仍为该连接的令牌）。
+// KEYS: 设备心跳键、用户设备集合、全局在线集合、到期索引；ARGV: token、deviceId、userId、member
+var offlineDeviceScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("SREM", KEYS[2], ARGV[2])
+redis.call("ZREM", KEYS[4], ARGV[4])
+if redis.call("SCARD", KEYS[2]) == 0 then
+	redis.call("SREM", KEYS[3], ARGV[3])
+end
+return 1`)
+
+func SetDeviceOffline(ctx context.Context, userID, deviceID, token string) error {
+	keys := []string{DeviceAliveKey(userID, deviceID), DevicePresenceKey(userID), OnlineUsersKey(), PresenceExpiryKey()}
+	return offlineDeviceScript.Run(ctx, redisClient, keys, token, deviceID, userID, presenceMember(userID, deviceID)).Err()
 }
 
 // OnlineDeviceCount/OnlineDevices 查询用户的在线设备信息。
@@ -72,3 +101,44 @@ func OnlineDeviceCount(ctx context.Context, userID string) (int64, error) {
 func OnlineDevices(ctx context.Context, userID string) ([]string, error) {
 	return redisClient.SMembers(ctx, DevicePresenceKey(userID)).Result()
 }
+
+// sweepDeviceScript 原子清理一个到期设备：心跳键仍存在（已续期）时仅校正到期索引，否则下线该设备并删除其投递路由。
+// KEYS: 到期索引、用户设备集合、全局在线集合、设备心跳键、用户路由表；ARGV: member、deviceId、userId、当前毫秒时间戳
+var sweepDeviceScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	redis.call("ZADD", KEYS[1], tonumber(ARGV[4]) + redis.call("PTTL", KEYS[4]), ARGV[1])
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("SREM", KEYS[2], ARGV[2])
+redis.call("HDEL", KEYS[5], ARGV[2])
+if redis.call("SCARD", KEYS[2]) == 0 then
+	redis.call("SREM", KEYS[3], ARGV[3])
+end
+return 1`)
+
+// SweepStaleDevices 下线心跳已过期的设备（每次最多检查 limit 个到期条目），返回清理的设备数；多实例并发执行是安全的。
+func SweepStaleDevices(ctx context.Context, now time.Time, limit int64) (int, error) {
+	members, err := redisClient.ZRangeByScore(ctx, PresenceExpiryKey(), &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.UnixMilli(), 10), Count: limit}).Result()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, m := range members {
+		userID, deviceID, ok := strings.Cut(m, "|")
+		if !ok {
+			_ = redisClient.ZRem(ctx, PresenceExpiryKey(), m).Err()
+			continue
+		}
+		keys := []string{PresenceExpiryKey(), DevicePresenceKey(userID), OnlineUsersKey(), DeviceAliveKey(userID, deviceID), RouteKey(userID)}
+		n, err := sweepDeviceScript.Run(ctx, redisClient, keys, m, deviceID, userID, now.UnixMilli()).Int()
+		if err != nil {
+			return removed, err
+		}
+		if n == 1 {
+			log.Printf("Presence.Sweep offline: user=%s device=%s", userID, deviceID)
+			removed++
+		}
+	}
+	return removed, nil
+}
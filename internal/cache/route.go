@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 投递路由：网关节点只订阅自己的节点通道，发布方按路由表每个目标节点发布一次，由节点在本地扇出到各连接。
+// - 路由表：im:route:<userId>（HASH，deviceId → nodeId），会话建立时登记，断开或心跳过期（清理任务）时删除；键带 TTL 并随心跳续期（路由被清理或过期后由心跳写回）
+// - 节点投递通道：im:deliver:node:<nodeId>，消息为 RoutedDelivery
+var delRouteScript = redis.NewScript(`if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then return redis.call("HDEL", KEYS[1], ARGV[1]) end return 0`)
+
+// touchRouteScript 心跳续期：路由缺失（被清理任务删除或整表过期）或仍指向本节点时写回 设备 → 节点，并重置 TTL。
+// KEYS: 路由表；ARGV: deviceId、nodeId、TTL 毫秒
+var touchRouteScript = redis.NewScript(`
+local cur = redis.call("HGET", KEYS[1], ARGV[1])
+if not cur or cur == ARGV[2] then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1`)
+
+// routeLookupBatch 单次管道查询的路由表数量
+const routeLookupBatch = 500
+
+// RouteKey 返回用户路由表键；NodeChannel 返回节点投递通道。
+func RouteKey(userID string) string    { return "im:route:" + userID }
+func NodeChannel(nodeID string) string { return "im:deliver:node:" + nodeID }
+
+// RoutedDelivery 节点投递通道上的一条投递：payload（编码无关信封）下发给本节点上 users 的全部连接。
+type RoutedDelivery struct {
+	Users   []string        `json:"users"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// SetDeviceRoute 登记设备所在节点（同一设备重连到其它节点时覆盖），路由表 TTL 重置为 ttl。
+func SetDeviceRoute(ctx context.Context, userID, deviceID, nodeID string, ttl time.Duration) error {
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, RouteKey(userID), deviceID, nodeID)
+	pipe.Expire(ctx, RouteKey(userID), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TouchDeviceRoute 心跳续期路由表 TTL，路由缺失时写回（已迁移到其它节点的设备不被旧连接覆盖）。
+func TouchDeviceRoute(ctx context.Context, userID, deviceID, nodeID string, ttl time.Duration) error {
+	return touchRouteScript.Run(ctx, redisClient, []string{RouteKey(userID)}, deviceID, nodeID, ttl.Milliseconds()).Err()
+}
+
+// DelDeviceRoute 删除设备路由（仅当仍指向该节点，避免覆盖设备在其它节点上的新连接）。
+func DelDeviceRoute(ctx context.Context, userID, deviceID, nodeID string) error {
+	return delRouteScript.Run(ctx, redisClient, []string{RouteKey(userID)}, deviceID, nodeID).Err()
+}
+
+// DeliverToUser 将下行信封投递给用户的全部在线设备。
+func DeliverToUser(ctx context.Context, userID string, payload []byte) error {
+	return DeliverToUsers(ctx, []string{userID}, payload)
+}
+
+// DeliverToUsers 按路由表将下行信封投递给多个用户：每个目标节点只发布一次；无路由（离线）的用户跳过，上线后由 sync 补齐。
+func DeliverToUsers(ctx context.Context, userIDs []string, payload []byte) error {
+	seen := make(map[string]bool, len(userIDs))
+	users := make([]string, 0, len(userIDs))
+	for _, uid := range userIDs {
+		if uid != "" && !seen[uid] {
+			seen[uid] = true
+			users = append(users, uid)
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	// 大群按批查询路由，汇总后每个节点仍只发布一次
+	nodes := make(map[string][]string)
+	for start := 0; start < len(users); start += routeLookupBatch {
+		batch := users[start:min(start+routeLookupBatch, len(users))]
+		pipe := redisClient.Pipeline()
+		routes := make([]*redis.MapStringStringCmd, len(batch))
+		for i, uid := range batch {
+			routes[i] = pipe.HGetAll(ctx, RouteKey(uid))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		for i, uid := range batch {
+			added := make(map[string]bool)
+			for _, nodeID := range routes[i].Val() {
+				if !added[nodeID] {
+					added[nodeID] = true
+					nodes[nodeID] = append(nodes[nodeID], uid)
+				}
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	pipe := redisClient.Pipeline()
+	for nodeID, uids := range nodes {
+		b, err := json.Marshal(RoutedDelivery{Users: uids, Payload: payload})
+		if err != nil {
+			return err
+		}
+		pipe.Publish(ctx, NodeChannel(nodeID), b)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -11,6 +11,7 @@ import (
 type Config struct {
 	ListenAddr string `yaml:"listenAddr"`
 	TCPAddr    string `yaml:"tcpAddr"`
+	NodeID     string `yaml:"nodeId"` // 网关节点 ID（投递路由用，集群内唯一；为空时取 主机名-进程号）
 	RedisAddr  string `yaml:"redisAddr"`
 	RedisDB    int    `yaml:"redisDB"`
 	RedisPass  string `yaml:"redisPass"`
@@ -39,9 +40,56 @@ type Config struct {
 	WSSendQPS   int `yaml:"wsSendQPS"`
 	WSSendBurst int `yaml:"wsSendBurst"`
 
+	// WS 投递确认：deliver_ack 超时（毫秒）、最大重投次数、每设备待确认窗口
+	WSAckTimeoutMS  int `yaml:"wsAckTimeoutMs"`
+	WSAckMaxRetries int `yaml:"wsAckMaxRetries"`
+	WSAckWindow     int `yaml:"wsAckWindow"`
+
+	// WS 心跳：服务端 ping 间隔（秒）、读超时（秒，期间未收到 pong 或任何上行帧即断开）
+	WSPingIntervalSec int `yaml:"wsPingIntervalSec"`
+	WSPongWaitSec     int `yaml:"wsPongWaitSec"`
+	// 设备在线状态 TTL（秒，心跳续期）与过期设备清理间隔（秒，<=0 关闭）
+	PresenceTTLSec   int `yaml:"presenceTtlSec"`
+	PresenceSweepSec int `yaml:"presenceSweepSec"`
+
+	// 连接下行队列（WS 与 TCP 共用）：每连接队列容量、写协程单次最多写出的帧数、队列写满时的慢连接策略（evict 断开 / drop 丢弃）
+	WSSendQueueSize      int    `yaml:"wsSendQueueSize"`
+	WSSendBatchMax       int    `yaml:"wsSendBatchMax"`
+	WSSlowConsumerPolicy string `yaml:"wsSlowConsumerPolicy"`
+
+	// TCP 帧协议接入（tcpAddr 非空时启用）：建议心跳间隔（秒）、读空闲超时（秒）、单帧上限（KB）
+	TCPHeartbeatSec   int `yaml:"tcpHeartbeatSec"`
+	TCPIdleTimeoutSec int `yaml:"tcpIdleTimeoutSec"`
+	TCPMaxFrameKB     int `yaml:"tcpMaxFrameKb"`
+
 	// 指标开关
 	EnableMetrics bool `yaml:"enableMetrics"`
 
+	// 消息编辑窗口（秒，<=0 表示不限制）
+	MessageEditWindowSec int `yaml:"messageEditWindowSec"`
+	// 消息撤回窗口（秒，<=0 表示不限制；群主/管理员不受限）
+	MessageRecallWindowSec int `yaml:"messageRecallWindowSec"`
+
+	// 消息保留策略（全局默认，可被后台按群/单聊覆盖）：保留天数（<=0 永久）、到期处理 archive|delete、归档目录、扫描间隔（分钟）
+	MessageRetentionDays   int    `yaml:"messageRetentionDays"`
+	MessageRetentionAction string `yaml:"messageRetentionAction"`
+	RetentionArchiveDir    string `yaml:"retentionArchiveDir"`
+	RetentionIntervalMin   int    `yaml:"retentionIntervalMin"`
+	// 会话导出文件目录（导出结果保留 24 小时）
+	ExportDir string `yaml:"exportDir"`
+	// 链接预览：服务端抓取文本消息中链接的 OpenGraph 元数据（单次请求超时，毫秒）
+	LinkPreviewEnabled   bool `yaml:"linkPreviewEnabled"`
+	LinkPreviewTimeoutMS int  `yaml:"linkPreviewTimeoutMs"`
+	// 敏感词过滤：词典文件（每行一个词，可用 "词|处理方式"）、默认处理方式 mask|review|reject、词典热加载检查间隔（秒）
+	ModerationEnabled   bool   `yaml:"moderationEnabled"`
+	ModerationDictPath  string `yaml:"moderationDictPath"`
+	ModerationAction    string `yaml:"moderationAction"`
+	ModerationReloadSec int    `yaml:"moderationReloadSec"`
+	// 消息发送 Webhook：每条消息分发前异步 POST 到该地址（为空关闭）；Secret 非空时附带 HMAC-SHA256 签名
+	MessageWebhookURL       string `yaml:"messageWebhookUrl"`
+	MessageWebhookSecret    string `yaml:"messageWebhookSecret"`
+	MessageWebhookTimeoutMS int    `yaml:"messageWebhookTimeoutMs"`
+
 	// WebRTC 音视频配置
 	WebRTCSTUNServers []string `yaml:"webrtcSTUNServers"` // STUN 服务器列表
 	WebRTCTURNServers []string `yaml:"webrtcTURNServers"` // TURN 服务器列表
@@ -88,6 +136,42 @@ func Load() *Config {
 		WSSendBurst:   40,
 		EnableMetrics: true,
 
+		WSAckTimeoutMS:  5000,
+		WSAckMaxRetries: 3,
+		WSAckWindow:     256,
+
+		WSPingIntervalSec: 25,
+		WSPongWaitSec:     60,
+		PresenceTTLSec:    90,
+		PresenceSweepSec:  30,
+
+		WSSendQueueSize:      256,
+		WSSendBatchMax:       32,
+		WSSlowConsumerPolicy: "evict",
+
+		TCPHeartbeatSec:   30,
+		TCPIdleTimeoutSec: 90,
+		TCPMaxFrameKB:     1024,
+
+		MessageEditWindowSec:   900,
+		MessageRecallWindowSec: 300,
+
+		MessageRetentionDays:   0,
+		MessageRetentionAction: "archive",
+		RetentionArchiveDir:    "./archives",
+		RetentionIntervalMin:   60,
+		ExportDir:              "./exports",
+
+		LinkPreviewEnabled:   true,
+		LinkPreviewTimeoutMS: 5000,
+
+		ModerationEnabled:   true,
+		ModerationDictPath:  "./sensitive_words.txt",
+		ModerationAction:    "mask",
+		ModerationReloadSec: 30,
+
+		MessageWebhookTimeoutMS: 5000,
+
 		WebRTCSTUNServers: parseServerList("stun:stun.l.google.com:19302,stun:stun1.l.google.com:19302"),
 		WebRTCTURNServers: nil,
 		WebRTCTURNUser:    "",
@@ -144,6 +228,7 @@ func applyEnv(cfg *Config) {
 
 	setStr("IM_LISTEN_ADDR", &cfg.ListenAddr)
 	setStr("IM_TCP_ADDR", &cfg.TCPAddr)
+	setStr("IM_NODE_ID", &cfg.NodeID)
 	setStr("IM_REDIS_ADDR", &cfg.RedisAddr)
 	setStr("IM_REDIS_PASS", &cfg.RedisPass)
 	setInt("IM_REDIS_DB", &cfg.RedisDB)
@@ -165,8 +250,38 @@ func applyEnv(cfg *Config) {
 
 	setInt("IM_WS_SEND_QPS", &cfg.WSSendQPS)
 	setInt("IM_WS_SEND_BURST", &cfg.WSSendBurst)
+	setInt("IM_WS_ACK_TIMEOUT_MS", &cfg.WSAckTimeoutMS)
+	setInt("IM_WS_ACK_MAX_RETRIES", &cfg.WSAckMaxRetries)
+	setInt("IM_WS_ACK_WINDOW", &cfg.WSAckWindow)
+	setInt("IM_WS_PING_INTERVAL_SEC", &cfg.WSPingIntervalSec)
+	setInt("IM_WS_PONG_WAIT_SEC", &cfg.WSPongWaitSec)
+	setInt("IM_PRESENCE_TTL_SEC", &cfg.PresenceTTLSec)
+	setInt("IM_PRESENCE_SWEEP_SEC", &cfg.PresenceSweepSec)
+	setInt("IM_WS_SEND_QUEUE_SIZE", &cfg.WSSendQueueSize)
+	setInt("IM_WS_SEND_BATCH_MAX", &cfg.WSSendBatchMax)
+	setStr("IM_WS_SLOW_CONSUMER_POLICY", &cfg.WSSlowConsumerPolicy)
+	setInt("IM_TCP_HEARTBEAT_SEC", &cfg.TCPHeartbeatSec)
+	setInt("IM_TCP_IDLE_TIMEOUT_SEC", &cfg.TCPIdleTimeoutSec)
+	setInt("IM_TCP_MAX_FRAME_KB", &cfg.TCPMaxFrameKB)
 	setBool("IM_ENABLE_METRICS", &cfg.EnableMetrics)
 
+	setInt("IM_MESSAGE_EDIT_WINDOW_SEC", &cfg.MessageEditWindowSec)
+	setInt("IM_MESSAGE_RECALL_WINDOW_SEC", &cfg.MessageRecallWindowSec)
+	setInt("IM_MESSAGE_RETENTION_DAYS", &cfg.MessageRetentionDays)
+	setStr("IM_MESSAGE_RETENTION_ACTION", &cfg.MessageRetentionAction)
+	setStr("IM_RETENTION_ARCHIVE_DIR", &cfg.RetentionArchiveDir)
+	setInt("IM_RETENTION_INTERVAL_MIN", &cfg.RetentionIntervalMin)
+	setStr("IM_EXPORT_DIR", &cfg.ExportDir)
+	setBool("IM_LINK_PREVIEW_ENABLED", &cfg.LinkPreviewEnabled)
+	setInt("IM_LINK_PREVIEW_TIMEOUT_MS", &cfg.LinkPreviewTimeoutMS)
+	setBool("IM_MODERATION_ENABLED", &cfg.ModerationEnabled)
+	setStr("IM_MODERATION_DICT_PATH", &cfg.ModerationDictPath)
+	setStr("IM_MODERATION_ACTION", &cfg.ModerationAction)
+	setInt("IM_MODERATION_RELOAD_SEC", &cfg.ModerationReloadSec)
+	setStr("IM_MESSAGE_WEBHOOK_URL", &cfg.MessageWebhookURL)
+	setStr("IM_MESSAGE_WEBHOOK_SECRET", &cfg.MessageWebhookSecret)
+	setInt("IM_MESSAGE_WEBHOOK_TIMEOUT_MS", &cfg.MessageWebhookTimeoutMS)
+
 	setList("IM_WEBRTC_STUN_SERVERS", &cfg.WebRTCSTUNServers)
 	setList("IM_WEBRTC_TURN_SERVERS", &cfg.WebRTCTURNServers)
 	setStr("IM_WEBRTC_TURN_USER", &cfg.WebRTCTURNUser)
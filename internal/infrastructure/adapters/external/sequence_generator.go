@@ -0,0 +1,138 @@
+package external
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"go-im/internal/application/ports"
+)
+
+// MaxSeqReader 查询会话已入库消息的最大 seq（消息存储实现，MySQL/TiDB/MongoDB 均可）
+type MaxSeqReader interface {
+	MaxSeq(ctx context.Context, convID string) (int64, error)
+}
+
+// SequenceGeneratorAdapter 会话内序列号生成器适配器
+// - 主路径：Redis INCR（键不过期），保证同一会话跨节点严格递增且连续
+// - 冷启动：Redis 键不存在时以 GREATEST(conversations.last_seq, 已入库消息最大 seq) 作为下限初始化（SET NX）；last_seq 在入库后写入，可能滞后
+// - 配置了 Redis 时不降级：Redis 不可用则返回错误（发送失败），避免与仍能访问 Redis 的节点发放重复序号
+// - 未配置 Redis 时在 conversations 表上原子自增 last_seq（同样以已入库最大 seq 为下限）
+type SequenceGeneratorAdapter struct {
+	client *redis.Client
+	db     *sql.DB
+	msgs   MaxSeqReader
+}
+
+// NewSequenceGeneratorAdapter 创建序列号生成器适配器；msgs 为空时仅以 conversations.last_seq 为下限。
+func NewSequenceGeneratorAdapter(client *redis.Client, db *sql.DB, msgs MaxSeqReader) ports.SequenceGenerator {
+	return &SequenceGeneratorAdapter{client: client, db: db, msgs: msgs}
+}
+
+func seqKey(convID string) string { return fmt.Sprintf("im:seq:%s", convID) }
+
+// incrIfExists 仅当键存在时自增；键不存在返回 nil，由调用方完成初始化
+var incrIfExists = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return false
+end
+return redis.call('INCR', KEYS[1])
+`)
+
+// NextSeq 获取下一个序列号
+func (g *SequenceGeneratorAdapter) NextSeq(ctx context.Context, convID string) (int64, error) {
+	if convID == "" {
+		return 0, fmt.Errorf("empty convId")
+	}
+	if g.client == nil {
+		return g.nextSeqFromDB(ctx, convID)
+	}
+	key := seqKey(convID)
+	seq, err := incrIfExists.Run(ctx, g.client, []string{key}).Int64()
+	if err == nil {
+		return seq, nil
+	}
+	if err != redis.Nil {
+		return 0, fmt.Errorf("sequence generator: convId=%s: %w", convID, err)
+	}
+
+	// 键不存在：以持久化水位为下限初始化，多个节点并发初始化时仅一个生效
+	floor, err := g.loadFloor(ctx, convID)
+	if err != nil {
+		return 0, err
+	}
+	if err := g.client.SetNX(ctx, key, floor, 0).Err(); err != nil {
+		return 0, fmt.Errorf("sequence generator: convId=%s: %w", convID, err)
+	}
+	seq, err = incrIfExists.Run(ctx, g.client, []string{key}).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("sequence generator: convId=%s: %w", convID, err)
+	}
+	return seq, nil
+}
+
+// CurrentSeq 获取当前序列号
+func (g *SequenceGeneratorAdapter) CurrentSeq(ctx context.Context, convID string) (int64, error) {
+	if g.client != nil {
+		seq, err := g.client.Get(ctx, seqKey(convID)).Int64()
+		if err == nil {
+			return seq, nil
+		}
+	}
+	return g.loadFloor(ctx, convID)
+}
+
+// loadFloor 读取 GREATEST(conversations.last_seq, 已入库消息最大 seq)（会话不存在时为 0）
+func (g *SequenceGeneratorAdapter) loadFloor(ctx context.Context, convID string) (int64, error) {
+	lastSeq, err := g.loadLastSeq(ctx, convID)
+	if err != nil {
+		return 0, err
+	}
+	maxSeq, err := g.loadMaxSeq(ctx, convID)
+	if err != nil {
+		return 0, err
+	}
+	return max(lastSeq, maxSeq), nil
+}
+
+// loadLastSeq 读取 conversations.last_seq（会话不存在时为 0）
+func (g *SequenceGeneratorAdapter) loadLastSeq(ctx context.Context, convID string) (int64, error) {
+	if g.db == nil {
+		return 0, nil
+	}
+	var seq sql.NullInt64
+	err := g.db.QueryRowContext(ctx, `SELECT last_seq FROM conversations WHERE id=?`, convID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return seq.Int64, nil
+}
+
+func (g *SequenceGeneratorAdapter) loadMaxSeq(ctx context.Context, convID string) (int64, error) {
+	if g.msgs == nil {
+		return 0, nil
+	}
+	return g.msgs.MaxSeq(ctx, convID)
+}
+
+// nextSeqFromDB 在 conversations 表上原子自增 last_seq（LAST_INSERT_ID(expr) 计数器写法），以已入库最大 seq 为下限
+func (g *SequenceGeneratorAdapter) nextSeqFromDB(ctx context.Context, convID string) (int64, error) {
+	if g.db == nil {
+		return 0, fmt.Errorf("sequence generator unavailable: convId=%s", convID)
+	}
+	maxSeq, err := g.loadMaxSeq(ctx, convID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := g.db.ExecContext(ctx, `INSERT INTO conversations(id, conv_type, last_seq, updated_at) VALUES(?, '', LAST_INSERT_ID(?+1), ?) ON DUPLICATE KEY UPDATE last_seq=LAST_INSERT_ID(GREATEST(last_seq, ?)+1)`, convID, maxSeq, time.Now(), maxSeq)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -10,9 +10,36 @@ var (
 	MessageSendLatency = prometheus.NewHistogram(
 		prometheus.HistogramOpts{Name: "im_send_latency_ms", Help: "消息发送端到端延迟(近似)", Buckets: prometheus.LinearBuckets(5, 5, 20)},
 	)
+	MessagesSentTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "im_messages_sent_total", Help: "发送成功的消息数"},
+		[]string{"conv_type", "type"},
+	)
+	// 连接下行队列：transport 为 ws/tcp
+	SendQueueFrames = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "im_conn_send_queue_frames", Help: "各连接下行队列中待写出的帧总数"},
+		[]string{"transport"},
+	)
+	SendQueueDepth = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "im_conn_send_queue_depth", Help: "入队时连接下行队列的深度", Buckets: prometheus.ExponentialBuckets(1, 2, 10)},
+		[]string{"transport"},
+	)
+	SendBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "im_conn_send_batch_size", Help: "写协程单次批量写出的帧数", Buckets: prometheus.ExponentialBuckets(1, 2, 7)},
+		[]string{"transport"},
+	)
+	SendQueueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "im_conn_send_dropped_total", Help: "队列已满被丢弃的下行帧数（drop 策略）"},
+		[]string{"transport"},
+	)
+	SlowConsumerEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "im_conn_slow_consumer_evictions_total", Help: "因下行队列已满被断开的慢连接数（evict 策略）"},
+		[]string{"transport"},
+	)
 )
 
 func Init() {
 	prometheus.MustRegister(WSMessagesTotal)
 	prometheus.MustRegister(MessageSendLatency)
+	prometheus.MustRegister(MessagesSentTotal)
+	prometheus.MustRegister(SendQueueFrames, SendQueueDepth, SendBatchSize, SendQueueDropped, SlowConsumerEvictions)
 }
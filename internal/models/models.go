@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // User/Group/Friend/Conversation/Message 等为核心领域模型。
 // Message 增加自毁/过期字段以支持阅后即焚与定时自毁能力；
@@ -64,6 +67,7 @@ type Conversation struct {
 // - Seq 为会话内顺序（建议使用严格递增的会话内序列生成器）
 // - ExpireAt 到期自动清理（SQL 由后台任务；Mongo 由 TTL 索引）
 // - BurnAfterRead 阅后即焚（对端 read 后触发撤回并广播）
+// - Edited/Version 编辑标记与版本号（每次编辑 +1，历史版本见 MessageRevision）
 type Message struct {
 	ServerMsgID string           `json:"serverMsgId"`
 	ClientMsgID string           `json:"clientMsgId"`
@@ -85,6 +89,189 @@ type Message struct {
 	// 自毁/过期
 	ExpireAt      *time.Time `json:"expireAt,omitempty"`      // 定时自毁时间（为空表示不过期）
 	BurnAfterRead bool       `json:"burnAfterRead,omitempty"` // 阅后即焚（阅读后标记撤回）
+	// 编辑
+	Edited   bool       `json:"edited,omitempty"`   // 是否被编辑过
+	Version  int        `json:"version,omitempty"`  // 编辑版本（初始 0）
+	EditedAt *time.Time `json:"editedAt,omitempty"` // 最近编辑时间
+	// 引用回复/话题
+	ReplyTo    string         `json:"replyTo,omitempty"`    // 被引用消息的 serverMsgId
+	ThreadRoot string         `json:"threadRoot,omitempty"` // 所属话题根消息的 serverMsgId（为空表示主时间线）
+	Quote      *QuotedMessage `json:"quote,omitempty"`      // 被引用消息快照
+	// 逐条转发时记录来源
+	ForwardedFrom *ForwardInfo `json:"forwardedFrom,omitempty"`
+	// 表情回应聚合（查询时填充，不入库）
+	Reactions []*ReactionCount `json:"reactions,omitempty"`
+	// 链接预览（发送后由服务端异步抓取并回填）
+	Previews []*LinkPreview `json:"previews,omitempty"`
+}
+
+// LinkPreview 文本消息中链接的预览信息（OpenGraph/Twitter Card 元数据）。
+type LinkPreview struct {
+	URL         string `json:"url" bson:"url"`
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	Image       string `json:"image,omitempty" bson:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty" bson:"site_name,omitempty"`
+	Favicon     string `json:"favicon,omitempty" bson:"favicon,omitempty"`
+}
+
+// QuotedMessage 引用回复时附带的被引用消息快照（发送时截取，不随原消息后续编辑变化）。
+type QuotedMessage struct {
+	ServerMsgID string `json:"serverMsgId" bson:"server_msg_id"`
+	Seq         int64  `json:"seq" bson:"seq"`
+	From        string `json:"from" bson:"from"`
+	Type        string `json:"type" bson:"type"`
+	Summary     string `json:"summary" bson:"summary"` // 文本截断或类型占位，如 [图片]
+}
+
+// MessageRevision 消息编辑前的历史版本（Version 为被替换掉的版本号）。
+type MessageRevision struct {
+	ServerMsgID string    `json:"serverMsgId"`
+	ConvID      string    `json:"convId"`
+	Version     int       `json:"version"`
+	Payload     []byte    `json:"payload"`
+	EditedBy    string    `json:"editedBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ForwardInfo 转发来源（原会话、原消息与原发送者）。
+type ForwardInfo struct {
+	ConvID      string `json:"convId" bson:"conv_id"`
+	ServerMsgID string `json:"serverMsgId" bson:"server_msg_id"`
+	From        string `json:"from" bson:"from"`
+	Timestamp   int64  `json:"timestamp" bson:"timestamp"` // 原消息发送时间（毫秒）
+}
+
+// PinnedMessage 会话内置顶消息（Summary 为置顶时的摘要；Message 仅在详情接口中填充）。
+type PinnedMessage struct {
+	ConvID      string    `json:"convId"`
+	ServerMsgID string    `json:"serverMsgId"`
+	Seq         int64     `json:"seq"`
+	Type        string    `json:"type"`
+	Summary     string    `json:"summary"`
+	PinnedBy    string    `json:"pinnedBy"`
+	PinnedAt    time.Time `json:"pinnedAt"`
+	Message     *Message  `json:"message,omitempty"`
+}
+
+// 保留策略作用域与到期处理方式
+const (
+	RetentionScopeGlobal = "global" // 全局默认
+	RetentionScopeGroup  = "group"  // 指定群（TargetID 为 groupId）
+	RetentionScopeC2C    = "c2c"    // 指定单聊会话（TargetID 为 convId）
+
+	RetentionActionArchive = "archive" // 归档为压缩文件后删除
+	RetentionActionDelete  = "delete"  // 直接删除
+)
+
+// RetentionPolicy 消息保留策略：超过 Days 天的消息按 Action 处理（Days<=0 表示永久保留）。
+type RetentionPolicy struct {
+	Scope     string    `json:"scope"`
+	TargetID  string    `json:"targetId,omitempty"`
+	Days      int       `json:"days"`
+	Action    string    `json:"action"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// 敏感词审核记录状态
+const (
+	ModerationReviewPending  = "pending"  // 待审核
+	ModerationReviewApproved = "approved" // 审核通过，消息保留
+	ModerationReviewDeleted  = "deleted"  // 审核删除，消息已撤回
+)
+
+// ModerationReview 命中 review 处理方式的消息进入人工审核队列；Content 为发送时的文本快照。
+type ModerationReview struct {
+	ID          string           `json:"id"`
+	ConvID      string           `json:"convId"`
+	ConvType    ConversationType `json:"convType"`
+	ServerMsgID string           `json:"serverMsgId"`
+	Seq         int64            `json:"seq"`
+	FromUserID  string           `json:"from"`
+	GroupID     string           `json:"groupId,omitempty"`
+	Content     string           `json:"content"`
+	Words       []string         `json:"words"`
+	Status      string           `json:"status"`
+	ReviewedBy  string           `json:"reviewedBy,omitempty"`
+	ReviewedAt  *time.Time       `json:"reviewedAt,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+}
+
+// ModerationGroupPolicy 群级敏感词处理方式覆盖（none 表示该群关闭过滤）。
+type ModerationGroupPolicy struct {
+	GroupID   string    `json:"groupId"`
+	Action    string    `json:"action"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// 会话导出任务状态
+const (
+	ExportStatusPending = "pending" // 已创建，等待执行
+	ExportStatusRunning = "running" // 导出中
+	ExportStatusDone    = "done"    // 已完成，可下载
+	ExportStatusFailed  = "failed"  // 失败（Error 记录原因）
+)
+
+// ExportJob 会话导出任务：按 Formats 渲染聊天记录并连同本地附件打包为 zip。
+// Admin 为 true 表示管理后台（合规）导出，不受用户删除水位影响，仅管理员可下载。
+type ExportJob struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"userId"`
+	ConvID     string     `json:"convId"`
+	Formats    []string   `json:"formats"`
+	Admin      bool       `json:"admin,omitempty"`
+	Status     string     `json:"status"`
+	Messages   int        `json:"messages"`
+	Files      int        `json:"files"`
+	Size       int64      `json:"size,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// 定时消息状态
+const (
+	ScheduledStatusPending  = "pending"  // 待发送（可编辑/取消）
+	ScheduledStatusSending  = "sending"  // 已被某实例领取，发送中
+	ScheduledStatusSent     = "sent"     // 已发送
+	ScheduledStatusCanceled = "canceled" // 已取消
+	ScheduledStatusFailed   = "failed"   // 发送失败（Error 记录错误码）
+)
+
+// ScheduledMessage 定时消息：到达 SendAt 后以 UserID 身份发送，ServerMsgID 为发送后的消息 ID。
+type ScheduledMessage struct {
+	ID          string           `json:"id"`
+	UserID      string           `json:"userId"`
+	ConvID      string           `json:"convId"`
+	ConvType    ConversationType `json:"convType"`
+	ToUserID    string           `json:"to,omitempty"`
+	GroupID     string           `json:"groupId,omitempty"`
+	Type        string           `json:"type"`
+	Payload     []byte           `json:"payload"`
+	SendAt      time.Time        `json:"sendAt"`
+	Status      string           `json:"status"`
+	ServerMsgID string           `json:"serverMsgId,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	UpdatedAt   time.Time        `json:"updatedAt"`
+}
+
+// MessageReaction 表情回应，(convId, serverMsgId, emoji, userId) 唯一。
+type MessageReaction struct {
+	ConvID      string    `json:"convId"`
+	ServerMsgID string    `json:"serverMsgId"`
+	Emoji       string    `json:"emoji"`
+	UserID      string    `json:"userId"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ReactionCount 单条消息上某个表情的聚合计数。
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"` // 当前用户是否回应过
 }
 
 type ReadReceipt struct {
@@ -169,6 +356,7 @@ const (
 	MessageTypeLocation = "location" // 位置消息
 	MessageTypeCustom   = "custom"   // 自定义消息
 	MessageTypeStream   = "stream"   // 流式消息
+	MessageTypeMerged   = "merged"   // 合并转发消息
 )
 
 // 文本消息载荷
@@ -238,6 +426,22 @@ type CustomPayload struct {
 	Data map[string]interface{} `json:"data"` // 自定义数据
 }
 
+// 合并转发消息载荷：内嵌所选消息的快照（按原 seq 升序）
+type MergedPayload struct {
+	Title string       `json:"title"` // 标题，如“群聊的聊天记录”
+	Items []MergedItem `json:"items"` // 消息快照
+}
+
+// 合并转发中的单条消息快照
+type MergedItem struct {
+	ServerMsgID string          `json:"serverMsgId"`
+	ConvID      string          `json:"convId"`
+	From        string          `json:"from"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Timestamp   int64           `json:"timestamp"` // 毫秒
+}
+
 // 收藏消息
 type Favorite struct {
 	ID        string    `json:"id" db:"id"`                // 收藏 ID
@@ -0,0 +1,106 @@
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dictionary 基于文件的敏感词词典，支持热加载：
+// - 每行一个词，可用 "词|处理方式" 为单个词指定 mask/review/reject；# 开头为注释
+// - Watch 定期检查文件修改时间，变化后重建匹配器并原子替换，匹配过程无需加锁
+// - 文件不存在时词表为空（不拦截任何内容）
+type Dictionary struct {
+	Path string
+
+	matcher atomic.Pointer[Matcher]
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func NewDictionary(path string) *Dictionary {
+	d := &Dictionary{Path: path}
+	d.matcher.Store(NewMatcher(nil))
+	return d
+}
+
+// Matcher 当前生效的匹配器。
+func (d *Dictionary) Matcher() *Matcher { return d.matcher.Load() }
+
+// Reload 重新加载词典文件；force=false 时文件未变化则跳过。
+func (d *Dictionary) Reload(force bool) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info, err := os.Stat(d.Path)
+	if os.IsNotExist(err) {
+		d.matcher.Store(NewMatcher(nil))
+		d.modTime = time.Time{}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !force && info.ModTime().Equal(d.modTime) {
+		return d.Matcher().Len(), nil
+	}
+	words, err := loadWords(d.Path)
+	if err != nil {
+		return 0, err
+	}
+	m := NewMatcher(words)
+	d.matcher.Store(m)
+	d.modTime = info.ModTime()
+	log.Printf("Moderation.Dictionary reloaded: path=%s words=%d", d.Path, m.Len())
+	return m.Len(), nil
+}
+
+// Watch 按 interval 轮询文件变化，直到 stop 关闭。
+func (d *Dictionary) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := d.Reload(false); err != nil {
+				log.Printf("Moderation.Dictionary reload error: path=%s err=%v", d.Path, err)
+			}
+		}
+	}
+}
+
+func loadWords(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	words := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word, action := line, ""
+		if i := strings.LastIndex(line, "|"); i >= 0 {
+			word, action = strings.TrimSpace(line[:i]), strings.ToLower(strings.TrimSpace(line[i+1:]))
+			if !ValidAction(action) {
+				return nil, fmt.Errorf("%s:%d: invalid action %q", path, n, action)
+			}
+		}
+		if word != "" {
+			words[word] = Stricter(words[word], action)
+		}
+	}
+	return words, sc.Err()
+}
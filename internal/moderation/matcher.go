@@ -0,0 +1,143 @@
+package moderation
+
+import "unicode"
+
+// 命中敏感词后的处理方式
+const (
+	ActionNone   = "none"   // 不处理（群覆盖时表示关闭过滤）
+	ActionMask   = "mask"   // 将命中的词替换为 *
+	ActionReview = "review" // 正常发送，同时进入人工审核队列
+	ActionReject = "reject" // 拒绝发送
+)
+
+// actionRank 多个命中时取最严格的处理方式。
+var actionRank = map[string]int{ActionNone: 0, ActionMask: 1, ActionReview: 2, ActionReject: 3}
+
+// ValidAction 判断是否为合法的处理方式。
+func ValidAction(a string) bool {
+	_, ok := actionRank[a]
+	return ok
+}
+
+// Stricter 返回 a、b 中更严格的处理方式。
+func Stricter(a, b string) string {
+	if actionRank[b] > actionRank[a] {
+		return b
+	}
+	return a
+}
+
+// Match 一次命中：[Start, End) 为原文中的 rune 下标。
+type Match struct {
+	Word   string `json:"word"`
+	Action string `json:"action"`
+	Start  int    `json:"-"`
+	End    int    `json:"-"`
+}
+
+type acNode struct {
+	next   map[rune]int
+	fail   int
+	output []int // 以该节点结尾的词（words 下标）
+}
+
+// Matcher Aho-Corasick 多模式匹配器（构建后只读，可并发使用）：
+// - 按 rune 匹配，忽略大小写
+// - 每个词携带处理方式，空字符串表示使用默认处理方式
+type Matcher struct {
+	nodes   []acNode
+	words   []string
+	actions []string
+}
+
+// NewMatcher 由词表（词 -> 处理方式）构建匹配器。
+func NewMatcher(words map[string]string) *Matcher {
+	m := &Matcher{nodes: []acNode{{next: map[rune]int{}}}}
+	for w, action := range words {
+		rs := []rune(w)
+		if len(rs) == 0 {
+			continue
+		}
+		cur := 0
+		for _, r := range rs {
+			r = unicode.ToLower(r)
+			nxt, ok := m.nodes[cur].next[r]
+			if !ok {
+				nxt = len(m.nodes)
+				m.nodes = append(m.nodes, acNode{next: map[rune]int{}})
+				m.nodes[cur].next[r] = nxt
+			}
+			cur = nxt
+		}
+		m.nodes[cur].output = append(m.nodes[cur].output, len(m.words))
+		m.words = append(m.words, w)
+		m.actions = append(m.actions, action)
+	}
+	// BFS 构建失败指针，并合并失败链上的输出
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for r, child := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for f != 0 {
+				if _, ok := m.nodes[f].next[r]; ok {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if nxt, ok := m.nodes[f].next[r]; ok && nxt != child {
+				m.nodes[child].fail = nxt
+			}
+			m.nodes[child].output = append(m.nodes[child].output, m.nodes[m.nodes[child].fail].output...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// Len 词表大小。
+func (m *Matcher) Len() int { return len(m.words) }
+
+// Find 返回文本中的全部命中（可能重叠）。
+func (m *Matcher) Find(text string) []Match {
+	if m == nil || len(m.words) == 0 {
+		return nil
+	}
+	var res []Match
+	cur := 0
+	for i, r := range []rune(text) {
+		r = unicode.ToLower(r)
+		for cur != 0 {
+			if _, ok := m.nodes[cur].next[r]; ok {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		if nxt, ok := m.nodes[cur].next[r]; ok {
+			cur = nxt
+		}
+		for _, wi := range m.nodes[cur].output {
+			n := len([]rune(m.words[wi]))
+			res = append(res, Match{Word: m.words[wi], Action: m.actions[wi], Start: i + 1 - n, End: i + 1})
+		}
+	}
+	return res
+}
+
+// Mask 将命中区间替换为 *（按 rune 计）。
+func Mask(text string, matches []Match) string {
+	if len(matches) == 0 {
+		return text
+	}
+	rs := []rune(text)
+	for _, mt := range matches {
+		for i := mt.Start; i < mt.End && i < len(rs); i++ {
+			rs[i] = '*'
+		}
+	}
+	return string(rs)
+}
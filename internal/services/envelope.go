@@ -0,0 +1,20 @@
+package services
+
+import "encoding/json"
+
+// ActionMessage 新消息投递的 action（Data 为 Deliver）
+const ActionMessage = "message"
+
+// Envelope 投递通道（Redis Pub/Sub）上编码无关的下行信封：
+// - 服务层只发布 {action, data}，接入网关按连接协商的编码（JSON/Protobuf）重新编码后写出
+// - 新消息的 action 为 ActionMessage，其余为各类事件（recalled、edited、reaction 等）
+type Envelope struct {
+	Action string          `json:"action"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// NewEnvelope 序列化一条下行信封。
+func NewEnvelope(action string, data any) []byte {
+	b, _ := json.Marshal(map[string]any{"action": action, "data": data})
+	return b
+}
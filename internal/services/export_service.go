@@ -0,0 +1,483 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// 会话导出参数
+const (
+	exportPageSize    = 200              // 每页拉取的消息数（与 Store.List 上限一致）
+	exportMaxMessages = 100000           // 单次导出的最大消息数
+	exportTimeout     = 30 * time.Minute // 单个导出任务的最长执行时间
+	exportTTL         = 24 * time.Hour   // 任务状态与导出文件的保留时间
+)
+
+// 支持的导出格式
+const (
+	ExportFormatJSONL = "jsonl" // JSON Lines，每行一条消息
+	ExportFormatHTML  = "html"  // 自包含 HTML 聊天记录（内联样式，图片引用 zip 内 files/）
+	ExportFormatText  = "txt"   // 纯文本
+)
+
+var exportFormats = []string{ExportFormatJSONL, ExportFormatHTML, ExportFormatText}
+
+func exportJobKey(id string) string { return "im:export:" + id }
+
+// ExportService 会话导出：
+// - Start 创建任务并异步执行，同一用户同一时刻仅允许一个进行中的导出（Redis 锁）
+// - 任务分页读取 Store.List，通过 UserStore 解析发送者昵称，按所选格式渲染
+// - 消息引用的本地上传文件（FileService.UploadDir）一并打包到 zip 的 files/ 目录
+// - 任务状态保存在 Redis，导出文件保存在 Dir，均在 exportTTL 后过期
+type ExportService struct {
+	Store      store.MessageStoreInterface
+	Users      *store.UserStore
+	GroupStore *store.GroupStore
+	Files      *FileService // 可选：为空时不打包附件
+	Dir        string
+}
+
+func NewExportService(ms store.MessageStoreInterface, users *store.UserStore, groups *store.GroupStore, files *FileService, dir string) *ExportService {
+	return &ExportService{Store: ms, Users: users, GroupStore: groups, Files: files, Dir: dir}
+}
+
+// Start 创建导出任务。admin=false 时要求 userID 为会话参与者，且仅导出其删除水位之后的消息。
+func (s *ExportService) Start(ctx context.Context, userID, convID string, formats []string, admin bool) (*models.ExportJob, error) {
+	if convID == "" {
+		return nil, ErrInvalidExport
+	}
+	formats, err := normalizeExportFormats(formats)
+	if err != nil {
+		return nil, err
+	}
+	if !admin {
+		first, err := s.Store.List(ctx, "", convID, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(first) > 0 && !isParticipant(ctx, s.GroupStore, userID, first[0]) {
+			return nil, ErrNotParticipant
+		}
+	}
+	lockName := "export:" + userID
+	token, ok, err := cache.TryLock(ctx, lockName, exportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrExportInProgress
+	}
+	job := &models.ExportJob{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		ConvID:    convID,
+		Formats:   formats,
+		Admin:     admin,
+		Status:    models.ExportStatusPending,
+		CreatedAt: time.Now(),
+	}
+	if err := s.save(ctx, job); err != nil {
+		_ = cache.Unlock(ctx, lockName, token)
+		return nil, err
+	}
+	go func() {
+		defer func() { _ = cache.Unlock(context.Background(), lockName, token) }()
+		s.run(job)
+	}()
+	return job, nil
+}
+
+// Get 查询导出任务；userID 不是任务创建者时视为不存在。admin=true 仅可查询管理后台创建的任务。
+func (s *ExportService) Get(ctx context.Context, userID, id string, admin bool) (*models.ExportJob, error) {
+	raw, err := cache.Client().Get(ctx, exportJobKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job models.ExportJob
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, err
+	}
+	if job.Admin != admin || (!admin && job.UserID != userID) {
+		return nil, ErrExportNotFound
+	}
+	return &job, nil
+}
+
+// File 返回已完成任务的 zip 路径与下载文件名。
+func (s *ExportService) File(ctx context.Context, userID, id string, admin bool) (string, string, error) {
+	job, err := s.Get(ctx, userID, id, admin)
+	if err != nil {
+		return "", "", err
+	}
+	if job.Status != models.ExportStatusDone {
+		return "", "", ErrExportNotReady
+	}
+	p := s.zipPath(job.ID)
+	if _, err := os.Stat(p); err != nil {
+		return "", "", ErrExportNotFound
+	}
+	return p, fmt.Sprintf("conversation-%s-%s.zip", safeFileName(job.ConvID), job.CreatedAt.Format("20060102150405")), nil
+}
+
+// Cleanup 删除超过 exportTTL 的导出文件（任务状态由 Redis TTL 自动过期）。
+func (s *ExportService) Cleanup(now time.Time) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || now.Sub(info.ModTime()) < exportTTL {
+			continue
+		}
+		_ = os.Remove(filepath.Join(s.Dir, e.Name()))
+	}
+}
+
+func (s *ExportService) zipPath(id string) string { return filepath.Join(s.Dir, id+".zip") }
+
+func (s *ExportService) save(ctx context.Context, job *models.ExportJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return cache.Client().Set(ctx, exportJobKey(job.ID), b, exportTTL).Err()
+}
+
+func normalizeExportFormats(formats []string) ([]string, error) {
+	if len(formats) == 0 {
+		return exportFormats, nil
+	}
+	seen := make(map[string]bool, len(formats))
+	out := make([]string, 0, len(formats))
+	for _, f := range formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch f {
+		case ExportFormatJSONL, ExportFormatHTML, ExportFormatText:
+		default:
+			return nil, ErrInvalidExport
+		}
+		if !seen[f] {
+			seen[f] = true
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// run 执行导出任务并更新任务状态。
+func (s *ExportService) run(job *models.ExportJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	job.Status = models.ExportStatusRunning
+	_ = s.save(ctx, job)
+
+	err := s.export(ctx, job)
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		job.Status = models.ExportStatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = models.ExportStatusDone
+	}
+	if err := s.save(context.Background(), job); err != nil {
+		log.Printf("Export.Save error: id=%s err=%v", job.ID, err)
+	}
+	log.Printf("Export.Run: id=%s convId=%s user=%s status=%s messages=%d files=%d err=%v", job.ID, job.ConvID, job.UserID, job.Status, job.Messages, job.Files, err)
+}
+
+// exportItem 导出的单条消息（JSONL 行）。
+type exportItem struct {
+	ServerMsgID   string              `json:"serverMsgId"`
+	Seq           int64               `json:"seq"`
+	From          string              `json:"from"`
+	FromNickname  string              `json:"fromNickname"`
+	Type          string              `json:"type"`
+	Timestamp     time.Time           `json:"timestamp"`
+	Text          string              `json:"text,omitempty"`
+	Payload       json.RawMessage     `json:"payload,omitempty"`
+	Attachments   []string            `json:"attachments,omitempty"` // zip 内的附件路径
+	Edited        bool                `json:"edited,omitempty"`
+	ReplyTo       string              `json:"replyTo,omitempty"`
+	ThreadRoot    string              `json:"threadRoot,omitempty"`
+	ForwardedFrom *models.ForwardInfo `json:"forwardedFrom,omitempty"`
+}
+
+// exportRenderer 按格式写入临时文件，最后整体拷贝进 zip（zip 同一时刻只能写一个条目）。
+type exportRenderer struct {
+	name string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+// export 分页读取消息并生成 zip（先写临时文件，完成后原子改名）。
+func (s *ExportService) export(ctx context.Context, job *models.ExportJob) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(s.Dir, job.ID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	renderers := make(map[string]*exportRenderer, len(job.Formats))
+	for _, f := range job.Formats {
+		name := "messages.jsonl"
+		switch f {
+		case ExportFormatHTML:
+			name = "transcript.html"
+		case ExportFormatText:
+			name = "transcript.txt"
+		}
+		fh, err := os.Create(filepath.Join(tmpDir, name))
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		renderers[f] = &exportRenderer{name: name, f: fh, w: bufio.NewWriter(fh)}
+	}
+	title := "会话 " + job.ConvID + " 聊天记录"
+	if r := renderers[ExportFormatHTML]; r != nil {
+		if err := exportHTMLHead.Execute(r.w, title); err != nil {
+			return err
+		}
+	}
+	if r := renderers[ExportFormatText]; r != nil {
+		fmt.Fprintf(r.w, "%s\n导出时间：%s\n\n", title, time.Now().Format("2006-01-02 15:04:05"))
+	}
+
+	owner := job.UserID
+	if job.Admin {
+		owner = ""
+	}
+	nicknames := make(map[string]string)
+	attachments := make(map[string]string) // zip 内路径 -> 本地文件
+	var fromSeq int64
+	for job.Messages < exportMaxMessages {
+		msgs, err := s.Store.List(ctx, owner, job.ConvID, fromSeq, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			// 流式消息仅导出最终结果
+			if m.Type == models.MessageTypeStream && m.StreamStatus != models.StreamStatusEnd {
+				continue
+			}
+			item := s.buildItem(ctx, m, nicknames, attachments)
+			if err := renderExportItem(renderers, item); err != nil {
+				return err
+			}
+			job.Messages++
+		}
+		if len(msgs) < exportPageSize {
+			break
+		}
+		fromSeq = msgs[len(msgs)-1].Seq
+	}
+	if r := renderers[ExportFormatHTML]; r != nil {
+		if _, err := io.WriteString(r.w, exportHTMLFoot); err != nil {
+			return err
+		}
+	}
+
+	tmpZip := s.zipPath(job.ID) + ".tmp"
+	zf, err := os.Create(tmpZip)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpZip)
+	zw := zip.NewWriter(zf)
+	for _, f := range job.Formats {
+		r := renderers[f]
+		if err := r.w.Flush(); err != nil {
+			zf.Close()
+			return err
+		}
+		if err := addZipFile(zw, r.name, r.f.Name()); err != nil {
+			zf.Close()
+			return err
+		}
+	}
+	for name, local := range attachments {
+		if err := addZipFile(zw, name, local); err != nil {
+			log.Printf("Export.Attachment skip: id=%s file=%s err=%v", job.ID, local, err)
+			continue
+		}
+		job.Files++
+	}
+	if err := zw.Close(); err != nil {
+		zf.Close()
+		return err
+	}
+	if err := zf.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(tmpZip); err == nil {
+		job.Size = info.Size()
+	}
+	return os.Rename(tmpZip, s.zipPath(job.ID))
+}
+
+// buildItem 组装导出条目：解析昵称、提取正文并登记本地附件。
+func (s *ExportService) buildItem(ctx context.Context, m *models.Message, nicknames, attachments map[string]string) *exportItem {
+	nick, ok := nicknames[m.FromUserID]
+	if !ok {
+		nick = m.FromUserID
+		if u, err := s.Users.GetByID(ctx, m.FromUserID); err == nil && u != nil && u.Nickname != "" {
+			nick = u.Nickname
+		}
+		nicknames[m.FromUserID] = nick
+	}
+	item := &exportItem{
+		ServerMsgID:   m.ServerMsgID,
+		Seq:           m.Seq,
+		From:          m.FromUserID,
+		FromNickname:  nick,
+		Type:          m.Type,
+		Timestamp:     m.Timestamp,
+		Edited:        m.Edited,
+		ReplyTo:       m.ReplyTo,
+		ThreadRoot:    m.ThreadRoot,
+		ForwardedFrom: m.ForwardedFrom,
+	}
+	if json.Valid(m.Payload) {
+		item.Payload = m.Payload
+	}
+	item.Text = searchableText(m)
+	if item.Text == "" || m.Type == models.MessageTypeFile {
+		item.Text = quoteSummary(m)
+	}
+	var fields map[string]any
+	if json.Unmarshal(m.Payload, &fields) == nil {
+		for _, k := range []string{"url", "thumbnail"} {
+			u, _ := fields[k].(string)
+			if local, name, ok := s.localFile(u); ok {
+				attachments[name] = local
+				item.Attachments = append(item.Attachments, name)
+			}
+		}
+	}
+	return item
+}
+
+// localFile 将本地上传文件的访问 URL 映射为磁盘路径与 zip 内路径；外部 URL（如 OSS）返回 false。
+func (s *ExportService) localFile(raw string) (string, string, bool) {
+	if s.Files == nil || raw == "" {
+		return "", "", false
+	}
+	base, err := url.Parse(s.Files.BaseURL)
+	if err != nil {
+		return "", "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Host != "" && u.Host != base.Host) {
+		return "", "", false
+	}
+	prefix := strings.TrimSuffix(base.Path, "/") + "/"
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", "", false
+	}
+	rel := path.Clean(strings.TrimPrefix(u.Path, prefix))
+	if rel == "." || strings.HasPrefix(rel, "../") || rel == ".." {
+		return "", "", false
+	}
+	return filepath.Join(s.Files.UploadDir, filepath.FromSlash(rel)), "files/" + rel, true
+}
+
+func addZipFile(zw *zip.Writer, name, local string) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func renderExportItem(renderers map[string]*exportRenderer, item *exportItem) error {
+	if r := renderers[ExportFormatJSONL]; r != nil {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err := r.w.Write(b); err != nil {
+			return err
+		}
+	}
+	if r := renderers[ExportFormatHTML]; r != nil {
+		if err := exportHTMLItem.Execute(r.w, item); err != nil {
+			return err
+		}
+	}
+	if r := renderers[ExportFormatText]; r != nil {
+		line := fmt.Sprintf("[%s] %s: %s", item.Timestamp.Local().Format("2006-01-02 15:04:05"), item.FromNickname, item.Text)
+		if item.Edited {
+			line += "（已编辑）"
+		}
+		for _, a := range item.Attachments {
+			line += " <" + a + ">"
+		}
+		if _, err := fmt.Fprintln(r.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var exportHTMLHead = template.Must(template.New("head").Parse(`<!DOCTYPE html>
+<html lang="zh-CN"><head><meta charset="utf-8"><title>{{.}}</title>
+<style>
+body{font-family:-apple-system,"PingFang SC","Microsoft YaHei",sans-serif;background:#f5f5f5;margin:0;padding:24px}
+h1{font-size:18px;color:#333}
+.msg{background:#fff;border-radius:6px;padding:10px 14px;margin:8px 0;max-width:760px}
+.meta{color:#888;font-size:12px;margin-bottom:4px}
+.from{color:#1677ff;font-weight:600;margin-right:8px}
+.text{white-space:pre-wrap;word-break:break-word;color:#222}
+.msg img{max-width:320px;max-height:320px;display:block;margin-top:6px}
+</style></head><body><h1>{{.}}</h1>
+`))
+
+var exportHTMLItem = template.Must(template.New("item").Parse(`<div class="msg" id="m{{.Seq}}"><div class="meta"><span class="from">{{.FromNickname}}</span>{{.Timestamp.Local.Format "2006-01-02 15:04:05"}}{{if .Edited}} · 已编辑{{end}}</div><div class="text">{{.Text}}</div>{{$img := eq .Type "image"}}{{range .Attachments}}{{if $img}}<img src="{{.}}" alt="">{{else}}<a href="{{.}}">{{.}}</a>{{end}}{{end}}</div>
+`))
+
+const exportHTMLFoot = "</body></html>\n"
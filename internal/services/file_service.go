@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -221,6 +222,16 @@ func (s *FileService) GetFile(ctx context.Context, fileID string) (*models.FileU
 	return &upload, nil
 }
 
+// OwnsURL 判断 url 是否为 userID 上传成功的文件（消息载荷校验附件归属）
+func (s *FileService) OwnsURL(ctx context.Context, userID, url string) (bool, error) {
+	var one int
+	err := s.DB.Primary.QueryRowContext(ctx, `SELECT 1 FROM file_uploads WHERE user_id = ? AND url = ? AND status = 'success' LIMIT 1`, userID, url).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // 删除文件
 func (s *FileService) DeleteFile(ctx context.Context, fileID, userID string) error {
 	// 获取文件信息
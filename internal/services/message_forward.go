@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+
+	"go-im/internal/models"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 单次转发的数量上限
+const (
+	forwardMaxMessages = 100
+	forwardMaxTargets  = 20
+)
+
+// ForwardTarget 转发目标会话（与 SendPayload 的路由字段一致）。
+type ForwardTarget struct {
+	ConvID   string                  `json:"convId"`
+	ConvType models.ConversationType `json:"convType"`
+	To       string                  `json:"to,omitempty"`
+	GroupID  string                  `json:"groupId,omitempty"`
+}
+
+// ForwardRequest 转发请求：从 SourceConvID 选取 ServerMsgIDs，发往 Targets。
+// - Merged=false：逐条转发，每条保留 forwardedFrom 来源
+// - Merged=true：合并为一条 merged 消息，载荷内嵌所选消息快照
+// - ClientMsgID 可选，作为幂等键前缀（逐条转发时追加原 serverMsgId）
+type ForwardRequest struct {
+	From         string          `json:"from"`
+	SourceConvID string          `json:"sourceConvId"`
+	ServerMsgIDs []string        `json:"serverMsgIds"`
+	Targets      []ForwardTarget `json:"targets"`
+	Merged       bool            `json:"merged"`
+	Title        string          `json:"title,omitempty"`
+	ClientMsgID  string          `json:"clientMsgId,omitempty"`
+}
+
+// ForwardResult 单个目标会话的转发结果；失败时 Code 为错误码。
+type ForwardResult struct {
+	ConvID   string     `json:"convId"`
+	Code     string     `json:"code,omitempty"`
+	Messages []*Deliver `json:"messages,omitempty"`
+}
+
+// SendAuthorizer 目标会话发送权限校验（由接入层注入好友/群成员判断），无权限时返回错误。
+type SendAuthorizer func(ctx context.Context, from string, t *ForwardTarget) error
+
+// Forward 转发消息：
+// 1) 校验来源消息存在、未撤回、非阅后即焚/流式分片，且请求者为来源会话参与方
+// 2) 逐个目标做发送权限校验，失败的目标记录错误码，不影响其它目标
+// 3) 通过 Send 入库与分发，沿用会话序列、会话索引与下发逻辑
+func (s *MessageService) Forward(ctx context.Context, req *ForwardRequest, authorize SendAuthorizer) ([]*ForwardResult, error) {
+	if req.SourceConvID == "" || len(req.ServerMsgIDs) == 0 || len(req.ServerMsgIDs) > forwardMaxMessages || len(req.Targets) == 0 || len(req.Targets) > forwardMaxTargets {
+		return nil, ErrInvalidForward
+	}
+	sources, err := s.loadForwardSources(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged json.RawMessage
+	if req.Merged {
+		mp := models.MergedPayload{Title: req.Title, Items: make([]models.MergedItem, 0, len(sources))}
+		for _, m := range sources {
+			mp.Items = append(mp.Items, models.MergedItem{ServerMsgID: m.ServerMsgID, ConvID: m.ConvID, From: m.FromUserID, Type: m.Type, Payload: json.RawMessage(m.Payload), Timestamp: m.Timestamp.UnixMilli()})
+		}
+		merged, _ = json.Marshal(mp)
+	}
+
+	results := make([]*ForwardResult, 0, len(req.Targets))
+	for i := range req.Targets {
+		t := &req.Targets[i]
+		res := &ForwardResult{ConvID: t.ConvID}
+		results = append(results, res)
+		if t.ConvID == "" || (t.ConvType == models.ConversationTypeC2C && t.To == "") || (t.ConvType == models.ConversationTypeGroup && t.GroupID == "") {
+			res.Code, _ = MessageErrorCode(ErrInvalidForward)
+			continue
+		}
+		if authorize != nil {
+			if err := authorize(ctx, req.From, t); err != nil {
+				res.Code, _ = MessageErrorCode(err)
+				log.Printf("Msg.Forward denied: from=%s target=%s err=%v", req.From, t.ConvID, err)
+				continue
+			}
+		}
+		base := SendRequest{ConvID: t.ConvID, ConvType: t.ConvType, From: req.From, To: t.To, GroupID: t.GroupID}
+		if req.Merged {
+			sr := base
+			sr.ClientID = req.ClientMsgID
+			if sr.ClientID == "" {
+				sr.ClientID = uuid.NewString()
+			}
+			sr.Type = models.MessageTypeMerged
+			sr.Payload = merged
+			sr.merged = true
+			d, err := s.Send(ctx, &sr)
+			if err != nil {
+				res.Code, _ = MessageErrorCode(err)
+				continue
+			}
+			res.Messages = append(res.Messages, d)
+			continue
+		}
+		for _, m := range sources {
+			sr := base
+			sr.ClientID = uuid.NewString()
+			if req.ClientMsgID != "" {
+				sr.ClientID = req.ClientMsgID + ":" + m.ServerMsgID
+			}
+			sr.Type = m.Type
+			sr.Payload = json.RawMessage(m.Payload)
+			sr.ForwardedFrom = &models.ForwardInfo{ConvID: m.ConvID, ServerMsgID: m.ServerMsgID, From: m.FromUserID, Timestamp: m.Timestamp.UnixMilli()}
+			d, err := s.Send(ctx, &sr)
+			if err != nil {
+				res.Code, _ = MessageErrorCode(err)
+				break
+			}
+			res.Messages = append(res.Messages, d)
+		}
+	}
+	log.Printf("Msg.Forward done: from=%s source=%s msgs=%d targets=%d merged=%v", req.From, req.SourceConvID, len(sources), len(req.Targets), req.Merged)
+	return results, nil
+}
+
+// loadForwardSources 读取并校验来源消息，按原 seq 升序返回（去重）。
+func (s *MessageService) loadForwardSources(ctx context.Context, req *ForwardRequest) ([]*models.Message, error) {
+	seen := make(map[string]struct{}, len(req.ServerMsgIDs))
+	sources := make([]*models.Message, 0, len(req.ServerMsgIDs))
+	for _, id := range req.ServerMsgIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		m, err := s.Store.GetByID(ctx, req.SourceConvID, id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, ErrMessageNotFound
+			}
+			return nil, err
+		}
+		if m.Recalled {
+			return nil, ErrMessageRecalled
+		}
+		if m.BurnAfterRead || (m.IsStreaming && m.StreamStatus != models.StreamStatusEnd) {
+			return nil, ErrNotForwardable
+		}
+		if len(sources) == 0 && !s.isParticipant(ctx, req.From, m) {
+			return nil, ErrNotParticipant
+		}
+		sources = append(sources, m)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Seq < sources[j].Seq })
+	return sources, nil
+}
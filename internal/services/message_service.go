@@ -3,34 +3,170 @@ package services
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
+	"unicode/utf8"
 
+	"go-im/internal/application/ports"
 	"go-im/internal/cache"
+	"go-im/internal/domain/valueobjects"
 	"go-im/internal/models"
 	"go-im/internal/mq"
 	"go-im/internal/store"
 
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // MessageService 负责消息生命周期：
 // - Send：校验/入库/更新会话索引/Redis 下发/可选 Kafka 通知
 // - Stream：支持 start/chunk/end 的流式消息持久化与下发
 // - Recall/Delete：消息撤回、按用户的会话删除水位
-// - List：按会话 seq 游标增量拉取历史
+// - Edit：发送者在时间窗口内编辑文本消息，保留历史版本并广播 edited 事件
+// - ReplyTo/ThreadRoot：引用回复与话题，发送时校验被引用消息并附带快照；ListThread 拉取话题回复
+// - Forward：逐条或合并转发到多个目标会话（见 message_forward.go）
+// - Pin：会话内置顶/取消置顶消息，广播 pinned_changed 事件
+// - React：表情回应增删，广播 reaction 事件；AttachReactions 为历史消息填充聚合计数
+// - List/ListBefore：按会话 seq 游标向后增量拉取 / 向前翻页历史
 // - DeleteExpired：清理到期的定时自毁消息
-// 依赖：MessageStoreInterface + ConvStore + GroupStore（可选 KafkaProducer）
+// 依赖：MessageStoreInterface + ConvStore + GroupStore + SeqGen（可选 KafkaProducer、Search）
 type MessageService struct {
 	Store      store.MessageStoreInterface // 使用接口支持多种存储
 	ConvStore  *store.ConversationStore
 	GroupStore *store.GroupStore
-	Producer   *mq.KafkaProducer // 可选
+	SeqGen     ports.SequenceGenerator // 会话内严格递增序列（Redis INCR + last_seq 兜底）
+	Producer   *mq.KafkaProducer       // 可选
 
 	GroupBatchSize  int
 	GroupBatchSleep time.Duration
+
+	EditWindow   time.Duration       // 消息可编辑窗口（<=0 不限制）
+	RecallWindow time.Duration       // 发送者可撤回窗口（<=0 不限制；群主/管理员不受限）
+	Search       *SearchService      // 可选：全文检索索引
+	Receipts     *store.ReceiptStore // 可选：清空/删除会话时将未读清零
+	Payloads     *PayloadRegistry    // 可选：按消息类型校验载荷（为空不校验）
+	Unfurl       *UnfurlService      // 可选：文本消息链接预览
+	Moderation   *ModerationService  // 可选：编辑消息时的敏感词过滤（发送时通过 Pipeline 注册）
+	Pipeline     *SendPipeline       // 可选：发送拦截器链（权限、禁言、审核、提及、指标、Webhook 等）
+}
+
+// 消息编辑相关错误，WS/HTTP 层据此映射错误码
+var (
+	ErrMessageNotFound     = errors.New("message not found")
+	ErrNotMessageSender    = errors.New("only the sender can edit this message")
+	ErrMessageNotEditable  = errors.New("message type is not editable")
+	ErrMessageRecalled     = errors.New("message has been recalled")
+	ErrEditWindowExpired   = errors.New("edit window expired")
+	ErrRecallForbidden     = errors.New("only the sender or group admin can recall this message")
+	ErrRecallWindowExpired = errors.New("recall window expired")
+	ErrInvalidPayload      = errors.New("invalid payload")
+	ErrNotParticipant      = errors.New("not a participant of the conversation")
+	ErrInvalidEmoji        = errors.New("invalid emoji")
+	ErrReplyTargetMissing  = errors.New("reply target not found in conversation")
+	ErrNotFriend           = errors.New("not friend")
+	ErrNotGroupMember      = errors.New("not group member")
+	ErrNotForwardable      = errors.New("message cannot be forwarded")
+	ErrInvalidForward      = errors.New("invalid forward request")
+	ErrPinForbidden        = errors.New("only group owner or admin can pin messages")
+	ErrPinLimitExceeded    = errors.New("too many pinned messages in conversation")
+	ErrScheduleNotFound    = errors.New("scheduled message not found")
+	ErrScheduleNotPending  = errors.New("scheduled message is no longer pending")
+	ErrInvalidSendAt       = errors.New("invalid sendAt")
+	ErrScheduleLimit       = errors.New("too many pending scheduled messages")
+	ErrInvalidRetention    = errors.New("invalid retention policy")
+	ErrInvalidExport       = errors.New("invalid export request")
+	ErrExportNotFound      = errors.New("export not found")
+	ErrExportNotReady      = errors.New("export is not ready")
+	ErrExportInProgress    = errors.New("another export is in progress")
+	ErrContentRejected     = errors.New("content contains sensitive words")
+	ErrGroupMuted          = errors.New("group is muted or user muted")
+	ErrInvalidModeration   = errors.New("invalid moderation policy")
+	ErrReviewNotFound      = errors.New("moderation review not found")
+	ErrReviewResolved      = errors.New("moderation review already resolved")
+)
+
+// maxPinsPerConv 单个会话最多置顶的消息数
+const maxPinsPerConv = 20
+
+// maxEmojiLen 单个表情回应的最大字节数（容纳组合/肤色修饰的 emoji 序列）
+const maxEmojiLen = 64
+
+// MessageErrorCode 将消息相关错误映射为 WS 错误码与 HTTP 状态码；未知错误归为 INTERNAL/500。
+func MessageErrorCode(err error) (string, int) {
+	var payloadErr *PayloadError
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		return "MESSAGE_NOT_FOUND", 404
+	case errors.Is(err, ErrNotMessageSender):
+		return "NOT_MESSAGE_SENDER", 403
+	case errors.Is(err, ErrNotParticipant):
+		return "NOT_PARTICIPANT", 403
+	case errors.As(err, &payloadErr):
+		return payloadErr.Code, payloadErr.status()
+	case errors.Is(err, ErrMessageNotEditable):
+		return "MESSAGE_NOT_EDITABLE", 400
+	case errors.Is(err, ErrInvalidPayload):
+		return "INVALID_PAYLOAD", 400
+	case errors.Is(err, ErrInvalidEmoji):
+		return "INVALID_EMOJI", 400
+	case errors.Is(err, ErrReplyTargetMissing):
+		return "REPLY_TARGET_NOT_FOUND", 400
+	case errors.Is(err, ErrNotFriend):
+		return "NOT_FRIEND", 403
+	case errors.Is(err, ErrNotGroupMember):
+		return "NOT_GROUP_MEMBER", 403
+	case errors.Is(err, ErrNotForwardable):
+		return "MESSAGE_NOT_FORWARDABLE", 400
+	case errors.Is(err, ErrInvalidForward):
+		return "INVALID_FORWARD", 400
+	case errors.Is(err, ErrPinForbidden):
+		return "PIN_FORBIDDEN", 403
+	case errors.Is(err, ErrPinLimitExceeded):
+		return "PIN_LIMIT_EXCEEDED", 409
+	case errors.Is(err, ErrScheduleNotFound):
+		return "SCHEDULE_NOT_FOUND", 404
+	case errors.Is(err, ErrScheduleNotPending):
+		return "SCHEDULE_NOT_PENDING", 409
+	case errors.Is(err, ErrInvalidSendAt):
+		return "INVALID_SEND_AT", 400
+	case errors.Is(err, ErrScheduleLimit):
+		return "SCHEDULE_LIMIT_EXCEEDED", 409
+	case errors.Is(err, ErrInvalidRetention):
+		return "INVALID_RETENTION", 400
+	case errors.Is(err, ErrInvalidExport):
+		return "INVALID_EXPORT", 400
+	case errors.Is(err, ErrExportNotFound):
+		return "EXPORT_NOT_FOUND", 404
+	case errors.Is(err, ErrExportNotReady):
+		return "EXPORT_NOT_READY", 409
+	case errors.Is(err, ErrExportInProgress):
+		return "EXPORT_IN_PROGRESS", 409
+	case errors.Is(err, ErrGroupMuted):
+		return "GROUP_MUTED", 403
+	case errors.Is(err, ErrContentRejected):
+		return "CONTENT_REJECTED", 400
+	case errors.Is(err, ErrInvalidModeration):
+		return "INVALID_MODERATION", 400
+	case errors.Is(err, ErrReviewNotFound):
+		return "REVIEW_NOT_FOUND", 404
+	case errors.Is(err, ErrReviewResolved):
+		return "REVIEW_ALREADY_RESOLVED", 409
+	case errors.Is(err, ErrMessageRecalled):
+		return "MESSAGE_RECALLED", 409
+	case errors.Is(err, ErrEditWindowExpired):
+		return "EDIT_WINDOW_EXPIRED", 409
+	case errors.Is(err, ErrRecallForbidden):
+		return "RECALL_FORBIDDEN", 403
+	case errors.Is(err, ErrRecallWindowExpired):
+		return "RECALL_WINDOW_EXPIRED", 409
+	case errors.Is(err, store.ErrVersionConflict):
+		return "VERSION_CONFLICT", 409
+	}
+	return "INTERNAL", 500
 }
 
 func NewMessageService(ms store.MessageStoreInterface) *MessageService {
@@ -38,7 +174,7 @@ func NewMessageService(ms store.MessageStoreInterface) *MessageService {
 }
 
 // SendRequest 发送请求载荷（服务内部），来自 WS/HTTP 层组装。
-// - ClientID 作为幂等键，与 convId 构成唯一约束
+// - ClientID 作为幂等键，与 convId 构成唯一约束；重复发送返回已入库的消息且不再分发
 // - 支持流式消息（IsStreaming/Stream*），以及自毁策略（ExpireAt/BurnAfterRead）
 type SendRequest struct {
 	ConvID   string                  `json:"convId"`
@@ -57,6 +193,14 @@ type SendRequest struct {
 	// 自毁/过期
 	ExpireAt      *time.Time `json:"expireAt,omitempty"`      // 定时自毁时间（毫秒）
 	BurnAfterRead bool       `json:"burnAfterRead,omitempty"` // 阅后即焚
+	// 引用回复/话题：ReplyTo 与 ReplyToSeq 二选一指定被引用消息；ThreadRoot 指定话题根消息
+	ReplyTo    string `json:"replyTo,omitempty"`
+	ReplyToSeq int64  `json:"replyToSeq,omitempty"`
+	ThreadRoot string `json:"threadRoot,omitempty"`
+	// 转发来源（由 Forward 填充）
+	ForwardedFrom *models.ForwardInfo `json:"forwardedFrom,omitempty"`
+	// 合并转发（仅 Forward 设置；客户端无法构造 merged 消息）
+	merged bool
 }
 
 // Deliver 下发给客户端的消息模型（通过 Redis 发布）。
@@ -82,6 +226,65 @@ type Deliver struct {
 	// 自毁/过期
 	ExpireAt      *time.Time `json:"expireAt,omitempty"`
 	BurnAfterRead bool       `json:"burnAfterRead,omitempty"`
+	// 编辑状态
+	Edited   bool       `json:"edited,omitempty"`
+	Version  int        `json:"version,omitempty"`
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	// 引用回复/话题
+	ReplyTo    string                `json:"replyTo,omitempty"`
+	ThreadRoot string                `json:"threadRoot,omitempty"`
+	Quote      *models.QuotedMessage `json:"quote,omitempty"`
+	// 转发来源
+	ForwardedFrom *models.ForwardInfo `json:"forwardedFrom,omitempty"`
+	// 墓碑：离线同步中已撤回/已过期的消息（不含载荷）
+	Recalled bool `json:"recalled,omitempty"`
+}
+
+// ToDeliver 将存储模型转换为下发模型（实时投递与离线同步共用）。
+func ToDeliver(msg *models.Message) *Deliver {
+	return &Deliver{
+		ServerMsgID:   msg.ServerMsgID,
+		ClientMsgID:   msg.ClientMsgID,
+		ConvID:        msg.ConvID,
+		ConvType:      msg.ConvType,
+		From:          msg.FromUserID,
+		To:            msg.ToUserID,
+		GroupID:       msg.GroupID,
+		Seq:           msg.Seq,
+		Timestamp:     msg.Timestamp.UnixMilli(),
+		Type:          msg.Type,
+		Payload:       json.RawMessage(msg.Payload),
+		StreamID:      msg.StreamID,
+		StreamSeq:     msg.StreamSeq,
+		StreamStatus:  msg.StreamStatus,
+		IsStreaming:   msg.IsStreaming,
+		ExpireAt:      msg.ExpireAt,
+		BurnAfterRead: msg.BurnAfterRead,
+		Edited:        msg.Edited,
+		Version:       msg.Version,
+		EditedAt:      msg.EditedAt,
+		ReplyTo:       msg.ReplyTo,
+		ThreadRoot:    msg.ThreadRoot,
+		Quote:         msg.Quote,
+		ForwardedFrom: msg.ForwardedFrom,
+	}
+}
+
+// ToTombstone 已撤回/已过期消息的墓碑：仅保留定位信息，不含载荷（离线同步下发，客户端删除本地副本）。
+func ToTombstone(msg *models.Message) *Deliver {
+	return &Deliver{
+		ServerMsgID: msg.ServerMsgID,
+		ClientMsgID: msg.ClientMsgID,
+		ConvID:      msg.ConvID,
+		ConvType:    msg.ConvType,
+		From:        msg.FromUserID,
+		To:          msg.ToUserID,
+		GroupID:     msg.GroupID,
+		Seq:         msg.Seq,
+		Timestamp:   msg.Timestamp.UnixMilli(),
+		Type:        msg.Type,
+		Recalled:    true,
+	}
 }
 
 func lastSeqCacheKey(convID string) string { return fmt.Sprintf("im:lastseq:%s", convID) }
@@ -90,12 +293,63 @@ func readSeqCacheKey(userID, convID string) string {
 }
 func streamCacheKey(streamID string) string { return fmt.Sprintf("im:stream:%s", streamID) }
 
-// Send 执行消息入库与分发：
-// 1) 构造 models.Message；根据自毁策略带上字段
-// 2) 入库（流式仅在 start/end 时入库）；更新会话索引与用户-会话关系
-// 3) C2C：向双方个人通道发布；Group：向群通道发布（演示）
-// 注意：生产环境建议使用严格递增的会话内序列生成器替代 time.Now().UnixNano()
+// nextSeq 分配会话内序列号；未注入 SeqGen 时退化为时间戳（仅用于本地演示）。
+func (s *MessageService) nextSeq(ctx context.Context, convID string) (int64, error) {
+	if s.SeqGen == nil {
+		return time.Now().UnixNano(), nil
+	}
+	return s.SeqGen.NextSeq(ctx, convID)
+}
+
+// Send 执行消息入库与分发（WS/HTTP/转发/定时消息均经由此处）：
+// 1) 载荷校验后执行 Pipeline 的 before-persist 拦截器（权限、禁言、审核），通过后由 SeqGen 分配连续 seq；已入库的重发直接返回原消息
+// 2) 入库（流式仅在 start/end 时入库，失败时以占位消息填补已分配的 seq）并执行 after-persist 拦截器；更新会话索引与用户-会话关系
+// 3) 执行 before-deliver 拦截器后分发：C2C 向双方个人通道发布；Group 向群通道发布
+// 流式 chunk 不入库也不占用会话序列（seq=0），客户端按 streamSeq 拼接。
 func (s *MessageService) Send(ctx context.Context, req *SendRequest) (*Deliver, error) {
+	// 流式消息：只有 start 和 end 状态才入库，chunk 仅实时分发
+	shouldStore := !req.IsStreaming || req.StreamStatus == models.StreamStatusStart || req.StreamStatus == models.StreamStatusEnd || req.StreamStatus == models.StreamStatusError
+	// 客户端重发：已入库的消息直接返回（含原 serverMsgId/seq），不再分配 seq、不重复分发
+	if shouldStore && req.ClientID != "" {
+		existing, err := s.Store.GetByClientID(ctx, req.ConvID, req.ClientID)
+		if err == nil {
+			return resentMessage(req, existing)
+		}
+		if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Msg.Send duplicate lookup error: convId=%s clientMsgId=%s err=%v", req.ConvID, req.ClientID, err)
+			return nil, err
+		}
+	}
+	// 载荷校验：流式消息的 chunk/end 由服务端组装，仅校验客户端提交的载荷
+	if !req.IsStreaming || req.StreamStatus == models.StreamStatusStart {
+		if err := s.Payloads.Validate(ctx, PayloadContext{UserID: req.From, Forwarded: req.ForwardedFrom != nil, merged: req.merged}, req.Type, req.Payload); err != nil {
+			log.Printf("Msg.Send payload invalid: convId=%s from=%s type=%s err=%v", req.ConvID, req.From, req.Type, err)
+			return nil, err
+		}
+	}
+	// 引用/话题：先校验被引用消息，避免为无效请求分配 seq
+	replyTo, threadRoot, quote, err := s.resolveReply(ctx, req)
+	if err != nil {
+		log.Printf("Msg.Send reply invalid: convId=%s replyTo=%s replyToSeq=%d threadRoot=%s err=%v", req.ConvID, req.ReplyTo, req.ReplyToSeq, req.ThreadRoot, err)
+		return nil, err
+	}
+	// 拦截器 before-persist：权限、禁言、内容审核等，拒绝的消息不分配 seq
+	sc := &SendContext{Req: req, Started: time.Now()}
+	if err := s.Pipeline.run(ctx, StageBeforePersist, sc); err != nil {
+		return nil, err
+	}
+	// 未携带 clientMsgId 的请求各自独立，避免空幂等键互相判为重复
+	if req.ClientID == "" {
+		req.ClientID = uuid.NewString()
+	}
+	var seq int64
+	if shouldStore {
+		seq, err = s.nextSeq(ctx, req.ConvID)
+		if err != nil {
+			log.Printf("Msg.NextSeq error: convId=%s err=%v", req.ConvID, err)
+			return nil, err
+		}
+	}
 	serverID := uuid.NewString()
 	msg := &models.Message{
 		ServerMsgID:   serverID,
@@ -105,7 +359,7 @@ func (s *MessageService) Send(ctx context.Context, req *SendRequest) (*Deliver,
 		FromUserID:    req.From,
 		ToUserID:      req.To,
 		GroupID:       req.GroupID,
-		Seq:           time.Now().UnixNano(), // 演示用序列（生产应使用有序生成）
+		Seq:           seq,
 		Timestamp:     time.Now(),
 		Type:          req.Type,
 		Payload:       req.Payload,
@@ -115,24 +369,50 @@ func (s *MessageService) Send(ctx context.Context, req *SendRequest) (*Deliver,
 		IsStreaming:   req.IsStreaming,
 		ExpireAt:      req.ExpireAt,
 		BurnAfterRead: req.BurnAfterRead,
+		ReplyTo:       replyTo,
+		ThreadRoot:    threadRoot,
+		Quote:         quote,
+		ForwardedFrom: req.ForwardedFrom,
 	}
 	log.Printf("Msg.Send begin: convId=%s convType=%s from=%s to=%s group=%s clientMsgId=%s seq=%d", req.ConvID, string(req.ConvType), req.From, req.To, req.GroupID, req.ClientID, msg.Seq)
 
-	// 流式消息：只有 start 和 end 状态才入库，chunk 仅实时分发
-	shouldStore := !req.IsStreaming || req.StreamStatus == models.StreamStatusStart || req.StreamStatus == models.StreamStatusEnd || req.StreamStatus == models.StreamStatusError
 	if shouldStore {
 		if err := s.Store.Append(ctx, msg); err != nil {
+			// 已分配的 seq 不能留空洞：写入占位消息
+			s.fillSeqGap(ctx, msg)
+			if errors.Is(err, store.ErrDuplicateMessage) {
+				// 并发重发：返回已入库的消息，不重复分发
+				existing, gerr := s.Store.GetByClientID(ctx, req.ConvID, req.ClientID)
+				if gerr != nil {
+					log.Printf("Msg.Append duplicate lookup error: convId=%s clientMsgId=%s err=%v", req.ConvID, req.ClientID, gerr)
+					return nil, gerr
+				}
+				return resentMessage(req, existing)
+			}
 			log.Printf("Msg.Append error: convId=%s err=%v", req.ConvID, err)
 			return nil, err
 		}
 		log.Printf("Msg.Append ok: convId=%s seq=%d", req.ConvID, msg.Seq)
+		sc.Msg = msg
+		_ = s.Pipeline.run(ctx, StageAfterPersist, sc)
+		if !req.IsStreaming || req.StreamStatus == models.StreamStatusEnd {
+			s.Search.IndexMessage(ctx, msg)
+		}
+		if !req.IsStreaming {
+			s.Unfurl.Attach(msg)
+		}
+		// 持久化会话 last_seq：既用于未读计算，也是序列生成器冷启动时的下限之一（另一为已入库最大 seq）
+		if s.ConvStore != nil {
+			if err := s.ConvStore.UpsertConversation(ctx, req.ConvID, string(req.ConvType), req.To, req.GroupID, msg.Seq); err != nil {
+				log.Printf("Msg.UpsertConversation error: convId=%s seq=%d err=%v", req.ConvID, msg.Seq, err)
+			}
+			cache.Client().Set(ctx, lastSeqCacheKey(req.ConvID), msg.Seq, 10*time.Minute)
+		}
 	}
 
-	// 更新会话索引与用户-会话关系（仅在 start 或非流式时）
+	// 更新用户-会话关系（仅在 start 或非流式时）
 	if s.ConvStore != nil && (!req.IsStreaming || req.StreamStatus == models.StreamStatusStart) {
 		convTypeStr := string(req.ConvType)
-		_ = s.ConvStore.UpsertConversation(ctx, req.ConvID, convTypeStr, req.To, req.GroupID, msg.Seq)
-		cache.Client().Set(ctx, lastSeqCacheKey(req.ConvID), msg.Seq, 10*time.Minute)
 		_ = s.ConvStore.UpsertUserConversation(ctx, req.From, req.ConvID, convTypeStr, req.To, req.GroupID)
 		if req.ConvType == models.ConversationTypeC2C && req.To != "" {
 			_ = s.ConvStore.UpsertUserConversation(ctx, req.To, req.ConvID, convTypeStr, req.From, "")
@@ -175,45 +455,151 @@ func (s *MessageService) Send(ctx context.Context, req *SendRequest) (*Deliver,
 		}
 	}
 
-	if req.ConvType == models.ConversationTypeGroup && s.GroupStore != nil {
-		// 群禁言检查：全员禁言或成员禁言
-		muted, err := s.GroupStore.IsMuted(ctx, req.GroupID, req.From)
-		if err == nil && muted {
-			log.Printf("Msg.Send denied by mute: group=%s user=%s", req.GroupID, req.From)
-			return nil, fmt.Errorf("group is muted or user muted")
+	d := ToDeliver(msg)
+	// 拦截器 before-deliver：提及提醒、指标、Webhook 等
+	sc.Msg, sc.Deliver = msg, d
+	_ = s.Pipeline.run(ctx, StageBeforeDeliver, sc)
+	// Redis 简化分发：编码无关信封，由网关按连接编码下发
+	publishToConv(ctx, s.GroupStore, msg, NewEnvelope(ActionMessage, d))
+	return d, nil
+}
+
+// resentMessage 重发命中已入库的消息：返回原消息（幂等键被其他用户占用时拒绝，不泄露他人消息）。
+func resentMessage(req *SendRequest, existing *models.Message) (*Deliver, error) {
+	if existing.FromUserID != req.From {
+		log.Printf("Msg.Send clientMsgId conflict: convId=%s clientMsgId=%s from=%s", req.ConvID, req.ClientID, req.From)
+		return nil, payloadInvalid("clientMsgId", "clientMsgId already used in this conversation")
+	}
+	log.Printf("Msg.Send duplicate: convId=%s clientMsgId=%s serverMsgId=%s seq=%d", req.ConvID, req.ClientID, existing.ServerMsgID, existing.Seq)
+	return ToDeliver(existing), nil
+}
+
+// fillSeqGap 已分配 seq 但消息未能入库时写入占位（已撤回的空消息），保持会话 seq 连续；客户端按撤回墓碑处理。
+func (s *MessageService) fillSeqGap(ctx context.Context, msg *models.Message) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	gap := &models.Message{
+		ServerMsgID: uuid.NewString(),
+		ClientMsgID: fmt.Sprintf("gap:%d", msg.Seq),
+		ConvID:      msg.ConvID,
+		ConvType:    msg.ConvType,
+		FromUserID:  msg.FromUserID,
+		ToUserID:    msg.ToUserID,
+		GroupID:     msg.GroupID,
+		Seq:         msg.Seq,
+		Timestamp:   msg.Timestamp,
+		Type:        msg.Type,
+		Payload:     []byte("{}"),
+		Recalled:    true,
+	}
+	if err := s.Store.Append(ctx, gap); err != nil && !errors.Is(err, store.ErrDuplicateMessage) {
+		log.Printf("Msg.FillSeqGap error: convId=%s seq=%d err=%v", msg.ConvID, msg.Seq, err)
+	}
+}
+
+// quoteSummaryRunes 引用快照中文本摘要的最大字符数
+const quoteSummaryRunes = 60
+
+// resolveReply 校验引用/话题目标位于同一会话且未撤回，返回 replyTo、threadRoot 与引用快照。
+// - 回复话题内的消息时自动归入该话题；指定的话题根本身属于话题时归并到最上层根
+func (s *MessageService) resolveReply(ctx context.Context, req *SendRequest) (string, string, *models.QuotedMessage, error) {
+	if req.ReplyTo == "" && req.ReplyToSeq <= 0 && req.ThreadRoot == "" {
+		return "", "", nil, nil
+	}
+	lookup := func(serverMsgID string, seq int64) (*models.Message, error) {
+		var m *models.Message
+		var err error
+		if serverMsgID != "" {
+			m, err = s.Store.GetByID(ctx, req.ConvID, serverMsgID)
+		} else {
+			m, err = s.Store.GetBySeq(ctx, req.ConvID, seq)
 		}
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, ErrReplyTargetMissing
+			}
+			return nil, err
+		}
+		if m.Recalled {
+			return nil, ErrMessageRecalled
+		}
+		return m, nil
 	}
 
-	d := &Deliver{
-		ServerMsgID:   msg.ServerMsgID,
-		ClientMsgID:   msg.ClientMsgID,
-		ConvID:        msg.ConvID,
-		ConvType:      msg.ConvType,
-		From:          msg.FromUserID,
-		To:            msg.ToUserID,
-		GroupID:       msg.GroupID,
-		Seq:           msg.Seq,
-		Timestamp:     msg.Timestamp.UnixMilli(),
-		Type:          msg.Type,
-		Payload:       json.RawMessage(msg.Payload),
-		StreamID:      msg.StreamID,
-		StreamSeq:     msg.StreamSeq,
-		StreamStatus:  msg.StreamStatus,
-		IsStreaming:   msg.IsStreaming,
-		ExpireAt:      msg.ExpireAt,
-		BurnAfterRead: msg.BurnAfterRead,
+	var replyTo, threadRoot string
+	var quote *models.QuotedMessage
+	if req.ReplyTo != "" || req.ReplyToSeq > 0 {
+		target, err := lookup(req.ReplyTo, req.ReplyToSeq)
+		if err != nil {
+			return "", "", nil, err
+		}
+		replyTo = target.ServerMsgID
+		threadRoot = target.ThreadRoot
+		quote = &models.QuotedMessage{ServerMsgID: target.ServerMsgID, Seq: target.Seq, From: target.FromUserID, Type: target.Type, Summary: quoteSummary(target)}
+	}
+	if req.ThreadRoot != "" {
+		root, err := lookup(req.ThreadRoot, 0)
+		if err != nil {
+			return "", "", nil, err
+		}
+		threadRoot = root.ServerMsgID
+		if root.ThreadRoot != "" {
+			threadRoot = root.ThreadRoot
+		}
+	}
+	return replyTo, threadRoot, quote, nil
+}
+
+// quoteSummary 生成被引用消息摘要：文本截断，其它类型使用占位文案。
+func quoteSummary(m *models.Message) string {
+	switch m.Type {
+	case models.MessageTypeText:
+		var p models.TextPayload
+		_ = json.Unmarshal(m.Payload, &p)
+		r := []rune(p.Text)
+		if len(r) > quoteSummaryRunes {
+			return string(r[:quoteSummaryRunes]) + "…"
+		}
+		return p.Text
+	case models.MessageTypeFile:
+		var p models.FilePayload
+		_ = json.Unmarshal(m.Payload, &p)
+		return "[文件] " + p.Name
+	case models.MessageTypeImage:
+		return "[图片]"
+	case models.MessageTypeVoice:
+		return "[语音]"
+	case models.MessageTypeVideo:
+		return "[视频]"
+	case models.MessageTypeCard:
+		return "[名片]"
+	case models.MessageTypeLocation:
+		return "[位置]"
 	}
-	// Redis 简化分发
-	payload, _ := json.Marshal(d)
-	if req.ConvType == models.ConversationTypeC2C {
-		err1 := cache.Client().Publish(ctx, cache.DeliverChannel(req.To), payload).Err()
-		err2 := cache.Client().Publish(ctx, cache.DeliverChannel(req.From), payload).Err()
-		log.Printf("Msg.Publish c2c: convId=%s to=%s err1=%v from=%s err2=%v", req.ConvID, req.To, err1, req.From, err2)
+	return "[消息]"
+}
+
+// publishToConv 按会话类型发布：C2C 按路由投递给双方（同一节点上的双方只发布一次），Group 投递给全体群成员。
+func publishToConv(ctx context.Context, groups *store.GroupStore, msg *models.Message, payload []byte) {
+	if msg.ConvType == models.ConversationTypeC2C {
+		err := cache.DeliverToUsers(ctx, []string{msg.ToUserID, msg.FromUserID}, payload)
+		log.Printf("Msg.Publish c2c: convId=%s to=%s from=%s err=%v", msg.ConvID, msg.ToUserID, msg.FromUserID, err)
 	} else {
-		err := cache.Client().Publish(ctx, cache.DeliverChannel(req.GroupID), payload).Err()
-		log.Printf("Msg.Publish group: convId=%s group=%s err=%v", req.ConvID, req.GroupID, err)
+		err := DeliverToGroup(ctx, groups, msg.GroupID, payload)
+		log.Printf("Msg.Publish group: convId=%s group=%s err=%v", msg.ConvID, msg.GroupID, err)
 	}
-	return d, nil
+}
+
+// DeliverToGroup 解析群成员并按路由表投递（每个目标节点发布一次），与单聊一样进入各设备的待确认窗口。
+func DeliverToGroup(ctx context.Context, groups *store.GroupStore, groupID string, payload []byte) error {
+	if groups == nil {
+		return errors.New("group store not configured")
+	}
+	members, err := groups.ListMemberIDs(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	return cache.DeliverToUsers(ctx, members, payload)
 }
 
 // StartStream 启动一条流式消息（分多次向同一条消息流追加增量）。
@@ -335,19 +721,480 @@ func (s *MessageService) EndStream(ctx context.Context, streamID string, finalTe
 	return err
 }
 
-// Recall 撤回指定消息（按 convId + serverMsgId）。
-func (s *MessageService) Recall(ctx context.Context, convID, serverMsgID string) error {
-	return s.Store.Recall(ctx, convID, serverMsgID)
+// Recall 撤回指定消息（按 convId + serverMsgId）：
+// 1) 校验撤回权限（发送者限时，群主/管理员不限），已撤回返回 ErrMessageRecalled
+// 2) 标记撤回后向单聊双方 / 群通道广播 recalled 事件
+func (s *MessageService) Recall(ctx context.Context, userID, convID, serverMsgID string) (*RecalledEvent, error) {
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.Recalled {
+		return nil, ErrMessageRecalled
+	}
+	if err := s.checkRecallPermission(ctx, userID, msg, time.Now()); err != nil {
+		return nil, err
+	}
+	return s.recall(ctx, msg, userID)
+}
+
+// ForceRecall 管理员强制撤回（不校验撤回权限与时间窗口），用于审核删除。
+func (s *MessageService) ForceRecall(ctx context.Context, convID, serverMsgID, by string) (*RecalledEvent, error) {
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.Recalled {
+		return nil, ErrMessageRecalled
+	}
+	return s.recall(ctx, msg, by)
+}
+
+// recall 标记撤回并广播 recalled 事件。
+func (s *MessageService) recall(ctx context.Context, msg *models.Message, by string) (*RecalledEvent, error) {
+	if err := s.Store.Recall(ctx, msg.ConvID, msg.ServerMsgID); err != nil {
+		log.Printf("Msg.Recall error: convId=%s serverMsgId=%s err=%v", msg.ConvID, msg.ServerMsgID, err)
+		return nil, err
+	}
+	evt := &RecalledEvent{ConvID: msg.ConvID, ServerMsgID: msg.ServerMsgID, Seq: msg.Seq, By: by}
+	b := NewEnvelope("recalled", evt)
+	publishToConv(ctx, s.GroupStore, msg, b)
+	log.Printf("Msg.Recall ok: convId=%s serverMsgId=%s by=%s", msg.ConvID, msg.ServerMsgID, by)
+	return evt, nil
+}
+
+// checkRecallPermission 撤回规则（同 entities.Message.CanRecall）：发送者须在 RecallWindow 内；群主/管理员可撤回群内任意消息。
+func (s *MessageService) checkRecallPermission(ctx context.Context, userID string, msg *models.Message, now time.Time) error {
+	if msg.ConvType == models.ConversationTypeGroup && s.GroupStore != nil {
+		role, err := s.GroupStore.GetMemberRole(ctx, msg.GroupID, userID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil && valueobjects.MemberRole(role).CanManageGroup() {
+			return nil
+		}
+		if err != nil {
+			return ErrNotGroupMember
+		}
+	}
+	if msg.FromUserID != userID {
+		return ErrRecallForbidden
+	}
+	if s.RecallWindow > 0 && now.Sub(msg.Timestamp) > s.RecallWindow {
+		return ErrRecallWindowExpired
+	}
+	return nil
+}
+
+// RecalledEvent 消息撤回后广播的 recalled 事件数据（by 为操作者）。
+type RecalledEvent struct {
+	ConvID      string `json:"convId"`
+	ServerMsgID string `json:"serverMsgId"`
+	Seq         int64  `json:"seq"`
+	By          string `json:"by"`
+}
+
+// EditedEvent 消息编辑后广播的 edited 事件数据。
+type EditedEvent struct {
+	ConvID      string          `json:"convId"`
+	ServerMsgID string          `json:"serverMsgId"`
+	Seq         int64           `json:"seq"`
+	From        string          `json:"from"`
+	Payload     json.RawMessage `json:"payload"`
+	Version     int             `json:"version"`
+	EditedAt    int64           `json:"editedAt"`
+}
+
+// Edit 编辑一条已发送的文本消息：
+// 1) 仅发送者可编辑，且须在 EditWindow 内、未被撤回
+// 2) 以当前 version 做乐观锁替换载荷，旧载荷写入历史版本
+// 3) 向单聊双方 / 群通道广播 edited 事件，多端原地更新
+func (s *MessageService) Edit(ctx context.Context, userID, convID, serverMsgID string, payload json.RawMessage) (*EditedEvent, error) {
+	var text models.TextPayload
+	if err := json.Unmarshal(payload, &text); err != nil || text.Text == "" {
+		return nil, ErrInvalidPayload
+	}
+	if err := s.Payloads.Validate(ctx, PayloadContext{UserID: userID}, models.MessageTypeText, payload); err != nil {
+		return nil, err
+	}
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.FromUserID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if msg.Recalled {
+		return nil, ErrMessageRecalled
+	}
+	if msg.Type != models.MessageTypeText || msg.IsStreaming {
+		return nil, ErrMessageNotEditable
+	}
+	now := time.Now()
+	if s.EditWindow > 0 && now.Sub(msg.Timestamp) > s.EditWindow {
+		return nil, ErrEditWindowExpired
+	}
+	verdict, err := s.Moderation.Check(ctx, msg.GroupID, models.MessageTypeText, payload)
+	if err != nil {
+		return nil, err
+	}
+	if verdict != nil {
+		payload = verdict.Payload
+	}
+	if err := s.Store.Edit(ctx, convID, serverMsgID, payload, msg.Version, userID, now); err != nil {
+		log.Printf("Msg.Edit error: convId=%s serverMsgId=%s err=%v", convID, serverMsgID, err)
+		return nil, err
+	}
+	edited := *msg
+	edited.Payload = payload
+	s.Search.ReindexMessage(ctx, &edited)
+	evt := &EditedEvent{
+		ConvID:      convID,
+		ServerMsgID: serverMsgID,
+		Seq:         msg.Seq,
+		From:        userID,
+		Payload:     payload,
+		Version:     msg.Version + 1,
+		EditedAt:    now.UnixMilli(),
+	}
+	b := NewEnvelope("edited", evt)
+	publishToConv(ctx, s.GroupStore, msg, b)
+	// 按新内容重新生成链接预览（不再含链接时清空）
+	edited.Version = evt.Version
+	s.Unfurl.Attach(&edited)
+	s.Moderation.Enqueue(ctx, &edited, verdict)
+	log.Printf("Msg.Edit ok: convId=%s serverMsgId=%s version=%d", convID, serverMsgID, evt.Version)
+	return evt, nil
+}
+
+// ListRevisions 查询消息的编辑历史（仅会话参与方可见）。
+func (s *MessageService) ListRevisions(ctx context.Context, userID, convID, serverMsgID string) ([]*models.MessageRevision, error) {
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if !s.isParticipant(ctx, userID, msg) {
+		return nil, ErrNotParticipant
+	}
+	return s.Store.ListRevisions(ctx, convID, serverMsgID)
 }
 
-// DeleteConversation 为用户设置会话删除水位（不物理删历史）。
+// ReactionEvent 表情回应变更后广播的 reaction 事件数据。
+type ReactionEvent struct {
+	ConvID      string `json:"convId"`
+	ServerMsgID string `json:"serverMsgId"`
+	Seq         int64  `json:"seq"`
+	Emoji       string `json:"emoji"`
+	UserID      string `json:"userId"`
+	Op          string `json:"op"`    // add/remove
+	Count       int    `json:"count"` // 变更后该表情的总数
+	Ts          int64  `json:"ts"`
+}
+
+// React 添加（add=true）或取消表情回应：
+// 1) 校验 emoji、消息存在且未撤回、用户为会话参与方
+// 2) 写入/删除回应记录（重复操作幂等，不重复广播）
+// 3) 与 Send 相同的方式向单聊双方 / 群通道广播 reaction 事件
+func (s *MessageService) React(ctx context.Context, userID, convID, serverMsgID, emoji string, add bool) (*ReactionEvent, error) {
+	if emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return nil, ErrInvalidEmoji
+	}
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.Recalled {
+		return nil, ErrMessageRecalled
+	}
+	if !s.isParticipant(ctx, userID, msg) {
+		return nil, ErrNotParticipant
+	}
+	now := time.Now()
+	op := "add"
+	var changed bool
+	if add {
+		changed, err = s.Store.AddReaction(ctx, &models.MessageReaction{ConvID: convID, ServerMsgID: serverMsgID, Emoji: emoji, UserID: userID, CreatedAt: now})
+	} else {
+		op = "remove"
+		changed, err = s.Store.RemoveReaction(ctx, convID, serverMsgID, emoji, userID)
+	}
+	if err != nil {
+		log.Printf("Msg.React error: convId=%s serverMsgId=%s op=%s err=%v", convID, serverMsgID, op, err)
+		return nil, err
+	}
+	evt := &ReactionEvent{ConvID: convID, ServerMsgID: serverMsgID, Seq: msg.Seq, Emoji: emoji, UserID: userID, Op: op, Ts: now.UnixMilli()}
+	if counts, err := s.Store.CountReactions(ctx, convID, []string{serverMsgID}, userID); err == nil {
+		for _, rc := range counts[serverMsgID] {
+			if rc.Emoji == emoji {
+				evt.Count = rc.Count
+			}
+		}
+	}
+	if changed {
+		b := NewEnvelope("reaction", evt)
+		publishToConv(ctx, s.GroupStore, msg, b)
+	}
+	return evt, nil
+}
+
+// AttachReactions 为一页消息填充表情回应聚合（失败时忽略，不影响历史拉取）。
+func (s *MessageService) AttachReactions(ctx context.Context, userID, convID string, msgs []*models.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ServerMsgID)
+	}
+	counts, err := s.Store.CountReactions(ctx, convID, ids, userID)
+	if err != nil {
+		log.Printf("Msg.CountReactions error: convId=%s err=%v", convID, err)
+		return
+	}
+	for _, m := range msgs {
+		m.Reactions = counts[m.ServerMsgID]
+	}
+}
+
+// ListThread 拉取话题：返回根消息与 seq>fromSeq 的回复（仅会话参与方可见）。
+func (s *MessageService) ListThread(ctx context.Context, userID, convID, rootID string, fromSeq int64, limit int) (*models.Message, []*models.Message, error) {
+	root, err := s.Store.GetByID(ctx, convID, rootID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, ErrMessageNotFound
+		}
+		return nil, nil, err
+	}
+	if !s.isParticipant(ctx, userID, root) {
+		return nil, nil, ErrNotParticipant
+	}
+	wms, err := s.Store.DeleteWatermarks(ctx, userID, []string{convID})
+	if err != nil {
+		return nil, nil, err
+	}
+	wm, hasWM := wms[convID]
+	if hasWM && !root.Timestamp.After(wm) {
+		return nil, nil, ErrMessageNotFound
+	}
+	replies, err := s.Store.ListThread(ctx, convID, rootID, fromSeq, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasWM {
+		visible := replies[:0]
+		for _, m := range replies {
+			if m.Timestamp.After(wm) {
+				visible = append(visible, m)
+			}
+		}
+		replies = visible
+	}
+	return root, replies, nil
+}
+
+// PinnedChangedEvent 置顶变更后广播的 pinned_changed 事件数据。
+type PinnedChangedEvent struct {
+	ConvID      string                  `json:"convId"`
+	ServerMsgID string                  `json:"serverMsgId"`
+	Seq         int64                   `json:"seq"`
+	Pinned      bool                    `json:"pinned"`
+	By          string                  `json:"by"`
+	Ts          int64                   `json:"ts"`
+	Pins        []*models.PinnedMessage `json:"pins"` // 变更后的完整置顶列表，客户端可直接替换
+}
+
+// Pin 置顶（pin=true）或取消置顶会话内消息：
+// 1) 单聊双方均可操作；群聊仅群主/管理员（MemberRole.CanManageGroup）
+// 2) 置顶须为未撤回消息，且会话置顶数不超过 maxPinsPerConv
+// 3) 状态变化时向单聊双方 / 群通道广播 pinned_changed 事件
+func (s *MessageService) Pin(ctx context.Context, userID, convID, serverMsgID string, pin bool) (*PinnedChangedEvent, error) {
+	if s.ConvStore == nil {
+		return nil, fmt.Errorf("conversation store not configured")
+	}
+	msg, err := s.Store.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if err := s.checkPinPermission(ctx, userID, msg); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var changed bool
+	if pin {
+		if msg.Recalled {
+			return nil, ErrMessageRecalled
+		}
+		n, err := s.ConvStore.CountPins(ctx, convID)
+		if err != nil {
+			return nil, err
+		}
+		if n >= maxPinsPerConv {
+			return nil, ErrPinLimitExceeded
+		}
+		changed, err = s.ConvStore.AddPin(ctx, &models.PinnedMessage{ConvID: convID, ServerMsgID: serverMsgID, Seq: msg.Seq, Type: msg.Type, Summary: quoteSummary(msg), PinnedBy: userID, PinnedAt: now})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		changed, err = s.ConvStore.RemovePin(ctx, convID, serverMsgID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pins, err := s.ConvStore.ListPins(ctx, convID)
+	if err != nil {
+		return nil, err
+	}
+	evt := &PinnedChangedEvent{ConvID: convID, ServerMsgID: serverMsgID, Seq: msg.Seq, Pinned: pin, By: userID, Ts: now.UnixMilli(), Pins: pins}
+	if changed {
+		b := NewEnvelope("pinned_changed", evt)
+		publishToConv(ctx, s.GroupStore, msg, b)
+		log.Printf("Msg.Pin ok: convId=%s serverMsgId=%s pinned=%v by=%s", convID, serverMsgID, pin, userID)
+	}
+	return evt, nil
+}
+
+// checkPinPermission 单聊要求为会话参与方；群聊要求群主/管理员。
+func (s *MessageService) checkPinPermission(ctx context.Context, userID string, msg *models.Message) error {
+	if msg.ConvType != models.ConversationTypeGroup {
+		if !s.isParticipant(ctx, userID, msg) {
+			return ErrNotParticipant
+		}
+		return nil
+	}
+	if s.GroupStore == nil {
+		return ErrPinForbidden
+	}
+	role, err := s.GroupStore.GetMemberRole(ctx, msg.GroupID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotGroupMember
+		}
+		return err
+	}
+	if !valueobjects.MemberRole(role).CanManageGroup() {
+		return ErrPinForbidden
+	}
+	return nil
+}
+
+// ListPins 查询会话置顶消息并附带完整消息（仅会话参与方可见；已删除/撤回的消息不附带正文）。
+func (s *MessageService) ListPins(ctx context.Context, userID, convID string) ([]*models.PinnedMessage, error) {
+	if s.ConvStore == nil {
+		return nil, nil
+	}
+	pins, err := s.ConvStore.ListPins(ctx, convID)
+	if err != nil || len(pins) == 0 {
+		return pins, err
+	}
+	allowed := false
+	for _, p := range pins {
+		m, err := s.Store.GetByID(ctx, convID, p.ServerMsgID)
+		if err != nil {
+			continue
+		}
+		if !allowed {
+			if !s.isParticipant(ctx, userID, m) {
+				return nil, ErrNotParticipant
+			}
+			allowed = true
+		}
+		if !m.Recalled {
+			p.Message = m
+		}
+	}
+	if !allowed {
+		return nil, ErrMessageNotFound
+	}
+	return pins, nil
+}
+
+// isParticipant 判断用户是否为消息所在会话的参与方（单聊双方 / 群成员）。
+func (s *MessageService) isParticipant(ctx context.Context, userID string, msg *models.Message) bool {
+	return isParticipant(ctx, s.GroupStore, userID, msg)
+}
+
+func isParticipant(ctx context.Context, groups *store.GroupStore, userID string, msg *models.Message) bool {
+	switch msg.ConvType {
+	case models.ConversationTypeC2C:
+		return msg.FromUserID == userID || msg.ToUserID == userID
+	case models.ConversationTypeGroup:
+		if groups == nil {
+			return true
+		}
+		ok, _ := groups.IsMember(ctx, msg.GroupID, userID)
+		return ok
+	}
+	return false
+}
+
+// ClearHistory 清空用户视角的会话历史：设置删除水位（不物理删历史）并将未读清零，会话仍保留在列表中。
+func (s *MessageService) ClearHistory(ctx context.Context, ownerID, convID string) error {
+	if err := s.Store.DeleteConversation(ctx, ownerID, convID); err != nil {
+		return err
+	}
+	s.markConvRead(ctx, ownerID, convID)
+	return nil
+}
+
+// DeleteConversation 删除会话：清空历史并从会话列表隐藏，直到会话有新消息时重新出现。
 func (s *MessageService) DeleteConversation(ctx context.Context, ownerID, convID string) error {
-	return s.Store.DeleteConversation(ctx, ownerID, convID)
+	if err := s.ClearHistory(ctx, ownerID, convID); err != nil {
+		return err
+	}
+	if s.ConvStore == nil {
+		return nil
+	}
+	return s.ConvStore.HideUserConversation(ctx, ownerID, convID)
+}
+
+// markConvRead 将用户在会话的已读水位推进到会话 last_seq（清空/删除后不再计入未读）。
+func (s *MessageService) markConvRead(ctx context.Context, ownerID, convID string) {
+	if s.ConvStore == nil || s.Receipts == nil {
+		return
+	}
+	lastSeq, err := s.ConvStore.GetConversationLastSeq(ctx, convID)
+	if err != nil || lastSeq <= 0 {
+		return
+	}
+	if err := s.Receipts.UpsertReadSeq(ctx, ownerID, convID, lastSeq); err != nil {
+		log.Printf("Msg.MarkConvRead error: owner=%s convId=%s err=%v", ownerID, convID, err)
+		return
+	}
+	cache.Client().Set(ctx, readSeqCacheKey(ownerID, convID), lastSeq, 10*time.Minute)
+}
+
+// List 按 seq 游标拉取 userID 可见的历史（隐藏其删除水位及之前的消息）。
+func (s *MessageService) List(ctx context.Context, userID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	return s.Store.List(ctx, userID, convID, fromSeq, limit)
+}
+
+// ListForSync 离线同步拉取 userID 可见的增量（含已撤回/已过期消息，由调用方转为墓碑）。
+func (s *MessageService) ListForSync(ctx context.Context, userID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	return s.Store.ListForSync(ctx, userID, convID, fromSeq, limit)
 }
 
-// List 按 seq 游标拉取历史。
-func (s *MessageService) List(ctx context.Context, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
-	return s.Store.List(ctx, convID, fromSeq, limit)
+// ListBefore 向前翻页拉取 userID 可见的历史（beforeSeq<=0 表示从最新一条开始）。
+func (s *MessageService) ListBefore(ctx context.Context, userID, convID string, beforeSeq int64, limit int) ([]*models.Message, error) {
+	return s.Store.ListBefore(ctx, userID, convID, beforeSeq, limit)
 }
 
 // DeleteExpired 清理到期的定时自毁消息（SQL 侧通过定时任务调用；Mongo 侧可由 TTL 索引自动清理）。
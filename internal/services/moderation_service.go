@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/moderation"
+	"go-im/internal/store"
+)
+
+// moderationGroupTTL 群级处理方式的 Redis 缓存时间（修改时主动失效）
+const moderationGroupTTL = 5 * time.Minute
+
+func moderationGroupKey(groupID string) string { return "im:moderation:group:" + groupID }
+
+// ModerationVerdict 单条内容的审核结论（未命中敏感词时为 nil）。
+// Payload 为处理后的载荷（mask 时已替换命中词），Review 表示入库后需进入人工审核队列。
+type ModerationVerdict struct {
+	Action  string          `json:"action"`
+	Words   []string        `json:"words"`
+	Payload json.RawMessage `json:"-"`
+	Review  bool            `json:"-"`
+	content string
+}
+
+// ModerationService 敏感词过滤与人工审核：
+// - 检查各类型载荷中的文本字段（见 moderationTextFields，合并转发递归检查各条目）；词典由 moderation.Dictionary 热加载
+// - 处理方式：词典中单个词的设置与全局默认取更严格者；群级覆盖优先（none 表示该群关闭过滤）
+// - mask 替换命中词后发送；reject 返回 ErrContentRejected；review 正常发送并进入审核队列
+// - 审核通过仅记录结论；审核删除强制撤回消息并广播 recalled
+type ModerationService struct {
+	Dict          *moderation.Dictionary
+	Store         *store.ModerationStore // 可选：为空时不支持群级覆盖与审核队列（review 退化为 mask）
+	Msg           *MessageService
+	DefaultAction string
+}
+
+func NewModerationService(dict *moderation.Dictionary, ms *store.ModerationStore, msg *MessageService, defaultAction string) *ModerationService {
+	if !moderation.ValidAction(defaultAction) {
+		defaultAction = moderation.ActionMask
+	}
+	return &ModerationService{Dict: dict, Store: ms, Msg: msg, DefaultAction: defaultAction}
+}
+
+// Check 检查待发送/编辑的内容；reject 时返回 ErrContentRejected。
+func (s *ModerationService) Check(ctx context.Context, groupID, msgType string, payload json.RawMessage) (*ModerationVerdict, error) {
+	if s == nil || s.Dict == nil {
+		return nil, nil
+	}
+	var scan moderationScan
+	masked, hit := scanPayload(s.Dict.Matcher(), msgType, payload, &scan)
+	if !hit {
+		return nil, nil
+	}
+	v := &ModerationVerdict{Action: moderation.ActionNone, Payload: payload, content: strings.Join(scan.texts, "\n")}
+	seen := make(map[string]bool)
+	for _, m := range scan.matches {
+		action := m.Action
+		if action == "" {
+			action = s.DefaultAction
+		}
+		v.Action = moderation.Stricter(v.Action, action)
+		if !seen[m.Word] {
+			seen[m.Word] = true
+			v.Words = append(v.Words, m.Word)
+		}
+	}
+	if groupID != "" {
+		override, err := s.groupAction(ctx, groupID)
+		if err != nil {
+			log.Printf("Moderation.GroupAction error: group=%s err=%v", groupID, err)
+		} else if override != "" {
+			v.Action = override
+		}
+	}
+	switch v.Action {
+	case moderation.ActionNone:
+		return nil, nil
+	case moderation.ActionReject:
+		log.Printf("Moderation.Check rejected: group=%s words=%v", groupID, v.Words)
+		return v, ErrContentRejected
+	case moderation.ActionReview:
+		if s.Store != nil {
+			v.Review = true
+			return v, nil
+		}
+	}
+	// mask：仅替换命中的文本字段，保留 mentions、附件等其他字段
+	v.Payload = masked
+	return v, nil
+}
+
+// moderationTextFields 各消息类型参与过滤的文本字段（merged 另递归检查 items[].payload）
+var moderationTextFields = map[string][]string{
+	models.MessageTypeText:     {"text"},
+	models.MessageTypeFile:     {"name"},
+	models.MessageTypeCard:     {"nickname"},
+	models.MessageTypeLocation: {"title", "address"},
+	models.MessageTypeMerged:   {"title"},
+}
+
+// moderationScan 一条载荷的命中结果：全部命中与命中的原文（审核队列展示）
+type moderationScan struct {
+	matches []moderation.Match
+	texts   []string
+}
+
+// scanPayload 按类型扫描载荷中的文本字段，返回替换命中词后的载荷及是否命中（未命中时原样返回）。
+func scanPayload(m *moderation.Matcher, msgType string, payload json.RawMessage, scan *moderationScan) (json.RawMessage, bool) {
+	keys, ok := moderationTextFields[msgType]
+	if !ok {
+		return payload, false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload, false
+	}
+	hit := false
+	for _, k := range keys {
+		var text string
+		if err := json.Unmarshal(fields[k], &text); err != nil || text == "" {
+			continue
+		}
+		found := m.Find(text)
+		if len(found) == 0 {
+			continue
+		}
+		hit = true
+		scan.matches = append(scan.matches, found...)
+		scan.texts = append(scan.texts, text)
+		fields[k], _ = json.Marshal(moderation.Mask(text, found))
+	}
+	if msgType == models.MessageTypeMerged {
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(fields["items"], &items); err == nil {
+			itemsHit := false
+			for _, it := range items {
+				var itemType string
+				_ = json.Unmarshal(it["type"], &itemType)
+				if p, ok := scanPayload(m, itemType, it["payload"], scan); ok {
+					it["payload"] = p
+					itemsHit = true
+				}
+			}
+			if itemsHit {
+				hit = true
+				fields["items"], _ = json.Marshal(items)
+			}
+		}
+	}
+	if !hit {
+		return payload, false
+	}
+	b, _ := json.Marshal(fields)
+	return b, true
+}
+
+// moderationVerdictKey SendContext 中保存审核结论的键
+const moderationVerdictKey = "moderation.verdict"
+
+// BeforePersist 发送拦截器（before-persist）：mask 改写载荷，reject 拒绝发送，review 记录结论待入库后入队。
+func (s *ModerationService) BeforePersist(ctx context.Context, sc *SendContext) error {
+	if !sc.Submitted() {
+		return nil
+	}
+	v, err := s.Check(ctx, sc.Req.GroupID, sc.Req.Type, sc.Req.Payload)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		sc.Req.Payload = v.Payload
+		sc.Set(moderationVerdictKey, v)
+	}
+	return nil
+}
+
+// AfterPersist 发送拦截器（after-persist）：将需人工审核的消息加入审核队列。
+func (s *ModerationService) AfterPersist(ctx context.Context, sc *SendContext) error {
+	v, _ := sc.Get(moderationVerdictKey).(*ModerationVerdict)
+	s.Enqueue(ctx, sc.Msg, v)
+	return nil
+}
+
+// groupAction 群级处理方式（Redis 缓存，未配置为空串）。
+func (s *ModerationService) groupAction(ctx context.Context, groupID string) (string, error) {
+	if s.Store == nil {
+		return "", nil
+	}
+	action, err := cache.Client().Get(ctx, moderationGroupKey(groupID)).Result()
+	if err == nil {
+		return action, nil
+	}
+	if err != redis.Nil {
+		log.Printf("Moderation.GroupAction cache error: group=%s err=%v", groupID, err)
+	}
+	action, err = s.Store.GetGroupAction(ctx, groupID)
+	if err != nil {
+		return "", err
+	}
+	cache.Client().Set(ctx, moderationGroupKey(groupID), action, moderationGroupTTL)
+	return action, nil
+}
+
+// Enqueue 将已入库的消息加入人工审核队列。
+func (s *ModerationService) Enqueue(ctx context.Context, msg *models.Message, v *ModerationVerdict) {
+	if s == nil || s.Store == nil || v == nil || !v.Review {
+		return
+	}
+	r := &models.ModerationReview{
+		ID:          uuid.NewString(),
+		ConvID:      msg.ConvID,
+		ConvType:    msg.ConvType,
+		ServerMsgID: msg.ServerMsgID,
+		Seq:         msg.Seq,
+		FromUserID:  msg.FromUserID,
+		GroupID:     msg.GroupID,
+		Content:     v.content,
+		Words:       v.Words,
+		Status:      models.ModerationReviewPending,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.Store.CreateReview(ctx, r); err != nil {
+		log.Printf("Moderation.Enqueue error: convId=%s serverMsgId=%s err=%v", msg.ConvID, msg.ServerMsgID, err)
+		return
+	}
+	log.Printf("Moderation.Enqueue ok: id=%s convId=%s serverMsgId=%s words=%v", r.ID, msg.ConvID, msg.ServerMsgID, v.Words)
+}
+
+// ListReviews 审核队列（status 为空时返回全部）。
+func (s *ModerationService) ListReviews(ctx context.Context, status string, limit, offset int) ([]*models.ModerationReview, error) {
+	if s.Store == nil {
+		return nil, nil
+	}
+	return s.Store.ListReviews(ctx, status, limit, offset)
+}
+
+// Approve 审核通过，消息保持原样。
+func (s *ModerationService) Approve(ctx context.Context, id, by string) (*models.ModerationReview, error) {
+	return s.resolve(ctx, id, models.ModerationReviewApproved, by)
+}
+
+// Delete 审核删除：强制撤回消息（已撤回或已删除的消息直接记录结论）。
+func (s *ModerationService) Delete(ctx context.Context, id, by string) (*models.ModerationReview, error) {
+	return s.resolve(ctx, id, models.ModerationReviewDeleted, by)
+}
+
+func (s *ModerationService) resolve(ctx context.Context, id, status, by string) (*models.ModerationReview, error) {
+	if s.Store == nil {
+		return nil, ErrReviewNotFound
+	}
+	r, err := s.Store.GetReview(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrReviewNotFound
+		}
+		return nil, err
+	}
+	if r.Status != models.ModerationReviewPending {
+		return nil, ErrReviewResolved
+	}
+	if status == models.ModerationReviewDeleted {
+		if _, err := s.Msg.ForceRecall(ctx, r.ConvID, r.ServerMsgID, by); err != nil && !errors.Is(err, ErrMessageRecalled) && !errors.Is(err, ErrMessageNotFound) {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	ok, err := s.Store.ResolveReview(ctx, id, status, by, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrReviewResolved
+	}
+	r.Status, r.ReviewedBy, r.ReviewedAt = status, by, &now
+	log.Printf("Moderation.Review resolved: id=%s status=%s by=%s", id, status, by)
+	return r, nil
+}
+
+// ListGroupPolicies 全部群级覆盖。
+func (s *ModerationService) ListGroupPolicies(ctx context.Context) ([]*models.ModerationGroupPolicy, error) {
+	if s.Store == nil {
+		return nil, nil
+	}
+	return s.Store.ListGroupPolicies(ctx)
+}
+
+// SetGroupPolicy 设置群级处理方式（none/mask/review/reject）。
+func (s *ModerationService) SetGroupPolicy(ctx context.Context, p *models.ModerationGroupPolicy) error {
+	if s.Store == nil || p.GroupID == "" || !moderation.ValidAction(p.Action) {
+		return ErrInvalidModeration
+	}
+	p.UpdatedAt = time.Now()
+	if err := s.Store.UpsertGroupPolicy(ctx, p); err != nil {
+		return err
+	}
+	cache.Client().Del(ctx, moderationGroupKey(p.GroupID))
+	log.Printf("Moderation.SetGroupPolicy: group=%s action=%s by=%s", p.GroupID, p.Action, p.UpdatedBy)
+	return nil
+}
+
+// DeleteGroupPolicy 删除群级覆盖，回退到全局处理方式。
+func (s *ModerationService) DeleteGroupPolicy(ctx context.Context, groupID string) error {
+	if s.Store == nil {
+		return nil
+	}
+	if _, err := s.Store.DeleteGroupPolicy(ctx, groupID); err != nil {
+		return err
+	}
+	cache.Client().Del(ctx, moderationGroupKey(groupID))
+	return nil
+}
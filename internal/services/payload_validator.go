@@ -0,0 +1,431 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go-im/internal/models"
+)
+
+// 载荷校验错误码（MessageErrorCode 直接返回 PayloadError.Code）
+const (
+	PayloadCodeUnknownType  = "UNKNOWN_MESSAGE_TYPE"
+	PayloadCodeMalformed    = "INVALID_PAYLOAD"
+	PayloadCodeRequired     = "PAYLOAD_FIELD_REQUIRED"
+	PayloadCodeInvalidField = "PAYLOAD_FIELD_INVALID"
+	PayloadCodeTooLarge     = "PAYLOAD_TOO_LARGE"
+	PayloadCodeURLNotOwned  = "PAYLOAD_URL_NOT_OWNED"
+)
+
+// 载荷大小限制
+const (
+	payloadMaxBytes        = 64 << 10  // 普通消息载荷上限
+	payloadMergedMaxBytes  = 1 << 20   // 合并转发载荷上限（内嵌最多 forwardMaxMessages 条快照）
+	payloadMaxTextRunes    = 10000     // 文本消息最大字符数
+	payloadMaxNameRunes    = 255       // 文件名/标题等短文本最大字符数
+	payloadMaxURLLen       = 2048      // URL 最大长度
+	payloadMaxMediaSeconds = 24 * 3600 // 语音/视频最大时长（秒）
+	payloadMaxDimension    = 100000    // 图片/视频最大宽高（像素）
+)
+
+// PayloadError 结构化的载荷校验错误：Code 为错误码，Field 为出错字段（JSON 路径）。
+type PayloadError struct {
+	Code   string
+	Field  string
+	Reason string
+}
+
+func (e *PayloadError) Error() string {
+	if e.Field == "" {
+		return "invalid payload: " + e.Reason
+	}
+	return fmt.Sprintf("invalid payload: %s: %s", e.Field, e.Reason)
+}
+
+// Is 使 errors.Is(err, ErrInvalidPayload) 对所有载荷错误成立。
+func (e *PayloadError) Is(target error) bool { return target == ErrInvalidPayload }
+
+// status 错误码对应的 HTTP 状态码。
+func (e *PayloadError) status() int {
+	switch e.Code {
+	case PayloadCodeURLNotOwned:
+		return 403
+	case PayloadCodeTooLarge:
+		return 413
+	}
+	return 400
+}
+
+func payloadRequired(field string) error {
+	return &PayloadError{Code: PayloadCodeRequired, Field: field, Reason: "required"}
+}
+
+func payloadInvalid(field, reason string) error {
+	return &PayloadError{Code: PayloadCodeInvalidField, Field: field, Reason: reason}
+}
+
+// PayloadContext 单次校验的上下文。
+type PayloadContext struct {
+	UserID    string
+	Forwarded bool // 逐条转发沿用原消息的附件，不校验 URL 归属
+	registry  *PayloadRegistry
+	merged    bool // 由 Forward 组装的合并转发（merged 类型仅允许服务端组装）
+}
+
+// CheckURL 校验附件 URL：必须为 http(s) 绝对地址，且（非转发时）属于发送者上传的文件。
+func (c *PayloadContext) CheckURL(ctx context.Context, field, raw string) error {
+	if raw == "" {
+		return payloadRequired(field)
+	}
+	if len(raw) > payloadMaxURLLen {
+		return &PayloadError{Code: PayloadCodeTooLarge, Field: field, Reason: "url too long"}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return payloadInvalid(field, "must be an absolute http(s) url")
+	}
+	if c.Forwarded || c.registry.FileOwner == nil {
+		return nil
+	}
+	ok, err := c.registry.FileOwner(ctx, c.UserID, raw)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &PayloadError{Code: PayloadCodeURLNotOwned, Field: field, Reason: "url does not belong to a file uploaded by the sender"}
+	}
+	return nil
+}
+
+// PayloadValidator 校验某一消息类型的载荷（raw 已确认为 JSON 对象）。
+type PayloadValidator func(ctx context.Context, c *PayloadContext, raw json.RawMessage) error
+
+// PayloadRegistry 按消息类型注册的载荷校验器：未注册的类型一律拒绝。
+// FileOwner 用于校验附件 URL 归属（通常为 FileService.OwnsURL），为空时仅校验格式。
+type PayloadRegistry struct {
+	FileOwner   func(ctx context.Context, userID, url string) (bool, error)
+	MaxFileSize int64 // 文件/媒体 size 字段上限（<=0 不限制）
+
+	mu         sync.RWMutex
+	validators map[string]PayloadValidator
+}
+
+// NewPayloadRegistry 创建注册了内置消息类型校验器的注册表。
+func NewPayloadRegistry() *PayloadRegistry {
+	r := &PayloadRegistry{validators: make(map[string]PayloadValidator)}
+	r.Register(models.MessageTypeText, validateTextPayload)
+	r.Register(models.MessageTypeImage, r.validateImagePayload)
+	r.Register(models.MessageTypeVoice, r.validateVoicePayload)
+	r.Register(models.MessageTypeVideo, r.validateVideoPayload)
+	r.Register(models.MessageTypeFile, r.validateFilePayload)
+	r.Register(models.MessageTypeCard, validateCardPayload)
+	r.Register(models.MessageTypeLocation, validateLocationPayload)
+	r.Register(models.MessageTypeCustom, validateCustomPayload)
+	r.Register(models.MessageTypeStream, validateStreamPayload)
+	r.Register(models.MessageTypeMerged, validateMergedPayload)
+	return r
+}
+
+// Register 注册（或覆盖）某一消息类型的校验器。
+func (r *PayloadRegistry) Register(msgType string, v PayloadValidator) {
+	r.mu.Lock()
+	r.validators[msgType] = v
+	r.mu.Unlock()
+}
+
+// Validate 校验消息载荷；r 为空时不做校验。
+func (r *PayloadRegistry) Validate(ctx context.Context, c PayloadContext, msgType string, raw json.RawMessage) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	v, ok := r.validators[msgType]
+	r.mu.RUnlock()
+	if !ok {
+		return &PayloadError{Code: PayloadCodeUnknownType, Field: "type", Reason: fmt.Sprintf("unknown message type %q", msgType)}
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '{' || !json.Valid(raw) {
+		return &PayloadError{Code: PayloadCodeMalformed, Reason: "payload must be a JSON object"}
+	}
+	c.registry = r
+	return v(ctx, &c, raw)
+}
+
+func checkPayloadSize(raw json.RawMessage, limit int) error {
+	if len(raw) > limit {
+		return &PayloadError{Code: PayloadCodeTooLarge, Reason: fmt.Sprintf("payload exceeds %d bytes", limit)}
+	}
+	return nil
+}
+
+func decodePayload(raw json.RawMessage, v any) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &PayloadError{Code: PayloadCodeMalformed, Reason: err.Error()}
+	}
+	return nil
+}
+
+func checkRunes(field, s string, max int, required bool) error {
+	if s == "" {
+		if required {
+			return payloadRequired(field)
+		}
+		return nil
+	}
+	if !utf8.ValidString(s) {
+		return payloadInvalid(field, "invalid utf-8")
+	}
+	if utf8.RuneCountInString(s) > max {
+		return &PayloadError{Code: PayloadCodeTooLarge, Field: field, Reason: fmt.Sprintf("exceeds %d characters", max)}
+	}
+	return nil
+}
+
+func (r *PayloadRegistry) checkFileSize(field string, size int64) error {
+	if size < 0 {
+		return payloadInvalid(field, "must not be negative")
+	}
+	if r.MaxFileSize > 0 && size > r.MaxFileSize {
+		return &PayloadError{Code: PayloadCodeTooLarge, Field: field, Reason: fmt.Sprintf("exceeds %d bytes", r.MaxFileSize)}
+	}
+	return nil
+}
+
+func checkDimensions(w, h int) error {
+	if w < 0 || w > payloadMaxDimension {
+		return payloadInvalid("width", "out of range")
+	}
+	if h < 0 || h > payloadMaxDimension {
+		return payloadInvalid("height", "out of range")
+	}
+	return nil
+}
+
+func checkDuration(d int) error {
+	if d <= 0 || d > payloadMaxMediaSeconds {
+		return payloadInvalid("duration", "out of range")
+	}
+	return nil
+}
+
+func validateTextPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.TextPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if strings.TrimSpace(p.Text) == "" {
+		return payloadRequired("text")
+	}
+	return checkRunes("text", p.Text, payloadMaxTextRunes, true)
+}
+
+func (r *PayloadRegistry) validateImagePayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.ImagePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.CheckURL(ctx, "url", p.URL); err != nil {
+		return err
+	}
+	if p.Thumbnail != "" {
+		if err := c.CheckURL(ctx, "thumbnail", p.Thumbnail); err != nil {
+			return err
+		}
+	}
+	if err := checkDimensions(p.Width, p.Height); err != nil {
+		return err
+	}
+	return r.checkFileSize("size", p.Size)
+}
+
+func (r *PayloadRegistry) validateVoicePayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.VoicePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.CheckURL(ctx, "url", p.URL); err != nil {
+		return err
+	}
+	if err := checkDuration(p.Duration); err != nil {
+		return err
+	}
+	return r.checkFileSize("size", p.Size)
+}
+
+func (r *PayloadRegistry) validateVideoPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.VideoPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.CheckURL(ctx, "url", p.URL); err != nil {
+		return err
+	}
+	if p.Thumbnail != "" {
+		if err := c.CheckURL(ctx, "thumbnail", p.Thumbnail); err != nil {
+			return err
+		}
+	}
+	if err := checkDuration(p.Duration); err != nil {
+		return err
+	}
+	if err := checkDimensions(p.Width, p.Height); err != nil {
+		return err
+	}
+	return r.checkFileSize("size", p.Size)
+}
+
+func (r *PayloadRegistry) validateFilePayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.FilePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.CheckURL(ctx, "url", p.URL); err != nil {
+		return err
+	}
+	if err := checkRunes("name", p.Name, payloadMaxNameRunes, true); err != nil {
+		return err
+	}
+	return r.checkFileSize("size", p.Size)
+}
+
+func validateCardPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.CardPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if p.UserID == "" {
+		return payloadRequired("userId")
+	}
+	return checkRunes("nickname", p.Nickname, payloadMaxNameRunes, false)
+}
+
+func validateLocationPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p struct {
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+		Address   string   `json:"address"`
+		Title     string   `json:"title"`
+	}
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if p.Latitude == nil {
+		return payloadRequired("latitude")
+	}
+	if p.Longitude == nil {
+		return payloadRequired("longitude")
+	}
+	if math.Abs(*p.Latitude) > 90 {
+		return payloadInvalid("latitude", "out of range")
+	}
+	if math.Abs(*p.Longitude) > 180 {
+		return payloadInvalid("longitude", "out of range")
+	}
+	if err := checkRunes("address", p.Address, payloadMaxNameRunes*2, false); err != nil {
+		return err
+	}
+	return checkRunes("title", p.Title, payloadMaxNameRunes, false)
+}
+
+func validateCustomPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.CustomPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	return checkRunes("type", p.Type, payloadMaxNameRunes, true)
+}
+
+// validateStreamPayload 仅校验客户端提交的 start 载荷（chunk/end 由服务端组装）。
+func validateStreamPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if err := checkPayloadSize(raw, payloadMaxBytes); err != nil {
+		return err
+	}
+	var p models.StreamPayload
+	return decodePayload(raw, &p)
+}
+
+// validateMergedPayload 合并转发只能由 Forward 从已有消息组装，客户端直接发送 merged 一律拒绝。
+func validateMergedPayload(ctx context.Context, c *PayloadContext, raw json.RawMessage) error {
+	if !c.merged {
+		return payloadInvalid("type", "merged messages can only be created by forwarding")
+	}
+	if err := checkPayloadSize(raw, payloadMergedMaxBytes); err != nil {
+		return err
+	}
+	var p models.MergedPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := checkRunes("title", p.Title, payloadMaxNameRunes, false); err != nil {
+		return err
+	}
+	if len(p.Items) == 0 {
+		return payloadRequired("items")
+	}
+	if len(p.Items) > forwardMaxMessages {
+		return &PayloadError{Code: PayloadCodeTooLarge, Field: "items", Reason: fmt.Sprintf("exceeds %d items", forwardMaxMessages)}
+	}
+	for i, it := range p.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		if it.ServerMsgID == "" || it.Type == "" {
+			return payloadRequired(field)
+		}
+		// 快照按条目类型的校验器校验；附件沿用原消息，不校验 URL 归属
+		item := PayloadContext{UserID: c.UserID, Forwarded: true, merged: true}
+		if err := c.registry.Validate(ctx, item, it.Type, it.Payload); err != nil {
+			var pe *PayloadError
+			if errors.As(err, &pe) {
+				nested := *pe
+				nested.Field = field + ".payload"
+				if pe.Field != "" {
+					nested.Field += "." + pe.Field
+				}
+				return &nested
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// PayloadErrorField 返回载荷错误的出错字段（非载荷错误返回空）。
+func PayloadErrorField(err error) string {
+	var pe *PayloadError
+	if errors.As(err, &pe) {
+		return pe.Field
+	}
+	return ""
+}
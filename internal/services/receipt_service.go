@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/store"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 已读回执参数
+const (
+	receiptMaxEventMessages = 200 // 单次推进最多为多少条消息生成 read_receipt 增量
+	receiptMemberChunk      = 500 // 批量查询成员已读 seq 的分片大小
+)
+
+// ReadByResult 群消息已读详情：ReadCount/MemberCount 即 N/M（不含发送者本人）。
+type ReadByResult struct {
+	ConvID      string   `json:"convId"`
+	ServerMsgID string   `json:"serverMsgId"`
+	Seq         int64    `json:"seq"`
+	ReadCount   int      `json:"readCount"`
+	MemberCount int      `json:"memberCount"`
+	ReadBy      []string `json:"readBy"`
+	UnreadBy    []string `json:"unreadBy"`
+}
+
+// ReadReceiptEvent 推送给原发送者的 read_receipt 增量事件：Reader 已读了 Seqs 中的消息。
+type ReadReceiptEvent struct {
+	ConvID       string   `json:"convId"`
+	GroupID      string   `json:"groupId"`
+	Reader       string   `json:"reader"`
+	ReadSeq      int64    `json:"readSeq"`
+	Seqs         []int64  `json:"seqs"`
+	ServerMsgIDs []string `json:"serverMsgIds"`
+	Ts           int64    `json:"ts"`
+}
+
+// ReceiptService 已读回执：
+// - MarkRead 推进用户已读水位（read_receipts），群聊中新读到的他人消息按原发送者推送 read_receipt 增量
+// - ReadBy 以成员已读水位 >= 消息 seq 计算群消息的已读成员与 N/M
+type ReceiptService struct {
+	Receipts   *store.ReceiptStore
+	Store      store.MessageStoreInterface
+	GroupStore *store.GroupStore
+}
+
+func NewReceiptService(rs *store.ReceiptStore, ms store.MessageStoreInterface, gs *store.GroupStore) *ReceiptService {
+	return &ReceiptService{Receipts: rs, Store: ms, GroupStore: gs}
+}
+
+// MarkRead 写入已读水位并更新缓存；水位前进时推送 read_receipt 增量（失败仅记录日志）。
+// 仅会话参与方（单聊双方/群成员）可推进，否则返回 ErrNotParticipant；会话尚无消息时忽略。
+func (s *ReceiptService) MarkRead(ctx context.Context, userID, convID string, seq int64) error {
+	first, err := s.Store.List(ctx, "", convID, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(first) == 0 {
+		return nil
+	}
+	if !isParticipant(ctx, s.GroupStore, userID, first[0]) {
+		return ErrNotParticipant
+	}
+	prev, err := s.Receipts.AdvanceReadSeq(ctx, userID, convID, seq)
+	if err != nil {
+		return err
+	}
+	if seq <= prev {
+		return nil
+	}
+	cache.Client().Set(ctx, readSeqCacheKey(userID, convID), seq, 10*time.Minute)
+	s.notifySenders(ctx, userID, convID, prev, seq)
+	return nil
+}
+
+// notifySenders 按原发送者聚合新读到的群消息并推送至其个人通道。
+func (s *ReceiptService) notifySenders(ctx context.Context, reader, convID string, prev, seq int64) {
+	from := prev
+	if seq-from > receiptMaxEventMessages {
+		from = seq - receiptMaxEventMessages
+	}
+	msgs, err := s.Store.List(ctx, "", convID, from, receiptMaxEventMessages)
+	if err != nil {
+		log.Printf("Receipt.List error: convId=%s err=%v", convID, err)
+		return
+	}
+	bySender := make(map[string]*ReadReceiptEvent)
+	var order []string
+	now := time.Now().UnixMilli()
+	for _, m := range msgs {
+		if m.Seq > seq {
+			break
+		}
+		if m.ConvType != models.ConversationTypeGroup || m.FromUserID == reader {
+			continue
+		}
+		evt, ok := bySender[m.FromUserID]
+		if !ok {
+			evt = &ReadReceiptEvent{ConvID: convID, GroupID: m.GroupID, Reader: reader, ReadSeq: seq, Ts: now}
+			bySender[m.FromUserID] = evt
+			order = append(order, m.FromUserID)
+		}
+		evt.Seqs = append(evt.Seqs, m.Seq)
+		evt.ServerMsgIDs = append(evt.ServerMsgIDs, m.ServerMsgID)
+	}
+	for _, sender := range order {
+		b := NewEnvelope("read_receipt", bySender[sender])
+		if err := cache.DeliverToUser(ctx, sender, b); err != nil {
+			log.Printf("Receipt.Publish error: convId=%s sender=%s err=%v", convID, sender, err)
+		}
+	}
+}
+
+// ReadBy 查询群消息的已读成员（仅发送者可查看）。
+func (s *ReceiptService) ReadBy(ctx context.Context, userID, convID string, seq int64) (*ReadByResult, error) {
+	msg, err := s.Store.GetBySeq(ctx, convID, seq)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.ConvType != models.ConversationTypeGroup {
+		return nil, ErrInvalidPayload
+	}
+	if msg.FromUserID != userID {
+		return nil, ErrNotMessageSender
+	}
+	members, err := s.GroupStore.ListMemberIDs(ctx, msg.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	res := &ReadByResult{ConvID: convID, ServerMsgID: msg.ServerMsgID, Seq: msg.Seq, ReadBy: []string{}, UnreadBy: []string{}}
+	others := make([]string, 0, len(members))
+	for _, uid := range members {
+		if uid != msg.FromUserID {
+			others = append(others, uid)
+		}
+	}
+	for i := 0; i < len(others); i += receiptMemberChunk {
+		end := i + receiptMemberChunk
+		if end > len(others) {
+			end = len(others)
+		}
+		seqs, err := s.Receipts.ListReadSeqs(ctx, convID, others[i:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, uid := range others[i:end] {
+			if seqs[uid] >= msg.Seq {
+				res.ReadBy = append(res.ReadBy, uid)
+			} else {
+				res.UnreadBy = append(res.UnreadBy, uid)
+			}
+		}
+	}
+	res.ReadCount, res.MemberCount = len(res.ReadBy), len(others)
+	return res, nil
+}
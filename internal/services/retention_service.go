@@ -0,0 +1,280 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/store"
+)
+
+// 保留策略扫描参数
+const (
+	retentionConvPage = 200 // 每批扫描的会话数
+	retentionMsgPage  = 500 // 每批归档/删除的消息数（对应一个归档文件）
+	retentionLock     = "retention"
+	retentionLockTTL  = 30 * time.Minute
+)
+
+// RetentionStats 单轮保留策略执行结果。
+type RetentionStats struct {
+	Convs    int      `json:"convs"`
+	Archived int64    `json:"archived"`
+	Deleted  int64    `json:"deleted"`
+	Files    []string `json:"files,omitempty"`
+}
+
+// RetentionService 消息保留策略：
+// - 策略优先级：单聊会话（c2c）> 群（group）> 全局（global，数据库未配置时取配置文件默认值）
+// - Run 由后台定时任务调用：扫描存在过期消息的会话，按策略归档为 gzip JSONL 文件后删除，或直接删除
+// - 多实例下通过 Redis 分布式锁保证同一时刻仅一个实例执行
+type RetentionService struct {
+	Policies   *store.RetentionStore
+	Store      store.MessageStoreInterface
+	Search     *SearchService // 可选：清理消息时同步删除检索索引
+	ArchiveDir string
+	Default    models.RetentionPolicy // 全局默认（来自配置）
+}
+
+func NewRetentionService(ps *store.RetentionStore, ms store.MessageStoreInterface, archiveDir string) *RetentionService {
+	return &RetentionService{Policies: ps, Store: ms, ArchiveDir: archiveDir, Default: models.RetentionPolicy{Scope: models.RetentionScopeGlobal, Action: models.RetentionActionArchive}}
+}
+
+// retentionPolicies 已加载的策略集合。
+type retentionPolicies struct {
+	global models.RetentionPolicy
+	groups map[string]models.RetentionPolicy
+	c2c    map[string]models.RetentionPolicy
+}
+
+// resolve 按会话解析生效策略。
+func (ps *retentionPolicies) resolve(m *models.Message) models.RetentionPolicy {
+	if p, ok := ps.c2c[m.ConvID]; ok && m.ConvType == models.ConversationTypeC2C {
+		return p
+	}
+	if p, ok := ps.groups[m.GroupID]; ok && m.ConvType == models.ConversationTypeGroup {
+		return p
+	}
+	return ps.global
+}
+
+// minDays 所有生效策略中最短的保留天数（0 表示没有需要清理的策略）。
+func (ps *retentionPolicies) minDays() int {
+	min := ps.global.Days
+	for _, m := range []map[string]models.RetentionPolicy{ps.groups, ps.c2c} {
+		for _, p := range m {
+			if p.Days > 0 && (min <= 0 || p.Days < min) {
+				min = p.Days
+			}
+		}
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
+
+func (s *RetentionService) load(ctx context.Context) (*retentionPolicies, error) {
+	list, err := s.Policies.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps := &retentionPolicies{global: s.Default, groups: make(map[string]models.RetentionPolicy), c2c: make(map[string]models.RetentionPolicy)}
+	for _, p := range list {
+		switch p.Scope {
+		case models.RetentionScopeGlobal:
+			ps.global = *p
+		case models.RetentionScopeGroup:
+			ps.groups[p.TargetID] = *p
+		case models.RetentionScopeC2C:
+			ps.c2c[p.TargetID] = *p
+		}
+	}
+	return ps, nil
+}
+
+// ListPolicies 返回数据库中的策略以及当前生效的全局策略。
+func (s *RetentionService) ListPolicies(ctx context.Context) ([]*models.RetentionPolicy, *models.RetentionPolicy, error) {
+	list, err := s.Policies.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	global := s.Default
+	for _, p := range list {
+		if p.Scope == models.RetentionScopeGlobal {
+			global = *p
+		}
+	}
+	return list, &global, nil
+}
+
+// SetPolicy 新增或更新策略（global 的 targetId 固定为空；action 为空时默认 archive）。
+func (s *RetentionService) SetPolicy(ctx context.Context, p *models.RetentionPolicy) error {
+	switch p.Scope {
+	case models.RetentionScopeGlobal:
+		p.TargetID = ""
+	case models.RetentionScopeGroup, models.RetentionScopeC2C:
+		if p.TargetID == "" {
+			return ErrInvalidRetention
+		}
+	default:
+		return ErrInvalidRetention
+	}
+	if p.Action == "" {
+		p.Action = models.RetentionActionArchive
+	}
+	if p.Days < 0 || (p.Action != models.RetentionActionArchive && p.Action != models.RetentionActionDelete) {
+		return ErrInvalidRetention
+	}
+	p.UpdatedAt = time.Now()
+	if err := s.Policies.Upsert(ctx, p); err != nil {
+		return err
+	}
+	log.Printf("Retention.SetPolicy: scope=%s target=%s days=%d action=%s by=%s", p.Scope, p.TargetID, p.Days, p.Action, p.UpdatedBy)
+	return nil
+}
+
+// DeletePolicy 删除策略，回退到上一级策略。
+func (s *RetentionService) DeletePolicy(ctx context.Context, scope, targetID string) error {
+	if scope == models.RetentionScopeGlobal {
+		targetID = ""
+	}
+	_, err := s.Policies.Delete(ctx, scope, targetID)
+	return err
+}
+
+// Run 执行一轮保留策略（未获得分布式锁时直接返回）。
+func (s *RetentionService) Run(ctx context.Context, now time.Time) (*RetentionStats, error) {
+	stats := &RetentionStats{}
+	token, ok, err := cache.TryLock(ctx, retentionLock, retentionLockTTL)
+	if err != nil || !ok {
+		return stats, err
+	}
+	defer func() { _ = cache.Unlock(context.Background(), retentionLock, token) }()
+
+	ps, err := s.load(ctx)
+	if err != nil {
+		return stats, err
+	}
+	minDays := ps.minDays()
+	if minDays <= 0 {
+		return stats, nil
+	}
+	scanBefore := now.AddDate(0, 0, -minDays)
+	after := ""
+	for {
+		convs, err := s.Store.ListRetentionConvs(ctx, scanBefore, after, retentionConvPage)
+		if err != nil {
+			return stats, err
+		}
+		for _, convID := range convs {
+			if err := s.applyConv(ctx, ps, convID, scanBefore, now, stats); err != nil {
+				log.Printf("Retention.Apply error: convId=%s err=%v", convID, err)
+			}
+		}
+		if len(convs) < retentionConvPage {
+			break
+		}
+		after = convs[len(convs)-1]
+	}
+	log.Printf("Retention.Run done: convs=%d archived=%d deleted=%d files=%d", stats.Convs, stats.Archived, stats.Deleted, len(stats.Files))
+	return stats, nil
+}
+
+// applyConv 按会话生效策略分批归档/删除早于截止时间的消息。
+func (s *RetentionService) applyConv(ctx context.Context, ps *retentionPolicies, convID string, scanBefore, now time.Time, stats *RetentionStats) error {
+	probe, err := s.Store.ListOlderThan(ctx, convID, scanBefore, 1)
+	if err != nil || len(probe) == 0 {
+		return err
+	}
+	policy := ps.resolve(probe[0])
+	if policy.Days <= 0 {
+		return nil
+	}
+	cutoff := now.AddDate(0, 0, -policy.Days)
+	stats.Convs++
+	for {
+		msgs, err := s.Store.ListOlderThan(ctx, convID, cutoff, retentionMsgPage)
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		if policy.Action == models.RetentionActionArchive {
+			file, err := s.archive(convID, msgs, now)
+			if err != nil {
+				return err
+			}
+			stats.Files = append(stats.Files, file)
+		}
+		ids := make([]string, 0, len(msgs))
+		for _, m := range msgs {
+			ids = append(ids, m.ServerMsgID)
+		}
+		n, err := s.Store.PurgeMessages(ctx, convID, ids)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			s.Search.RemoveMessage(ctx, convID, id)
+		}
+		if policy.Action == models.RetentionActionArchive {
+			stats.Archived += n
+		} else {
+			stats.Deleted += n
+		}
+		if len(msgs) < retentionMsgPage {
+			return nil
+		}
+	}
+}
+
+// archive 将一批消息写入 <ArchiveDir>/<yyyymmdd>/<convId>-<fromSeq>-<toSeq>.jsonl.gz（每行一条消息）。
+func (s *RetentionService) archive(convID string, msgs []*models.Message, now time.Time) (string, error) {
+	dir := filepath.Join(s.ArchiveDir, now.Format("20060102"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%d-%d.jsonl.gz", safeFileName(convID), msgs[0].Seq, msgs[len(msgs)-1].Seq)
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, m := range msgs {
+		if err = enc.Encode(m); err != nil {
+			break
+		}
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// safeFileName 将会话 ID 中的路径分隔等字符替换为下划线。
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/store"
+
+	"github.com/google/uuid"
+)
+
+// 定时消息限制与调度参数
+const (
+	scheduleMaxAhead        = 30 * 24 * time.Hour // 最远可预约的发送时间
+	scheduleMaxPending      = 100                 // 单用户待发送上限
+	scheduleDispatchBatch   = 100                 // 每轮最多发送条数
+	scheduleDispatchLock    = "scheduled_dispatch"
+	scheduleDispatchLockTTL = time.Minute     // 调度锁 TTL（单轮发送耗时上限）
+	scheduleStaleAfter      = 5 * time.Minute // sending 状态超过该时长视为实例中途退出
+)
+
+// ScheduleRequest 创建定时消息请求（路由字段与 SendPayload 一致）。
+type ScheduleRequest struct {
+	ConvID   string                  `json:"convId"`
+	ConvType models.ConversationType `json:"convType"`
+	To       string                  `json:"to,omitempty"`
+	GroupID  string                  `json:"groupId,omitempty"`
+	Type     string                  `json:"type"`
+	Payload  json.RawMessage         `json:"payload"`
+	SendAtMs int64                   `json:"sendAtMs"`
+}
+
+// ScheduleService 定时（稍后发送）消息：
+// - 创建/编辑/取消仅作用于 pending 状态，状态变更以数据库 CAS 保证与发送互斥
+// - Dispatch 由后台定时任务调用：Redis 分布式锁保证同一时刻只有一个实例扫描，逐条领取后以原发送者身份发送
+// - 幂等键固定为 sched:<id>，结果通过 scheduled_status 事件通知发送者；长时间停留在 sending 的记录退回 pending 重发（由幂等键去重）
+type ScheduleService struct {
+	Store *store.ScheduledStore
+	Msg   *MessageService
+	// 权限校验回调（与 WS 发送一致：单聊需好友、群聊需成员）
+	IsFriend func(ctx context.Context, a, b string) (bool, error)
+	IsMember func(ctx context.Context, groupID, userID string) (bool, error)
+}
+
+func NewScheduleService(st *store.ScheduledStore, msg *MessageService) *ScheduleService {
+	return &ScheduleService{Store: st, Msg: msg}
+}
+
+// authorize 校验发送者对目标会话的发送权限。
+func (s *ScheduleService) authorize(ctx context.Context, m *models.ScheduledMessage) error {
+	switch m.ConvType {
+	case models.ConversationTypeC2C:
+		if s.IsFriend != nil {
+			if ok, _ := s.IsFriend(ctx, m.UserID, m.ToUserID); !ok {
+				return ErrNotFriend
+			}
+		}
+	case models.ConversationTypeGroup:
+		if s.IsMember != nil {
+			if ok, _ := s.IsMember(ctx, m.GroupID, m.UserID); !ok {
+				return ErrNotGroupMember
+			}
+		}
+	}
+	return nil
+}
+
+// validSendAt 发送时间须晚于当前且不超过最远预约时间。
+func validSendAt(sendAt, now time.Time) bool {
+	return sendAt.After(now) && sendAt.Sub(now) <= scheduleMaxAhead
+}
+
+// Create 创建定时消息。
+func (s *ScheduleService) Create(ctx context.Context, userID string, req *ScheduleRequest) (*models.ScheduledMessage, error) {
+	if req.ConvID == "" || req.Type == "" || len(req.Payload) == 0 || !json.Valid(req.Payload) ||
+		(req.ConvType == models.ConversationTypeC2C && req.To == "") || (req.ConvType == models.ConversationTypeGroup && req.GroupID == "") ||
+		(req.ConvType != models.ConversationTypeC2C && req.ConvType != models.ConversationTypeGroup) {
+		return nil, ErrInvalidPayload
+	}
+	if err := s.Msg.Payloads.Validate(ctx, PayloadContext{UserID: userID}, req.Type, req.Payload); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sendAt := time.UnixMilli(req.SendAtMs)
+	if !validSendAt(sendAt, now) {
+		return nil, ErrInvalidSendAt
+	}
+	n, err := s.Store.CountPending(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= scheduleMaxPending {
+		return nil, ErrScheduleLimit
+	}
+	m := &models.ScheduledMessage{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		ConvID:    req.ConvID,
+		ConvType:  req.ConvType,
+		ToUserID:  req.To,
+		GroupID:   req.GroupID,
+		Type:      req.Type,
+		Payload:   req.Payload,
+		SendAt:    sendAt,
+		Status:    models.ScheduledStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.authorize(ctx, m); err != nil {
+		return nil, err
+	}
+	if err := s.Store.Create(ctx, m); err != nil {
+		log.Printf("Schedule.Create error: user=%s convId=%s err=%v", userID, req.ConvID, err)
+		return nil, err
+	}
+	log.Printf("Schedule.Create ok: user=%s id=%s convId=%s sendAt=%s", userID, m.ID, m.ConvID, sendAt.Format(time.RFC3339))
+	return m, nil
+}
+
+// get 读取用户的定时消息，不存在映射为 ErrScheduleNotFound。
+func (s *ScheduleService) get(ctx context.Context, userID, id string) (*models.ScheduledMessage, error) {
+	m, err := s.Store.Get(ctx, userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrScheduleNotFound
+	}
+	return m, err
+}
+
+// Update 编辑待发送的定时消息；payload 为空保留原内容，sendAtMs<=0 保留原时间。
+func (s *ScheduleService) Update(ctx context.Context, userID, id string, payload json.RawMessage, sendAtMs int64) (*models.ScheduledMessage, error) {
+	m, err := s.get(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != models.ScheduledStatusPending {
+		return nil, ErrScheduleNotPending
+	}
+	if len(payload) > 0 {
+		if !json.Valid(payload) {
+			return nil, ErrInvalidPayload
+		}
+		if err := s.Msg.Payloads.Validate(ctx, PayloadContext{UserID: userID}, m.Type, payload); err != nil {
+			return nil, err
+		}
+		m.Payload = payload
+	}
+	if sendAtMs > 0 {
+		m.SendAt = time.UnixMilli(sendAtMs)
+		if !validSendAt(m.SendAt, time.Now()) {
+			return nil, ErrInvalidSendAt
+		}
+	}
+	ok, err := s.Store.UpdatePending(ctx, userID, id, m.Payload, m.SendAt)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrScheduleNotPending
+	}
+	m.UpdatedAt = time.Now()
+	return m, nil
+}
+
+// Cancel 取消待发送的定时消息。
+func (s *ScheduleService) Cancel(ctx context.Context, userID, id string) error {
+	ok, err := s.Store.Cancel(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if _, err := s.get(ctx, userID, id); err != nil {
+			return err
+		}
+		return ErrScheduleNotPending
+	}
+	log.Printf("Schedule.Cancel ok: user=%s id=%s", userID, id)
+	return nil
+}
+
+// List 用户定时消息列表；status 为空时默认仅返回 pending，"all" 返回全部。
+func (s *ScheduleService) List(ctx context.Context, userID, status string, limit int) ([]*models.ScheduledMessage, error) {
+	switch status {
+	case "":
+		status = models.ScheduledStatusPending
+	case "all":
+		status = ""
+	}
+	return s.Store.ListByUser(ctx, userID, status, limit)
+}
+
+// Dispatch 发送到期的定时消息（多实例下仅持有调度锁的实例执行）。
+func (s *ScheduleService) Dispatch(ctx context.Context, now time.Time) error {
+	token, ok, err := cache.TryLock(ctx, scheduleDispatchLock, scheduleDispatchLockTTL)
+	if err != nil || !ok {
+		return err
+	}
+	defer func() { _ = cache.Unlock(context.Background(), scheduleDispatchLock, token) }()
+
+	// 中途退出的发送退回 pending 重新领取：幂等键 sched:<id> 保证已发出的消息不会重复
+	if n, err := s.Store.RequeueStale(ctx, now.Add(-scheduleStaleAfter)); err == nil && n > 0 {
+		log.Printf("Schedule.Dispatch stale sending requeued: n=%d", n)
+	}
+	due, err := s.Store.ListDue(ctx, now, scheduleDispatchBatch)
+	if err != nil {
+		log.Printf("Schedule.Dispatch list error: err=%v", err)
+		return err
+	}
+	for _, m := range due {
+		claimed, err := s.Store.Claim(ctx, m.ID, now)
+		if err != nil || !claimed {
+			continue
+		}
+		s.deliver(ctx, m)
+	}
+	return nil
+}
+
+// deliver 以原发送者身份发送一条已领取的定时消息，并记录结果。
+func (s *ScheduleService) deliver(ctx context.Context, m *models.ScheduledMessage) {
+	err := s.authorize(ctx, m)
+	var d *Deliver
+	if err == nil {
+		d, err = s.Msg.Send(ctx, &SendRequest{ConvID: m.ConvID, ConvType: m.ConvType, ClientID: "sched:" + m.ID, From: m.UserID, To: m.ToUserID, GroupID: m.GroupID, Type: m.Type, Payload: m.Payload})
+	}
+	if err != nil {
+		code, _ := MessageErrorCode(err)
+		m.Status, m.Error = models.ScheduledStatusFailed, code
+		log.Printf("Schedule.Send failed: id=%s user=%s convId=%s err=%v", m.ID, m.UserID, m.ConvID, err)
+	} else {
+		m.Status, m.ServerMsgID = models.ScheduledStatusSent, d.ServerMsgID
+		log.Printf("Schedule.Send ok: id=%s user=%s convId=%s serverMsgId=%s", m.ID, m.UserID, m.ConvID, d.ServerMsgID)
+	}
+	if err := s.Store.Finish(ctx, m.ID, m.Status, m.ServerMsgID, m.Error); err != nil {
+		log.Printf("Schedule.Finish error: id=%s err=%v", m.ID, err)
+	}
+	m.UpdatedAt = time.Now()
+	b := NewEnvelope("scheduled_status", m)
+	_ = cache.DeliverToUser(ctx, m.UserID, b)
+}
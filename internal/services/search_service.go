@@ -0,0 +1,338 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"go-im/internal/models"
+	"go-im/internal/store"
+)
+
+// 检索参数限制
+const (
+	searchMaxTermsPerMessage = 512 // 单条消息最多索引的词项数
+	searchMaxQueryTerms      = 16  // 单次查询最多使用的词项数
+	searchMaxWordRunes       = 32  // 拉丁词最大长度（超出截断）
+	searchMaxConvs           = 200 // 参与检索的最近会话数
+	searchSnippetRunes       = 20  // 摘要中命中词前后保留的字符数
+)
+
+// SearchService 消息全文检索：
+// - 写入：Send/Edit 后对文本（TextPayload.text、FilePayload.name、流式最终文本）分词并写入倒排索引
+// - 分词：CJK 连续片段产出单字与二元组，拉丁字母/数字按词小写
+// - 查询：词项 AND 匹配 → 按用户会话收敛 → 回表过滤撤回/过期/无权限/删除水位之前的消息
+type SearchService struct {
+	Index      store.SearchIndex
+	Store      store.MessageStoreInterface
+	ConvStore  *store.ConversationStore
+	GroupStore *store.GroupStore
+}
+
+func NewSearchService(idx store.SearchIndex, ms store.MessageStoreInterface) *SearchService {
+	return &SearchService{Index: idx, Store: ms}
+}
+
+// SearchParams 检索条件；ConvID/From/Start/End 为可选过滤。
+type SearchParams struct {
+	UserID string
+	Query  string
+	ConvID string
+	From   string
+	Start  time.Time
+	End    time.Time
+	Limit  int
+	Offset int
+}
+
+// SearchHit 检索结果：命中消息与高亮摘要。
+type SearchHit struct {
+	Message *models.Message `json:"message"`
+	Snippet string          `json:"snippet"`
+}
+
+// IndexMessage 为一条已入库消息建立索引（失败仅记录日志，不影响发送）。
+func (s *SearchService) IndexMessage(ctx context.Context, m *models.Message) {
+	if s == nil || s.Index == nil || m.BurnAfterRead {
+		return
+	}
+	terms := TokenizeForIndex(searchableText(m))
+	if len(terms) == 0 {
+		return
+	}
+	p := &store.SearchPosting{ConvID: m.ConvID, ServerMsgID: m.ServerMsgID, Seq: m.Seq, FromUserID: m.FromUserID, Timestamp: m.Timestamp}
+	if err := s.Index.Index(ctx, p, terms); err != nil {
+		log.Printf("Search.Index error: convId=%s serverMsgId=%s err=%v", m.ConvID, m.ServerMsgID, err)
+	}
+}
+
+// ReindexMessage 消息内容变化（编辑）后重建索引。
+func (s *SearchService) ReindexMessage(ctx context.Context, m *models.Message) {
+	if s == nil || s.Index == nil {
+		return
+	}
+	if err := s.Index.Remove(ctx, m.ConvID, m.ServerMsgID); err != nil {
+		log.Printf("Search.Remove error: convId=%s serverMsgId=%s err=%v", m.ConvID, m.ServerMsgID, err)
+		return
+	}
+	s.IndexMessage(ctx, m)
+}
+
+// RemoveMessage 删除消息的索引（消息被物理清理时调用）。
+func (s *SearchService) RemoveMessage(ctx context.Context, convID, serverMsgID string) {
+	if s == nil || s.Index == nil {
+		return
+	}
+	if err := s.Index.Remove(ctx, convID, serverMsgID); err != nil {
+		log.Printf("Search.Remove error: convId=%s serverMsgId=%s err=%v", convID, serverMsgID, err)
+	}
+}
+
+// Search 在用户可见的会话中检索消息，返回 (结果, 是否可能还有更多)。
+func (s *SearchService) Search(ctx context.Context, p *SearchParams) ([]*SearchHit, bool, error) {
+	terms := TokenizeForQuery(p.Query)
+	if len(terms) == 0 {
+		return nil, false, ErrInvalidPayload
+	}
+	if p.Limit <= 0 || p.Limit > 50 {
+		p.Limit = 20
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+	convIDs, err := s.userConvIDs(ctx, p.UserID, p.ConvID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(convIDs) == 0 {
+		return nil, false, nil
+	}
+	postings, err := s.Index.Search(ctx, &store.SearchQuery{Terms: terms, ConvIDs: convIDs, From: p.From, Start: p.Start, End: p.End, Offset: p.Offset, Limit: p.Limit})
+	if err != nil {
+		return nil, false, err
+	}
+	watermarks, err := s.Store.DeleteWatermarks(ctx, p.UserID, convIDs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	allowed := make(map[string]bool)
+	hits := make([]*SearchHit, 0, len(postings))
+	for _, ps := range postings {
+		if wm, ok := watermarks[ps.ConvID]; ok && !ps.Timestamp.After(wm) {
+			continue
+		}
+		m, err := s.Store.GetByID(ctx, ps.ConvID, ps.ServerMsgID)
+		if err != nil || m.Recalled || (m.ExpireAt != nil && !m.ExpireAt.After(now)) {
+			continue
+		}
+		ok, seen := allowed[m.ConvID]
+		if !seen {
+			ok = isParticipant(ctx, s.GroupStore, p.UserID, m)
+			allowed[m.ConvID] = ok
+		}
+		if !ok {
+			continue
+		}
+		hits = append(hits, &SearchHit{Message: m, Snippet: snippet(searchableText(m), terms)})
+	}
+	return hits, len(postings) == p.Limit, nil
+}
+
+// userConvIDs 用户最近会话列表；指定 convID 时须在列表中。
+func (s *SearchService) userConvIDs(ctx context.Context, userID, convID string) ([]string, error) {
+	if s.ConvStore == nil {
+		if convID == "" {
+			return nil, nil
+		}
+		return []string{convID}, nil
+	}
+	rows, err := s.ConvStore.ListByUser(ctx, userID, searchMaxConvs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		var convType, peerID, groupID, draft any
+		var pinned, muted int
+		var updatedAt time.Time
+		if err := rows.Scan(&id, &convType, &peerID, &groupID, &pinned, &muted, &draft, &updatedAt); err != nil {
+			continue
+		}
+		if convID != "" && id != convID {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if convID != "" && len(ids) == 0 {
+		return nil, ErrNotParticipant
+	}
+	return ids, rows.Err()
+}
+
+// searchableText 提取可检索文本：文本消息正文、文件名、流式消息最终文本。
+func searchableText(m *models.Message) string {
+	switch m.Type {
+	case models.MessageTypeText:
+		var p models.TextPayload
+		_ = json.Unmarshal(m.Payload, &p)
+		return p.Text
+	case models.MessageTypeFile:
+		var p models.FilePayload
+		_ = json.Unmarshal(m.Payload, &p)
+		return p.Name
+	case models.MessageTypeStream:
+		if m.StreamStatus != models.StreamStatusEnd {
+			return ""
+		}
+		var p models.StreamPayload
+		_ = json.Unmarshal(m.Payload, &p)
+		return p.Text
+	}
+	return ""
+}
+
+// isCJK 中日韩文字按字切分（无空格分词）。
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// splitSegments 将文本切分为拉丁词（已小写）与 CJK 连续片段。
+func splitSegments(text string, emit func(seg []rune, cjk bool)) {
+	var word, cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			if len(word) > searchMaxWordRunes {
+				word = word[:searchMaxWordRunes]
+			}
+			emit(word, false)
+			word = nil
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) > 0 {
+			emit(cjk, true)
+			cjk = nil
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+}
+
+// TokenizeForIndex 索引分词：CJK 片段产出单字与相邻二元组，拉丁词整体入索引（去重）。
+func TokenizeForIndex(text string) []string {
+	seen := make(map[string]struct{})
+	var terms []string
+	add := func(t string) {
+		if _, ok := seen[t]; ok || len(terms) >= searchMaxTermsPerMessage {
+			return
+		}
+		seen[t] = struct{}{}
+		terms = append(terms, t)
+	}
+	splitSegments(text, func(seg []rune, cjk bool) {
+		if !cjk {
+			add(string(seg))
+			return
+		}
+		for i := range seg {
+			add(string(seg[i]))
+			if i+1 < len(seg) {
+				add(string(seg[i : i+2]))
+			}
+		}
+	})
+	return terms
+}
+
+// TokenizeForQuery 查询分词：CJK 片段长度>=2 时仅用二元组（更精确），单字片段用单字。
+func TokenizeForQuery(query string) []string {
+	seen := make(map[string]struct{})
+	var terms []string
+	add := func(t string) {
+		if _, ok := seen[t]; ok || len(terms) >= searchMaxQueryTerms {
+			return
+		}
+		seen[t] = struct{}{}
+		terms = append(terms, t)
+	}
+	splitSegments(query, func(seg []rune, cjk bool) {
+		if !cjk || len(seg) == 1 {
+			add(string(seg))
+			return
+		}
+		for i := 0; i+1 < len(seg); i++ {
+			add(string(seg[i : i+2]))
+		}
+	})
+	return terms
+}
+
+// snippet 截取首个命中词附近的文本作为摘要。
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+	pos := -1
+	for _, t := range terms {
+		if i := indexRunes(lower, []rune(t)); i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	start := pos - searchSnippetRunes
+	if start < 0 {
+		start = 0
+	}
+	end := pos + searchSnippetRunes*2
+	if end > len(runes) {
+		end = len(runes)
+	}
+	out := string(runes[start:end])
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(runes) {
+		out += "…"
+	}
+	return out
+}
+
+func indexRunes(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		match := true
+		for j := range sub {
+			if s[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/metrics"
+	"go-im/internal/models"
+	"go-im/internal/store"
+)
+
+// SendPermissionHook before-persist：单聊须为好友、群聊须为成员（回调为空时不校验）。
+func SendPermissionHook(isFriend func(ctx context.Context, a, b string) (bool, error), isMember func(ctx context.Context, groupID, userID string) (bool, error)) SendHook {
+	return func(ctx context.Context, sc *SendContext) error {
+		if !sc.Submitted() {
+			return nil
+		}
+		req := sc.Req
+		switch req.ConvType {
+		case models.ConversationTypeC2C:
+			if isFriend != nil {
+				ok, err := isFriend(ctx, req.From, req.To)
+				if err != nil {
+					log.Printf("Msg.Permission isFriend error: user=%s to=%s err=%v", req.From, req.To, err)
+				}
+				if !ok {
+					return ErrNotFriend
+				}
+			}
+		case models.ConversationTypeGroup:
+			if isMember != nil {
+				ok, err := isMember(ctx, req.GroupID, req.From)
+				if err != nil {
+					log.Printf("Msg.Permission isMember error: user=%s group=%s err=%v", req.From, req.GroupID, err)
+				}
+				if !ok {
+					return ErrNotGroupMember
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// GroupMuteHook before-persist：全员禁言或成员禁言期间拒绝发送（入库前检查，被拒消息不占用 seq）。
+func GroupMuteHook(groups *store.GroupStore) SendHook {
+	return func(ctx context.Context, sc *SendContext) error {
+		if groups == nil || sc.Req.ConvType != models.ConversationTypeGroup || !sc.Submitted() {
+			return nil
+		}
+		muted, err := groups.IsMuted(ctx, sc.Req.GroupID, sc.Req.From)
+		if err == nil && muted {
+			return ErrGroupMuted
+		}
+		return nil
+	}
+}
+
+// MentionHook before-deliver：解析群文本载荷中的 mentions，向被提及的用户推送 mention 提醒。
+func MentionHook() SendHook {
+	return func(ctx context.Context, sc *SendContext) error {
+		msg := sc.Msg
+		if msg.ConvType != models.ConversationTypeGroup || !sc.Submitted() {
+			return nil
+		}
+		var body struct {
+			Mentions []string `json:"mentions"`
+		}
+		if json.Unmarshal(msg.Payload, &body) != nil || len(body.Mentions) == 0 {
+			return nil
+		}
+		tip := NewEnvelope("mention", map[string]any{"groupId": msg.GroupID, "convId": msg.ConvID, "from": msg.FromUserID, "seq": msg.Seq})
+		if err := cache.DeliverToUsers(ctx, body.Mentions, tip); err != nil {
+			log.Printf("Msg.Mention publish error: to=%v err=%v", body.Mentions, err)
+		}
+		return nil
+	}
+}
+
+// SendMetricsHook before-deliver：记录发送耗时与按会话/消息类型的发送计数（流式 chunk 不计）。
+func SendMetricsHook() SendHook {
+	return func(ctx context.Context, sc *SendContext) error {
+		if sc.Req.IsStreaming && sc.Req.StreamStatus == models.StreamStatusChunk {
+			return nil
+		}
+		metrics.MessageSendLatency.Observe(float64(time.Since(sc.Started).Milliseconds()))
+		metrics.MessagesSentTotal.WithLabelValues(string(sc.Msg.ConvType), sc.Msg.Type).Inc()
+		return nil
+	}
+}
+
+// SendWebhook 消息发送 Webhook：before-deliver 阶段异步 POST {event, ts, data}（data 同下行消息）。
+// - 配置 Secret 时附带 X-IM-Signature: sha256=<hex(HMAC-SHA256(body))>
+// - 流式消息仅在 end 时通知完整内容；投递失败只记录日志，不重试
+type SendWebhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewSendWebhook(url, secret string, timeout time.Duration) *SendWebhook {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &SendWebhook{URL: url, Secret: secret, Client: &http.Client{Timeout: timeout}}
+}
+
+// Hook 作为 before-deliver 拦截器注册。
+func (w *SendWebhook) Hook(ctx context.Context, sc *SendContext) error {
+	if sc.Req.IsStreaming && sc.Req.StreamStatus != models.StreamStatusEnd {
+		return nil
+	}
+	body, err := json.Marshal(map[string]any{"event": "message.sent", "ts": time.Now().UnixMilli(), "data": sc.Deliver})
+	if err != nil {
+		return err
+	}
+	go w.post(body, sc.Msg.ServerMsgID)
+	return nil
+}
+
+func (w *SendWebhook) post(body []byte, serverMsgID string) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Msg.Webhook request error: serverMsgId=%s err=%v", serverMsgID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set("X-IM-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.Client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("Msg.Webhook post error: serverMsgId=%s err=%v", serverMsgID, err)
+	}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go-im/internal/models"
+)
+
+// SendStage 发送拦截阶段
+type SendStage int
+
+const (
+	// StageBeforePersist 分配 seq 与入库前：权限、禁言、内容审核等；返回错误即拒绝发送，可改写 Req
+	StageBeforePersist SendStage = iota
+	// StageAfterPersist 入库后（仅入库的消息）：审核队列等；错误仅记录日志
+	StageAfterPersist
+	// StageBeforeDeliver 分发前：提及提醒、指标、Webhook 等；错误仅记录日志
+	StageBeforeDeliver
+
+	sendStageCount
+)
+
+func (st SendStage) String() string {
+	switch st {
+	case StageBeforePersist:
+		return "before_persist"
+	case StageAfterPersist:
+		return "after_persist"
+	case StageBeforeDeliver:
+		return "before_deliver"
+	}
+	return "unknown"
+}
+
+// SendContext 一次发送在拦截器之间传递的状态：
+// - Req 为发送请求（before-persist 阶段可修改载荷等字段）
+// - Msg 在 after-persist 起可用（流式 chunk 不入库，仅在 before-deliver 可用）；Deliver 在 before-deliver 可用
+// - Values 供同一拦截器跨阶段或不同拦截器之间共享数据
+type SendContext struct {
+	Req     *SendRequest
+	Msg     *models.Message
+	Deliver *Deliver
+	Started time.Time
+	Values  map[string]any
+}
+
+// Submitted 是否为客户端提交的内容（非流式消息或流式 start）；流式 chunk/end 由服务端组装。
+func (sc *SendContext) Submitted() bool {
+	return !sc.Req.IsStreaming || sc.Req.StreamStatus == models.StreamStatusStart
+}
+
+// Set 保存拦截器间共享的数据。
+func (sc *SendContext) Set(key string, v any) {
+	if sc.Values == nil {
+		sc.Values = make(map[string]any)
+	}
+	sc.Values[key] = v
+}
+
+// Get 读取拦截器间共享的数据。
+func (sc *SendContext) Get(key string) any { return sc.Values[key] }
+
+// SendHook 发送拦截器。
+type SendHook func(ctx context.Context, sc *SendContext) error
+
+type sendInterceptor struct {
+	name string
+	hook SendHook
+}
+
+// SendPipeline MessageService.Send 的拦截器链：
+// - 各阶段的拦截器按注册顺序依次执行
+// - before-persist 中任一拦截器返回错误即中止发送并将错误返回给调用方（WS/HTTP 按 MessageErrorCode 映射）
+// - 其余阶段消息已入库，错误仅记录日志，不影响后续拦截器与分发
+type SendPipeline struct {
+	mu     sync.RWMutex
+	stages [sendStageCount][]sendInterceptor
+}
+
+func NewSendPipeline() *SendPipeline { return &SendPipeline{} }
+
+// Use 在指定阶段末尾注册拦截器（通常在启动时完成注册）。
+func (p *SendPipeline) Use(stage SendStage, name string, hook SendHook) {
+	if stage < 0 || stage >= sendStageCount || hook == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages[stage] = append(p.stages[stage], sendInterceptor{name: name, hook: hook})
+}
+
+// Names 返回指定阶段已注册的拦截器名称（按执行顺序）。
+func (p *SendPipeline) Names(stage SendStage) []string {
+	if p == nil || stage < 0 || stage >= sendStageCount {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, 0, len(p.stages[stage]))
+	for _, ic := range p.stages[stage] {
+		names = append(names, ic.name)
+	}
+	return names
+}
+
+// run 执行一个阶段；before-persist 遇错即返回，其余阶段记录日志后继续。
+func (p *SendPipeline) run(ctx context.Context, stage SendStage, sc *SendContext) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	chain := p.stages[stage]
+	p.mu.RUnlock()
+	for _, ic := range chain {
+		if err := ic.hook(ctx, sc); err != nil {
+			if stage == StageBeforePersist {
+				log.Printf("Msg.Pipeline %s rejected by %s: convId=%s from=%s err=%v", stage, ic.name, sc.Req.ConvID, sc.Req.From, err)
+				return err
+			}
+			log.Printf("Msg.Pipeline %s %s error: convId=%s from=%s err=%v", stage, ic.name, sc.Req.ConvID, sc.Req.From, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/store"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// 链接预览抓取参数
+const (
+	unfurlMaxLinks      = 3                // 单条消息最多预览的链接数
+	unfurlMaxBytes      = 512 << 10        // 读取的 HTML 上限（仅解析 <head>）
+	unfurlMaxRedirects  = 3                // 最多跟随的重定向次数
+	unfurlCacheTTL      = 24 * time.Hour   // 预览结果缓存时间
+	unfurlNegativeTTL   = 10 * time.Minute // 抓取失败的缓存时间（避免重复抓取）
+	unfurlJobTimeout    = 20 * time.Second // 单条消息的全部抓取上限
+	unfurlMaxTitleRunes = 200
+	unfurlMaxDescRunes  = 500
+	unfurlMaxMediaBytes = 1 << 20 // 转存的预览图/图标大小上限
+	unfurlMaxJobs       = 32      // 同时进行的预览任务上限（超出时跳过该消息的预览）
+	unfurlUserAgent     = "Mozilla/5.0 (compatible; go-im-unfurl/1.0)"
+)
+
+var (
+	errUnfurlBlocked = errors.New("unfurl: destination not allowed")
+	unfurlURLPattern = regexp.MustCompile(`https?://[^\s<>"'，。！？、；：（）【】《》]+`)
+	// 允许转存的图片类型（不含 SVG，避免脚本随静态文件下发）
+	unfurlMediaExts = map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp", "image/x-icon": ".ico", "image/vnd.microsoft.icon": ".ico"}
+	// 非公网地址段（IsPrivate/IsLoopback 等之外的保留段）
+	unfurlBlockedNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "64:ff9b::/96", "2001:db8::/32")
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func unfurlCacheKey(u string) string {
+	sum := sha1.Sum([]byte(u))
+	return "im:unfurl:" + hex.EncodeToString(sum[:])
+}
+
+// UnfurlService 服务端链接预览：客户端无需自行访问链接（避免暴露用户 IP）。
+// - 发送/编辑文本消息后异步抓取消息中的链接，解析 OpenGraph/Twitter Card 元数据与 favicon
+// - 仅允许 http(s) 的 80/443 端口；连接时校验实际解析出的 IP，拒绝内网/回环/保留地址（含重定向与 DNS 重绑定）
+// - 预览图与图标由服务端抓取后转存到 MediaDir，预览中只出现本服务地址（未配置 MediaDir 时不返回图片）
+// - 同时进行的任务数不超过 unfurlMaxJobs；结果缓存在 Redis，回填到消息后以 message_updated 事件推送给会话
+type UnfurlService struct {
+	Store        store.MessageStoreInterface
+	Groups       *store.GroupStore // 群消息的 message_updated 投递给群成员
+	Client       *http.Client
+	MediaDir     string // 预览图转存目录
+	MediaBaseURL string // MediaDir 对外访问的基础 URL
+
+	jobs chan struct{}
+}
+
+func NewUnfurlService(ms store.MessageStoreInterface, timeout time.Duration) *UnfurlService {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout, Control: unfurlDialControl}
+	transport := &http.Transport{
+		Proxy:                  nil, // 不走代理，确保目标地址校验生效
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    timeout,
+		ResponseHeaderTimeout:  timeout,
+		MaxResponseHeaderBytes: 32 << 10,
+		MaxIdleConns:           32,
+		IdleConnTimeout:        90 * time.Second,
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > unfurlMaxRedirects {
+				return errors.New("unfurl: too many redirects")
+			}
+			return checkUnfurlURL(req.URL)
+		},
+	}
+	return &UnfurlService{Store: ms, Client: client, jobs: make(chan struct{}, unfurlMaxJobs)}
+}
+
+// unfurlDialControl 在建立连接前校验解析后的目标地址。
+func unfurlDialControl(network, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if port != "80" && port != "443" {
+		return errUnfurlBlocked
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errUnfurlBlocked
+	}
+	return nil
+}
+
+// isPublicIP 判断是否为可访问的公网地址。
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range unfurlBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUnfurlURL 校验链接本身：仅 http(s)、无账号信息、默认端口；IP 字面量直接校验。
+func checkUnfurlURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Hostname() == "" {
+		return errUnfurlBlocked
+	}
+	if p := u.Port(); p != "" && p != "80" && p != "443" {
+		return errUnfurlBlocked
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) {
+		return errUnfurlBlocked
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return errUnfurlBlocked
+	}
+	return nil
+}
+
+// extractLinks 提取文本中的链接（去重，去掉结尾标点，最多 unfurlMaxLinks 个）。
+func extractLinks(text string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, raw := range unfurlURLPattern.FindAllString(text, -1) {
+		raw = strings.TrimRight(raw, ".,;:!?)]}")
+		if seen[raw] {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || checkUnfurlURL(u) != nil {
+			continue
+		}
+		seen[raw] = true
+		links = append(links, raw)
+		if len(links) >= unfurlMaxLinks {
+			break
+		}
+	}
+	return links
+}
+
+// Attach 异步为文本消息生成链接预览并回填（s 为空或非文本消息时忽略）。
+// 消息已有预览但新内容不含链接时（编辑后）清空预览。
+func (s *UnfurlService) Attach(msg *models.Message) {
+	if s == nil || msg.Type != models.MessageTypeText {
+		return
+	}
+	var p models.TextPayload
+	_ = json.Unmarshal(msg.Payload, &p)
+	links := extractLinks(p.Text)
+	if len(links) == 0 && len(msg.Previews) == 0 {
+		return
+	}
+	select {
+	case s.jobs <- struct{}{}:
+	default:
+		log.Printf("Unfurl.Attach skip (busy): convId=%s serverMsgId=%s", msg.ConvID, msg.ServerMsgID)
+		return
+	}
+	m := *msg
+	go func() {
+		defer func() { <-s.jobs }()
+		ctx, cancel := context.WithTimeout(context.Background(), unfurlJobTimeout)
+		defer cancel()
+		previews := make([]*models.LinkPreview, 0, len(links))
+		for _, link := range links {
+			if pv := s.Preview(ctx, link); pv != nil {
+				previews = append(previews, pv)
+			}
+		}
+		if len(previews) == 0 && len(m.Previews) == 0 {
+			return
+		}
+		ok, err := s.Store.SetPreviews(ctx, m.ConvID, m.ServerMsgID, m.Version, previews)
+		if err != nil || !ok {
+			log.Printf("Unfurl.SetPreviews skip: convId=%s serverMsgId=%s version=%d ok=%v err=%v", m.ConvID, m.ServerMsgID, m.Version, ok, err)
+			return
+		}
+		b := NewEnvelope("message_updated", map[string]any{
+			"convId":      m.ConvID,
+			"serverMsgId": m.ServerMsgID,
+			"seq":         m.Seq,
+			"version":     m.Version,
+			"previews":    previews,
+		})
+		publishToConv(ctx, s.Groups, &m, b)
+	}()
+}
+
+// Preview 获取单个链接的预览（优先读缓存；失败返回 nil 并短期缓存失败结果）。
+func (s *UnfurlService) Preview(ctx context.Context, link string) *models.LinkPreview {
+	key := unfurlCacheKey(link)
+	if raw, err := cache.Client().Get(ctx, key).Bytes(); err == nil {
+		var pv models.LinkPreview
+		if json.Unmarshal(raw, &pv) == nil && pv.URL != "" {
+			return &pv
+		}
+		return nil
+	}
+	pv, err := s.fetch(ctx, link)
+	if err != nil {
+		log.Printf("Unfurl.Fetch error: url=%s err=%v", link, err)
+		cache.Client().Set(ctx, key, "{}", unfurlNegativeTTL)
+		return nil
+	}
+	b, _ := json.Marshal(pv)
+	cache.Client().Set(ctx, key, b, unfurlCacheTTL)
+	return pv
+}
+
+// fetch 抓取链接并解析 <head> 中的元数据；图片链接直接作为预览图。预览图与图标经 fetchMedia 转存，不返回远端地址。
+func (s *UnfurlService) fetch(ctx context.Context, link string) (*models.LinkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUnfurlURL(req.URL); err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,image/*;q=0.8")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unfurl: status %d", resp.StatusCode)
+	}
+	final := resp.Request.URL
+	ct := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	pv := &models.LinkPreview{URL: link, SiteName: final.Hostname()}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if pv.Image = s.storeMedia(final.String(), resp); pv.Image == "" {
+			return nil, errors.New("unfurl: image not stored")
+		}
+		return pv, nil
+	case mediaType != "text/html" && mediaType != "application/xhtml+xml":
+		return nil, fmt.Errorf("unfurl: unsupported content type %q", mediaType)
+	}
+	body, err := charset.NewReader(io.LimitReader(resp.Body, unfurlMaxBytes), ct)
+	if err != nil {
+		return nil, err
+	}
+	parseHead(body, final, pv)
+	if pv.Title == "" && pv.Description == "" && pv.Image == "" {
+		return nil, errors.New("unfurl: no metadata")
+	}
+	pv.Image = s.fetchMedia(ctx, pv.Image)
+	// 页面未声明图标时尝试站点根目录的 favicon.ico
+	pv.Favicon = s.fetchMedia(ctx, firstNonEmpty(pv.Favicon, final.Scheme+"://"+final.Host+"/favicon.ico"))
+	return pv, nil
+}
+
+// fetchMedia 经同一受限客户端抓取图片并转存，返回本服务地址；未配置 MediaDir 或抓取失败时返回空串。
+func (s *UnfurlService) fetchMedia(ctx context.Context, src string) string {
+	if s.MediaDir == "" || src == "" {
+		return ""
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil || checkUnfurlURL(req.URL) != nil {
+		return ""
+	}
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", "image/*")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		log.Printf("Unfurl.FetchMedia error: url=%s err=%v", src, err)
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return s.storeMedia(src, resp)
+}
+
+// storeMedia 校验图片类型与大小后写入 MediaDir（文件名取源地址摘要，重复抓取覆盖同一文件）。
+func (s *UnfurlService) storeMedia(src string, resp *http.Response) string {
+	if s.MediaDir == "" || resp.ContentLength > unfurlMaxMediaBytes {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ext, ok := unfurlMediaExts[mediaType]
+	if !ok {
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, unfurlMaxMediaBytes+1))
+	if err != nil || len(data) > unfurlMaxMediaBytes || !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return ""
+	}
+	sum := sha1.Sum([]byte(src))
+	name := hex.EncodeToString(sum[:]) + ext
+	if err := os.MkdirAll(s.MediaDir, 0o755); err != nil {
+		log.Printf("Unfurl.StoreMedia error: dir=%s err=%v", s.MediaDir, err)
+		return ""
+	}
+	tmp := filepath.Join(s.MediaDir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Unfurl.StoreMedia error: file=%s err=%v", tmp, err)
+		return ""
+	}
+	if err := os.Rename(tmp, filepath.Join(s.MediaDir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return ""
+	}
+	return strings.TrimRight(s.MediaBaseURL, "/") + "/" + name
+}
+
+// parseHead 解析 <head>：og:* 优先，其次 twitter:*，最后 <title>/description。
+func parseHead(r io.Reader, base *url.URL, pv *models.LinkPreview) {
+	meta := make(map[string]string)
+	var title, icon string
+	z := html.NewTokenizer(r)
+	inTitle := false
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tn, hasAttr := z.TagName()
+			switch string(tn) {
+			case "body":
+				break loop
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta", "link":
+				attrs := make(map[string]string)
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					attrs[string(k)] = string(v)
+				}
+				if string(tn) == "meta" {
+					name := strings.ToLower(attrs["property"])
+					if name == "" {
+						name = strings.ToLower(attrs["name"])
+					}
+					if name != "" && attrs["content"] != "" {
+						if _, ok := meta[name]; !ok {
+							meta[name] = strings.TrimSpace(attrs["content"])
+						}
+					}
+				} else if rel := strings.ToLower(attrs["rel"]); icon == "" && attrs["href"] != "" &&
+					(rel == "icon" || rel == "shortcut icon" || rel == "apple-touch-icon") {
+					icon = attrs["href"]
+				}
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			tn, _ := z.TagName()
+			switch string(tn) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		}
+	}
+	pick := func(keys ...string) string {
+		for _, k := range keys {
+			if v := meta[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	pv.Title = truncateRunes(firstNonEmpty(pick("og:title", "twitter:title"), title), unfurlMaxTitleRunes)
+	pv.Description = truncateRunes(pick("og:description", "twitter:description", "description"), unfurlMaxDescRunes)
+	if site := pick("og:site_name"); site != "" {
+		pv.SiteName = truncateRunes(site, unfurlMaxTitleRunes)
+	}
+	pv.Image = resolveHTTPURL(base, pick("og:image:secure_url", "og:image", "twitter:image", "twitter:image:src"))
+	if icon = resolveHTTPURL(base, icon); icon != "" {
+		pv.Favicon = icon
+	}
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func truncateRunes(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max]) + "…"
+}
+
+// resolveHTTPURL 将相对地址解析为绝对 http(s) 地址，其它协议（data:/javascript: 等）丢弃。
+func resolveHTTPURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
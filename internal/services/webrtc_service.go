@@ -206,15 +206,11 @@ func (s *WebRTCService) ForwardSignaling(ctx context.Context, msg *models.Signal
 		return err
 	}
 
-	// 通过 Redis Pub/Sub 转发信令
-	deliverMsg := map[string]interface{}{
-		"action": "webrtc_signaling",
-		"data":   msg,
-	}
-	deliverData, _ := json.Marshal(deliverMsg)
+	// 经投递路由转发信令
+	deliverData := NewEnvelope("webrtc_signaling", msg)
 
 	// 发送给目标用户
-	return cache.Client().Publish(ctx, cache.DeliverChannel(msg.To), deliverData).Err()
+	return cache.DeliverToUser(ctx, msg.To, deliverData)
 }
 
 // 通话超时检查（定期任务）
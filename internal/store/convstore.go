@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"go-im/internal/cache"
+	"go-im/internal/models"
 )
 
 // 会话存储
@@ -15,24 +16,30 @@ type ConversationStore struct{ DB *sql.DB }
 
 func NewConversationStore(db *sql.DB) *ConversationStore { return &ConversationStore{DB: db} }
 
-// 更新会话最新 seq 与时间
+// 更新会话最新 seq 与时间（last_seq 只增不减；补齐序列生成器降级时写入的空 conv_type）
 func (s *ConversationStore) UpsertConversation(ctx context.Context, convID, convType, peerID, groupID string, lastSeq int64) error {
-	_, err := s.DB.ExecContext(ctx, `INSERT INTO conversations(id, conv_type, peer_id, group_id, last_seq, updated_at) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE last_seq=IF(VALUES(last_seq)>last_seq, VALUES(last_seq), last_seq), updated_at=VALUES(updated_at)`, convID, convType, peerID, groupID, lastSeq, time.Now())
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO conversations(id, conv_type, peer_id, group_id, last_seq, updated_at) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE last_seq=IF(VALUES(last_seq)>last_seq, VALUES(last_seq), last_seq), conv_type=IF(conv_type='', VALUES(conv_type), conv_type), peer_id=IFNULL(peer_id, VALUES(peer_id)), group_id=IFNULL(group_id, VALUES(group_id)), updated_at=VALUES(updated_at)`, convID, convType, peerID, groupID, lastSeq, time.Now())
 	return err
 }
 
-// 建立用户与会话关系（用于列表），若存在则仅更新时间
+// 建立用户与会话关系（用于列表），若存在则更新时间并取消隐藏
 func (s *ConversationStore) UpsertUserConversation(ctx context.Context, userID, convID, convType, peerID, groupID string) error {
-	_, err := s.DB.ExecContext(ctx, `INSERT INTO user_conversations(user_id, conv_id, conv_type, peer_id, group_id, updated_at) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE updated_at=VALUES(updated_at)`, userID, convID, convType, peerID, groupID, time.Now())
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO user_conversations(user_id, conv_id, conv_type, peer_id, group_id, updated_at) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE updated_at=VALUES(updated_at), hidden=0`, userID, convID, convType, peerID, groupID, time.Now())
 	return err
 }
 
-// 按用户拉取会话列表（按更新时间倒序）
+// 从用户会话列表隐藏（删除会话）；有新消息时 UpsertUserConversation 会重新显示
+func (s *ConversationStore) HideUserConversation(ctx context.Context, userID, convID string) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE user_conversations SET hidden=1 WHERE user_id=? AND conv_id=?`, userID, convID)
+	return err
+}
+
+// 按用户拉取会话列表（按更新时间倒序，不含已删除隐藏的会话）
 func (s *ConversationStore) ListByUser(ctx context.Context, userID string, limit int) (*sql.Rows, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
 	}
-	return s.DB.QueryContext(ctx, `SELECT conv_id, conv_type, peer_id, group_id, pinned, muted, draft, updated_at FROM user_conversations WHERE user_id=? ORDER BY updated_at DESC LIMIT ?`, userID, limit)
+	return s.DB.QueryContext(ctx, `SELECT conv_id, conv_type, peer_id, group_id, pinned, muted, draft, updated_at FROM user_conversations WHERE user_id=? AND hidden=0 ORDER BY updated_at DESC LIMIT ?`, userID, limit)
 }
 
 // 获取会话 last_seq
@@ -89,6 +96,12 @@ func (s *ConversationStore) ListWithUnread(ctx context.Context, userID string, l
 	}
 	_, _ = pipe.Exec(ctx)
 
+	convIDs := make([]string, 0, len(items))
+	for _, it := range items {
+		convIDs = append(convIDs, it.convID)
+	}
+	pins, _ := s.ListPinsByConvs(ctx, convIDs)
+
 	var list []map[string]interface{}
 	for i, it := range items {
 		lastSeq, ok := parseInt64(lastSeqCmds[i])
@@ -122,6 +135,7 @@ func (s *ConversationStore) ListWithUnread(ctx context.Context, userID string, l
 			"lastSeq":   lastSeq,
 			"readSeq":   readSeq,
 			"unread":    unread,
+			"pins":      pins[it.convID],
 		})
 	}
 	return list, nil
@@ -173,3 +187,64 @@ func (s *ConversationStore) SetDraft(ctx context.Context, userID, convID, draft
 	_, err := s.DB.ExecContext(ctx, `UPDATE user_conversations SET draft=?, updated_at=? WHERE user_id=? AND conv_id=?`, draft, time.Now(), userID, convID)
 	return err
 }
+
+// 置顶会话消息；已置顶返回 false
+func (s *ConversationStore) AddPin(ctx context.Context, p *models.PinnedMessage) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `INSERT IGNORE INTO conversation_pins(conv_id, server_msg_id, seq, msg_type, summary, pinned_by, pinned_at) VALUES(?,?,?,?,?,?,?)`, p.ConvID, p.ServerMsgID, p.Seq, p.Type, p.Summary, p.PinnedBy, p.PinnedAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 取消置顶；未置顶返回 false
+func (s *ConversationStore) RemovePin(ctx context.Context, convID, serverMsgID string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM conversation_pins WHERE conv_id=? AND server_msg_id=?`, convID, serverMsgID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 会话置顶消息数
+func (s *ConversationStore) CountPins(ctx context.Context, convID string) (int, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, `SELECT COUNT(1) FROM conversation_pins WHERE conv_id=?`, convID).Scan(&n)
+	return n, err
+}
+
+// 会话置顶消息列表（最新置顶在前）
+func (s *ConversationStore) ListPins(ctx context.Context, convID string) ([]*models.PinnedMessage, error) {
+	res, err := s.ListPinsByConvs(ctx, []string{convID})
+	if err != nil {
+		return nil, err
+	}
+	return res[convID], nil
+}
+
+// 批量查询多个会话的置顶消息（用于会话列表）
+func (s *ConversationStore) ListPinsByConvs(ctx context.Context, convIDs []string) (map[string][]*models.PinnedMessage, error) {
+	res := make(map[string][]*models.PinnedMessage)
+	if len(convIDs) == 0 {
+		return res, nil
+	}
+	args := make([]any, 0, len(convIDs))
+	for _, id := range convIDs {
+		args = append(args, id)
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT conv_id, server_msg_id, seq, msg_type, summary, pinned_by, pinned_at FROM conversation_pins WHERE conv_id IN (`+placeholders(len(convIDs))+`) ORDER BY pinned_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := &models.PinnedMessage{}
+		if err := rows.Scan(&p.ConvID, &p.ServerMsgID, &p.Seq, &p.Type, &p.Summary, &p.PinnedBy, &p.PinnedAt); err != nil {
+			return nil, err
+		}
+		res[p.ConvID] = append(res[p.ConvID], p)
+	}
+	return res, rows.Err()
+}
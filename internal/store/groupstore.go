@@ -46,6 +46,13 @@ func (s *GroupStore) IsMember(ctx context.Context, groupID, userID string) (bool
 	return x > 0, nil
 }
 
+// 查询成员角色（owner/admin/member），非成员返回 sql.ErrNoRows
+func (s *GroupStore) GetMemberRole(ctx context.Context, groupID, userID string) (string, error) {
+	var role string
+	err := s.DB.QueryRowContext(ctx, `SELECT role FROM group_members WHERE group_id=? AND user_id=?`, groupID, userID).Scan(&role)
+	return role, err
+}
+
 // 列出群所有成员 userId
 func (s *GroupStore) ListMemberIDs(ctx context.Context, groupID string) ([]string, error) {
 	rows, err := s.DB.QueryContext(ctx, `SELECT user_id FROM group_members WHERE group_id=?`, groupID)
@@ -7,24 +7,60 @@ import (
 )
 
 // MessageStoreInterface 抽象消息存储，便于切换 MySQL/TiDB/MongoDB：
-// - Append：写入消息（需具备幂等约束）
-// - Recall/DeleteConversation：撤回消息/设置删除水位
-// - List：按会话游标拉取历史
+// - Append/GetByClientID/MaxSeq：写入消息（需具备幂等约束，重复写入返回 ErrDuplicateMessage）、按幂等键回查与最大 seq 查询
+// - Recall/DeleteConversation/DeleteWatermarks：撤回消息/设置与查询删除水位
+// - List/ListBefore/ListForSync：按会话游标向后/向前拉取历史，以及含撤回墓碑的离线同步
 // - DeleteExpired：清理到期的定时自毁
+// - ListRetentionConvs/ListOlderThan/PurgeMessages：保留策略的归档与清理
 // - RecallBySeq/GetBySeq：按序处理（阅后即焚依赖）
+// - GetByID/Edit/ListRevisions：按 serverMsgId 查询、编辑与历史版本
+// - ListThread：按话题根消息拉取回复
+// - AddReaction/RemoveReaction/CountReactions：表情回应及按消息聚合计数
 type MessageStoreInterface interface {
-	// Append 写入消息；要求底层实现对 (conv_id, client_msg_id) 提供唯一约束以实现幂等。
+	// Append 写入消息；要求底层实现对 (conv_id, client_msg_id) 提供唯一约束以实现幂等，已存在时不写入并返回 ErrDuplicateMessage。
 	Append(ctx context.Context, m *models.Message) error
+	// MaxSeq 查询会话已入库消息的最大 seq（无消息时为 0）。
+	MaxSeq(ctx context.Context, convID string) (int64, error)
+	// GetByClientID 按 convId + clientMsgId 查询单条消息（重复发送时返回已入库的消息）。
+	GetByClientID(ctx context.Context, convID, clientMsgID string) (*models.Message, error)
 	// Recall 将消息标记为撤回（不物理删除）。
 	Recall(ctx context.Context, convID, serverMsgID string) error
 	// DeleteConversation 记录会话删除水位（owner 视角）。
 	DeleteConversation(ctx context.Context, ownerID, convID string) error
-	// List 拉取历史（按 seq 严格递增，返回量受 limit 控制）。
-	List(ctx context.Context, convID string, fromSeq int64, limit int) ([]*models.Message, error)
+	// DeleteWatermarks 批量查询 owner 在各会话的删除水位（无水位的会话不在结果中）。
+	DeleteWatermarks(ctx context.Context, ownerID string, convIDs []string) (map[string]time.Time, error)
+	// List 拉取历史（按 seq 严格递增，返回量受 limit 控制）；ownerID 非空时隐藏其删除水位及之前的消息。
+	List(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error)
+	// ListForSync 同 List，但包含已撤回与已过期的消息（离线同步以墓碑下发，客户端据此删除本地副本且不会误判 seq 空洞）。
+	ListForSync(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error)
+	// ListBefore 向前翻页：seq<beforeSeq 的最近 limit 条（beforeSeq<=0 取最新），结果按 seq 升序；ownerID 语义同 List。
+	ListBefore(ctx context.Context, ownerID, convID string, beforeSeq int64, limit int) ([]*models.Message, error)
 	// DeleteExpired 清理到期自毁消息（可由后台任务周期调用）。
 	DeleteExpired(ctx context.Context, before time.Time) error
+	// ListRetentionConvs 列出存在 timestamp<before 消息的会话（按 convId 升序，afterConvID 为分页游标）。
+	ListRetentionConvs(ctx context.Context, before time.Time, afterConvID string, limit int) ([]string, error)
+	// ListOlderThan 拉取会话内 timestamp<before 的消息（含已撤回/过期，按 seq 升序），用于归档。
+	ListOlderThan(ctx context.Context, convID string, before time.Time, limit int) ([]*models.Message, error)
+	// PurgeMessages 物理删除会话内指定消息及其编辑历史、表情回应，返回删除的消息数。
+	PurgeMessages(ctx context.Context, convID string, serverMsgIDs []string) (int64, error)
 	// RecallBySeq 将会话内指定 seq 的消息标记撤回（用于阅后即焚）。
 	RecallBySeq(ctx context.Context, convID string, seq int64) error
 	// GetBySeq 查询会话内 seq 对应的消息（用于判断 burnAfterRead 等属性）。
 	GetBySeq(ctx context.Context, convID string, seq int64) (*models.Message, error)
+	// GetByID 按 convId + serverMsgId 查询单条消息。
+	GetByID(ctx context.Context, convID, serverMsgID string) (*models.Message, error)
+	// Edit 以 fromVersion 做乐观锁替换载荷，旧载荷写入历史版本；版本不匹配返回 ErrVersionConflict。
+	Edit(ctx context.Context, convID, serverMsgID string, payload []byte, fromVersion int, editorID string, at time.Time) error
+	// SetPreviews 回填链接预览；version 不匹配（期间被编辑）时不更新并返回 false。
+	SetPreviews(ctx context.Context, convID, serverMsgID string, version int, previews []*models.LinkPreview) (bool, error)
+	// ListRevisions 列出消息历史版本（按版本升序）。
+	ListRevisions(ctx context.Context, convID, serverMsgID string) ([]*models.MessageRevision, error)
+	// ListThread 拉取话题内 seq>fromSeq 的回复（升序）。
+	ListThread(ctx context.Context, convID, rootID string, fromSeq int64, limit int) ([]*models.Message, error)
+	// AddReaction 添加表情回应；已存在返回 false。
+	AddReaction(ctx context.Context, r *models.MessageReaction) (bool, error)
+	// RemoveReaction 取消表情回应；不存在返回 false。
+	RemoveReaction(ctx context.Context, convID, serverMsgID, emoji, userID string) (bool, error)
+	// CountReactions 按 serverMsgId 聚合表情计数，Reacted 标记 userID 是否回应过。
+	CountReactions(ctx context.Context, convID string, serverMsgIDs []string, userID string) (map[string][]*models.ReactionCount, error)
 }
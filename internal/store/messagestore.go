@@ -3,6 +3,9 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
 	"time"
 
 	"go-im/internal/models"
@@ -11,16 +14,39 @@ import (
 // MessageStore 基于 SQL 的消息存储实现（MySQL/TiDB 兼容）。
 // 约束：
 // - messages 表需具备 (conv_id, client_msg_id) 唯一键保障幂等
-// - idx_conv_seq 支撑按会话顺序拉取
+// - uniq_conv_seq 保证会话内 seq 不重复，并支撑按会话顺序拉取
 // - 扩展字段：expire_at、burn_after_read 支持定时自毁/阅后即焚
+// - 编辑：edited/version/edited_at，旧版本写入 message_revisions
+// - 引用/话题：reply_to、thread_root、quote（被引用消息快照 JSON），idx_conv_thread 支撑话题列表
+// - 转发：forward_from（来源 JSON）
+// - 表情回应：message_reactions 以 (conv_id, server_msg_id, emoji, user_id) 为主键
 type MessageStore struct{ DB *sql.DB }
 
+// ErrVersionConflict 编辑时消息版本已变化（并发编辑），调用方可重新读取后重试。
+var ErrVersionConflict = errors.New("message version conflict")
+
+// ErrDuplicateMessage 相同 (convId, clientMsgId) 的消息已入库（客户端重发），调用方可经 GetByClientID 取回原消息。
+var ErrDuplicateMessage = errors.New("duplicate message")
+
 func NewMessageStore(db *sql.DB) *MessageStore { return &MessageStore{DB: db} }
 
-// Append 插入消息；使用 INSERT IGNORE 实现幂等写入。
+// Append 插入消息；使用 INSERT IGNORE 实现幂等写入，未插入（唯一键冲突）时返回 ErrDuplicateMessage。
 func (s *MessageStore) Append(ctx context.Context, m *models.Message) error {
-	_, err := s.DB.ExecContext(ctx, `INSERT IGNORE INTO messages(server_msg_id, client_msg_id, conv_id, conv_type, from_user_id, to_user_id, group_id, seq, timestamp, type, payload, recalled, expire_at, burn_after_read) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`, m.ServerMsgID, m.ClientMsgID, m.ConvID, m.ConvType, m.FromUserID, m.ToUserID, m.GroupID, m.Seq, m.Timestamp, m.Type, m.Payload, m.Recalled, m.ExpireAt, m.BurnAfterRead)
-	return err
+	var quote, forwardFrom []byte
+	if m.Quote != nil {
+		quote, _ = json.Marshal(m.Quote)
+	}
+	if m.ForwardedFrom != nil {
+		forwardFrom, _ = json.Marshal(m.ForwardedFrom)
+	}
+	res, err := s.DB.ExecContext(ctx, `INSERT IGNORE INTO messages(server_msg_id, client_msg_id, conv_id, conv_type, from_user_id, to_user_id, group_id, seq, timestamp, type, payload, recalled, expire_at, burn_after_read, reply_to, thread_root, quote, forward_from) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`, m.ServerMsgID, m.ClientMsgID, m.ConvID, m.ConvType, m.FromUserID, m.ToUserID, m.GroupID, m.Seq, m.Timestamp, m.Type, m.Payload, m.Recalled, m.ExpireAt, m.BurnAfterRead, m.ReplyTo, m.ThreadRoot, quote, forwardFrom)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
 }
 
 // Recall 标记消息撤回（不删除物理记录）。
@@ -35,30 +61,180 @@ func (s *MessageStore) DeleteConversation(ctx context.Context, ownerID, convID s
 	return err
 }
 
-// List 按会话增量拉取历史：过滤已撤回与已过期消息。
-func (s *MessageStore) List(ctx context.Context, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+// DeleteWatermarks 批量查询用户在各会话的删除水位。
+func (s *MessageStore) DeleteWatermarks(ctx context.Context, ownerID string, convIDs []string) (map[string]time.Time, error) {
+	res := make(map[string]time.Time)
+	if len(convIDs) == 0 {
+		return res, nil
+	}
+	args := make([]any, 0, len(convIDs)+1)
+	args = append(args, ownerID)
+	for _, id := range convIDs {
+		args = append(args, id)
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT conv_id, deleted_at FROM conv_deletes WHERE owner_id=? AND conv_id IN (`+placeholders(len(convIDs))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var convID string
+		var at time.Time
+		if err := rows.Scan(&convID, &at); err != nil {
+			return nil, err
+		}
+		res[convID] = at
+	}
+	return res, rows.Err()
+}
+
+const messageColumns = `server_msg_id, client_msg_id, conv_id, conv_type, from_user_id, to_user_id, group_id, seq, timestamp, type, payload, recalled, expire_at, burn_after_read, edited, version, edited_at, reply_to, thread_root, quote, forward_from, previews`
+
+// watermarkCond 返回 owner 删除水位对应的过滤条件（ownerID 为空或无水位时为空条件）。
+func (s *MessageStore) watermarkCond(ctx context.Context, ownerID, convID string) (string, []any, error) {
+	if ownerID == "" {
+		return "", nil, nil
+	}
+	wms, err := s.DeleteWatermarks(ctx, ownerID, []string{convID})
+	if err != nil {
+		return "", nil, err
+	}
+	wm, ok := wms[convID]
+	if !ok {
+		return "", nil, nil
+	}
+	return ` AND timestamp>?`, []any{wm}, nil
+}
+
+// List 按会话增量拉取历史：过滤已撤回与已过期消息，以及 owner 删除水位及之前的消息。
+func (s *MessageStore) List(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
 	}
-	rows, err := s.DB.QueryContext(ctx, `SELECT server_msg_id, client_msg_id, conv_id, conv_type, from_user_id, to_user_id, group_id, seq, timestamp, type, payload, recalled, expire_at, burn_after_read FROM messages WHERE conv_id=? AND seq>? AND recalled=0 AND (expire_at IS NULL OR expire_at>NOW()) ORDER BY seq ASC LIMIT ?`, convID, fromSeq, limit)
+	cond, condArgs, err := s.watermarkCond(ctx, ownerID, convID)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{convID, fromSeq}, condArgs...)
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND seq>? AND recalled=0 AND (expire_at IS NULL OR expire_at>NOW())`+cond+` ORDER BY seq ASC LIMIT ?`, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// ListForSync 按会话增量拉取（含已撤回/已过期消息，仅过滤 owner 删除水位），供离线同步下发墓碑。
+func (s *MessageStore) ListForSync(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	cond, condArgs, err := s.watermarkCond(ctx, ownerID, convID)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{convID, fromSeq}, condArgs...)
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND seq>?`+cond+` ORDER BY seq ASC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// ListBefore 向前翻页：返回 seq<beforeSeq 的最近 limit 条（beforeSeq<=0 表示从最新开始），结果按 seq 升序。
+func (s *MessageStore) ListBefore(ctx context.Context, ownerID, convID string, beforeSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if beforeSeq <= 0 {
+		beforeSeq = math.MaxInt64
+	}
+	cond, condArgs, err := s.watermarkCond(ctx, ownerID, convID)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{convID, beforeSeq}, condArgs...)
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND seq<? AND recalled=0 AND (expire_at IS NULL OR expire_at>NOW())`+cond+` ORDER BY seq DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	reverseMessages(res)
+	return res, nil
+}
+
+// ListThread 拉取话题内回复：thread_root=rootID 且 seq>fromSeq，按 seq 升序。
+func (s *MessageStore) ListThread(ctx context.Context, convID, rootID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND thread_root=? AND seq>? AND recalled=0 AND (expire_at IS NULL OR expire_at>NOW()) ORDER BY seq ASC LIMIT ?`, convID, rootID, fromSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (*models.Message, error) {
+	m := &models.Message{}
+	var expireAt, editedAt sql.NullTime
+	var quote, forwardFrom, previews []byte
+	if err := row.Scan(&m.ServerMsgID, &m.ClientMsgID, &m.ConvID, &m.ConvType, &m.FromUserID, &m.ToUserID, &m.GroupID, &m.Seq, &m.Timestamp, &m.Type, &m.Payload, &m.Recalled, &expireAt, &m.BurnAfterRead, &m.Edited, &m.Version, &editedAt, &m.ReplyTo, &m.ThreadRoot, &quote, &forwardFrom, &previews); err != nil {
+		return nil, err
+	}
+	if len(quote) > 0 {
+		var q models.QuotedMessage
+		if json.Unmarshal(quote, &q) == nil {
+			m.Quote = &q
+		}
+	}
+	if len(forwardFrom) > 0 {
+		var f models.ForwardInfo
+		if json.Unmarshal(forwardFrom, &f) == nil {
+			m.ForwardedFrom = &f
+		}
+	}
+	if len(previews) > 0 {
+		_ = json.Unmarshal(previews, &m.Previews)
+	}
+	if expireAt.Valid {
+		t := expireAt.Time
+		m.ExpireAt = &t
+	}
+	if editedAt.Valid {
+		t := editedAt.Time
+		m.EditedAt = &t
+	}
+	return m, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]*models.Message, error) {
 	var res []*models.Message
 	for rows.Next() {
-		m := &models.Message{}
-		var nt sql.NullTime
-		if err := rows.Scan(&m.ServerMsgID, &m.ClientMsgID, &m.ConvID, &m.ConvType, &m.FromUserID, &m.ToUserID, &m.GroupID, &m.Seq, &m.Timestamp, &m.Type, &m.Payload, &m.Recalled, &nt, &m.BurnAfterRead); err != nil {
+		m, err := scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
-		if nt.Valid {
-			t := nt.Time
-			m.ExpireAt = &t
-		}
 		res = append(res, m)
 	}
-	return res, nil
+	return res, rows.Err()
+}
+
+// reverseMessages 原地反转（降序查询结果转为升序返回）。
+func reverseMessages(ms []*models.Message) {
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
 }
 
 // DeleteExpired 物理删除已到期的自毁消息（SQL 侧的简单清理策略）。
@@ -67,6 +243,64 @@ func (s *MessageStore) DeleteExpired(ctx context.Context, before time.Time) erro
 	return err
 }
 
+// ListRetentionConvs 列出存在早于 before 的消息的会话（保留策略扫描用）。
+func (s *MessageStore) ListRetentionConvs(ctx context.Context, before time.Time, afterConvID string, limit int) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT DISTINCT conv_id FROM messages WHERE timestamp<? AND conv_id>? ORDER BY conv_id ASC LIMIT ?`, before, afterConvID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ListOlderThan 拉取会话内早于 before 的消息（不过滤撤回/过期），按 seq 升序。
+func (s *MessageStore) ListOlderThan(ctx context.Context, convID string, before time.Time, limit int) ([]*models.Message, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND timestamp<? ORDER BY seq ASC LIMIT ?`, convID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// PurgeMessages 物理删除消息及其编辑历史与表情回应（事务内执行）。
+func (s *MessageStore) PurgeMessages(ctx context.Context, convID string, serverMsgIDs []string) (int64, error) {
+	if len(serverMsgIDs) == 0 {
+		return 0, nil
+	}
+	args := make([]any, 0, len(serverMsgIDs)+1)
+	args = append(args, convID)
+	for _, id := range serverMsgIDs {
+		args = append(args, id)
+	}
+	in := `(` + placeholders(len(serverMsgIDs)) + `)`
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_reactions WHERE conv_id=? AND server_msg_id IN `+in, args...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_revisions WHERE conv_id=? AND server_msg_id IN `+in, args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE conv_id=? AND server_msg_id IN `+in, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return n, tx.Commit()
+}
+
 // RecallBySeq 按 seq 撤回，仅应用于 burn_after_read 的消息，避免误撤回。
 func (s *MessageStore) RecallBySeq(ctx context.Context, convID string, seq int64) error {
 	_, err := s.DB.ExecContext(ctx, `UPDATE messages SET recalled=1 WHERE conv_id=? AND seq=? AND burn_after_read=1`, convID, seq)
@@ -75,15 +309,136 @@ func (s *MessageStore) RecallBySeq(ctx context.Context, convID string, seq int64
 
 // GetBySeq 查询会话内指定 seq 的消息元信息（用于判定阅后即焚等属性）。
 func (s *MessageStore) GetBySeq(ctx context.Context, convID string, seq int64) (*models.Message, error) {
-	row := s.DB.QueryRowContext(ctx, `SELECT server_msg_id, client_msg_id, conv_id, conv_type, from_user_id, to_user_id, group_id, seq, timestamp, type, payload, recalled, expire_at, burn_after_read FROM messages WHERE conv_id=? AND seq=?`, convID, seq)
-	m := &models.Message{}
-	var nt sql.NullTime
-	if err := row.Scan(&m.ServerMsgID, &m.ClientMsgID, &m.ConvID, &m.ConvType, &m.FromUserID, &m.ToUserID, &m.GroupID, &m.Seq, &m.Timestamp, &m.Type, &m.Payload, &m.Recalled, &nt, &m.BurnAfterRead); err != nil {
+	return scanMessage(s.DB.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND seq=?`, convID, seq))
+}
+
+// MaxSeq 查询会话已入库消息的最大 seq（序列生成器冷启动下限）。
+func (s *MessageStore) MaxSeq(ctx context.Context, convID string) (int64, error) {
+	var seq sql.NullInt64
+	if err := s.DB.QueryRowContext(ctx, `SELECT MAX(seq) FROM messages WHERE conv_id=?`, convID).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return seq.Int64, nil
+}
+
+// GetByClientID 按 convId + clientMsgId 查询单条消息（幂等重发时取回已入库的消息）。
+func (s *MessageStore) GetByClientID(ctx context.Context, convID, clientMsgID string) (*models.Message, error) {
+	return scanMessage(s.DB.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND client_msg_id=?`, convID, clientMsgID))
+}
+
+// GetByID 按 convId + serverMsgId 查询单条消息（不过滤撤回状态，由调用方判断）。
+func (s *MessageStore) GetByID(ctx context.Context, convID, serverMsgID string) (*models.Message, error) {
+	return scanMessage(s.DB.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE conv_id=? AND server_msg_id=?`, convID, serverMsgID))
+}
+
+// SetPreviews 回填链接预览（previews 为空时清空），以 version 防止覆盖编辑后的消息。
+func (s *MessageStore) SetPreviews(ctx context.Context, convID, serverMsgID string, version int, previews []*models.LinkPreview) (bool, error) {
+	var b []byte
+	if len(previews) > 0 {
+		var err error
+		if b, err = json.Marshal(previews); err != nil {
+			return false, err
+		}
+	}
+	res, err := s.DB.ExecContext(ctx, `UPDATE messages SET previews=? WHERE conv_id=? AND server_msg_id=? AND version=?`, b, convID, serverMsgID, version)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Edit 替换消息载荷：在同一事务内将旧载荷写入 message_revisions，并以 version 做乐观锁。
+func (s *MessageStore) Edit(ctx context.Context, convID, serverMsgID string, payload []byte, fromVersion int, editorID string, at time.Time) (err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	_, err = tx.ExecContext(ctx, `INSERT IGNORE INTO message_revisions(server_msg_id, conv_id, version, payload, edited_by, created_at) SELECT server_msg_id, conv_id, version, payload, ?, ? FROM messages WHERE conv_id=? AND server_msg_id=? AND version=?`, editorID, at, convID, serverMsgID, fromVersion)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE messages SET payload=?, edited=1, version=version+1, edited_at=? WHERE conv_id=? AND server_msg_id=? AND version=? AND recalled=0`, payload, at, convID, serverMsgID, fromVersion)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = ErrVersionConflict
+		return err
+	}
+	return nil
+}
+
+// ListRevisions 列出消息的历史版本（按版本升序）。
+func (s *MessageStore) ListRevisions(ctx context.Context, convID, serverMsgID string) ([]*models.MessageRevision, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT server_msg_id, conv_id, version, payload, edited_by, created_at FROM message_revisions WHERE conv_id=? AND server_msg_id=? ORDER BY version ASC`, convID, serverMsgID)
+	if err != nil {
 		return nil, err
 	}
-	if nt.Valid {
-		t := nt.Time
-		m.ExpireAt = &t
+	defer rows.Close()
+	var res []*models.MessageRevision
+	for rows.Next() {
+		r := &models.MessageRevision{}
+		if err := rows.Scan(&r.ServerMsgID, &r.ConvID, &r.Version, &r.Payload, &r.EditedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
 	}
-	return m, nil
+	return res, rows.Err()
+}
+
+// AddReaction 添加表情回应；已存在时返回 false（幂等）。
+func (s *MessageStore) AddReaction(ctx context.Context, r *models.MessageReaction) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `INSERT IGNORE INTO message_reactions(conv_id, server_msg_id, emoji, user_id, created_at) VALUES(?,?,?,?,?)`, r.ConvID, r.ServerMsgID, r.Emoji, r.UserID, r.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// RemoveReaction 取消表情回应；不存在时返回 false。
+func (s *MessageStore) RemoveReaction(ctx context.Context, convID, serverMsgID, emoji, userID string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM message_reactions WHERE conv_id=? AND server_msg_id=? AND emoji=? AND user_id=?`, convID, serverMsgID, emoji, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CountReactions 按消息聚合表情回应计数（按首次回应时间排序），userID 用于标记当前用户是否回应过。
+func (s *MessageStore) CountReactions(ctx context.Context, convID string, serverMsgIDs []string, userID string) (map[string][]*models.ReactionCount, error) {
+	res := make(map[string][]*models.ReactionCount)
+	if len(serverMsgIDs) == 0 {
+		return res, nil
+	}
+	args := make([]any, 0, len(serverMsgIDs)+2)
+	args = append(args, userID, convID)
+	for _, id := range serverMsgIDs {
+		args = append(args, id)
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT server_msg_id, emoji, COUNT(*), SUM(user_id=?) FROM message_reactions WHERE conv_id=? AND server_msg_id IN (`+placeholders(len(serverMsgIDs))+`) GROUP BY server_msg_id, emoji ORDER BY MIN(created_at) ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var rc models.ReactionCount
+		var mine int
+		if err := rows.Scan(&id, &rc.Emoji, &rc.Count, &mine); err != nil {
+			return nil, err
+		}
+		rc.Reacted = mine > 0
+		res[id] = append(res[id], &rc)
+	}
+	return res, rows.Err()
 }
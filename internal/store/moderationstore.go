@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go-im/internal/models"
+)
+
+// 敏感词审核存储（主库）：群级处理方式覆盖 + 人工审核队列；审核结论以 status=pending 作为 CAS 条件。
+type ModerationStore struct{ DB *sql.DB }
+
+func NewModerationStore(db *sql.DB) *ModerationStore { return &ModerationStore{DB: db} }
+
+const moderationReviewColumns = `id, conv_id, conv_type, server_msg_id, seq, from_user_id, group_id, content, words, status, reviewed_by, reviewed_at, created_at`
+
+func scanModerationReview(sc interface{ Scan(dest ...any) error }) (*models.ModerationReview, error) {
+	r := &models.ModerationReview{}
+	var convType, words string
+	var reviewedAt sql.NullTime
+	if err := sc.Scan(&r.ID, &r.ConvID, &convType, &r.ServerMsgID, &r.Seq, &r.FromUserID, &r.GroupID, &r.Content, &words, &r.Status, &r.ReviewedBy, &reviewedAt, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	r.ConvType = models.ConversationType(convType)
+	_ = json.Unmarshal([]byte(words), &r.Words)
+	if reviewedAt.Valid {
+		t := reviewedAt.Time
+		r.ReviewedAt = &t
+	}
+	return r, nil
+}
+
+// 新增待审核记录
+func (s *ModerationStore) CreateReview(ctx context.Context, r *models.ModerationReview) error {
+	words, _ := json.Marshal(r.Words)
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO moderation_reviews(`+moderationReviewColumns+`) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`, r.ID, r.ConvID, string(r.ConvType), r.ServerMsgID, r.Seq, r.FromUserID, r.GroupID, r.Content, string(words), r.Status, r.ReviewedBy, r.ReviewedAt, r.CreatedAt)
+	return err
+}
+
+// 按 ID 查询审核记录
+func (s *ModerationStore) GetReview(ctx context.Context, id string) (*models.ModerationReview, error) {
+	return scanModerationReview(s.DB.QueryRowContext(ctx, `SELECT `+moderationReviewColumns+` FROM moderation_reviews WHERE id=?`, id))
+}
+
+// 审核记录列表（按创建时间倒序）；status 为空时返回全部
+func (s *ModerationStore) ListReviews(ctx context.Context, status string, limit, offset int) ([]*models.ModerationReview, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	q := `SELECT ` + moderationReviewColumns + ` FROM moderation_reviews`
+	var args []any
+	if status != "" {
+		q += ` WHERE status=?`
+		args = append(args, status)
+	}
+	q += ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+	rows, err := s.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*models.ModerationReview
+	for rows.Next() {
+		r, err := scanModerationReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// 写入审核结论；非 pending 返回 false
+func (s *ModerationStore) ResolveReview(ctx context.Context, id, status, by string, at time.Time) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `UPDATE moderation_reviews SET status=?, reviewed_by=?, reviewed_at=? WHERE id=? AND status=?`, status, by, at, id, models.ModerationReviewPending)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 新增或更新群级处理方式
+func (s *ModerationStore) UpsertGroupPolicy(ctx context.Context, p *models.ModerationGroupPolicy) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO moderation_group_policies(group_id, action, updated_by, updated_at) VALUES(?,?,?,?) ON DUPLICATE KEY UPDATE action=VALUES(action), updated_by=VALUES(updated_by), updated_at=VALUES(updated_at)`, p.GroupID, p.Action, p.UpdatedBy, p.UpdatedAt)
+	return err
+}
+
+// 删除群级处理方式（回退到全局默认）；不存在返回 false
+func (s *ModerationStore) DeleteGroupPolicy(ctx context.Context, groupID string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM moderation_group_policies WHERE group_id=?`, groupID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 群级处理方式；未配置返回空串
+func (s *ModerationStore) GetGroupAction(ctx context.Context, groupID string) (string, error) {
+	var action string
+	err := s.DB.QueryRowContext(ctx, `SELECT action FROM moderation_group_policies WHERE group_id=?`, groupID).Scan(&action)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return action, err
+}
+
+// 全部群级处理方式
+func (s *ModerationStore) ListGroupPolicies(ctx context.Context) ([]*models.ModerationGroupPolicy, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT group_id, action, updated_by, updated_at FROM moderation_group_policies ORDER BY group_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*models.ModerationGroupPolicy
+	for rows.Next() {
+		p := &models.ModerationGroupPolicy{}
+		if err := rows.Scan(&p.GroupID, &p.Action, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
@@ -2,6 +2,8 @@ package store
 
 import (
 	"context"
+	"math"
+	"sort"
 	"time"
 
 	"go-im/internal/models"
@@ -15,7 +17,7 @@ import (
 // MongoMessageStore 基于 MongoDB 的消息存储实现。
 // - NewMongoMessageStore 会在 messages 集合上创建 expire_at 的 TTL 索引（partial），到期文档自动清理
 // - 通过 (conv_id, client_msg_id) 唯一索引保障幂等
-// - List 过滤 recalled 与 expire_at<=now 的消息
+// - List/ListBefore 过滤 recalled 与 expire_at<=now 的消息，依赖 (conv_id, seq) 索引
 // - RecallBySeq 仅作用于 burn_after_read=true 的文档
 type MongoMessageStore struct {
 	DB *mongo.Database
@@ -34,30 +36,115 @@ func NewMongoMessageStore(db *mongo.Database) *MongoMessageStore {
 			SetName("ttl_expire_at").
 			SetPartialFilterExpression(bson.D{{Key: "expire_at", Value: bson.D{{Key: "$exists", Value: true}}}}),
 	})
+	// 会话内按 seq 双向翻页；唯一约束保证 seq 不重复
+	_, _ = ms.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "conv_id", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetName("uniq_conv_seq").SetUnique(true),
+	})
+	// 话题回复列表（仅索引带 thread_root 的文档）
+	_, _ = ms.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conv_id", Value: 1}, {Key: "thread_root", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().
+			SetName("idx_conv_thread").
+			SetPartialFilterExpression(bson.D{{Key: "thread_root", Value: bson.D{{Key: "$exists", Value: true}}}}),
+	})
+	// 保留策略扫描：按时间定位过期会话
+	_, _ = ms.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetName("idx_timestamp"),
+	})
+	// 编辑历史：同一消息同一版本只保留一份
+	_, _ = ms.revisionCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "server_msg_id", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("uniq_msg_version"),
+	})
+	// 表情回应：唯一键兼作按消息聚合的索引
+	_, _ = ms.reactionCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "conv_id", Value: 1}, {Key: "server_msg_id", Value: 1}, {Key: "emoji", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("uniq_reaction"),
+	})
 	return ms
 }
 
 // mongoMessage 为存储层内部结构，与 models.Message 字段一一映射（部分命名略有差异）。
 type mongoMessage struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty"`
-	ServerMsgID   string             `bson:"server_msg_id"`
-	ClientMsgID   string             `bson:"client_msg_id"`
-	ConvID        string             `bson:"conv_id"`
-	ConvType      string             `bson:"conv_type"`
-	FromUserID    string             `bson:"from_user_id"`
-	ToUserID      string             `bson:"to_user_id,omitempty"`
-	GroupID       string             `bson:"group_id,omitempty"`
-	Seq           int64              `bson:"seq"`
-	Timestamp     time.Time          `bson:"timestamp"`
-	Type          string             `bson:"type"`
-	Payload       []byte             `bson:"payload"`
-	Recalled      bool               `bson:"recalled"`
-	StreamID      string             `bson:"stream_id,omitempty"`
-	StreamSeq     int                `bson:"stream_seq,omitempty"`
-	StreamStatus  string             `bson:"stream_status,omitempty"`
-	IsStreaming   bool               `bson:"is_streaming,omitempty"`
-	ExpireAt      *time.Time         `bson:"expire_at,omitempty"`
-	BurnAfterRead bool               `bson:"burn_after_read,omitempty"`
+	ID            primitive.ObjectID    `bson:"_id,omitempty"`
+	ServerMsgID   string                `bson:"server_msg_id"`
+	ClientMsgID   string                `bson:"client_msg_id"`
+	ConvID        string                `bson:"conv_id"`
+	ConvType      string                `bson:"conv_type"`
+	FromUserID    string                `bson:"from_user_id"`
+	ToUserID      string                `bson:"to_user_id,omitempty"`
+	GroupID       string                `bson:"group_id,omitempty"`
+	Seq           int64                 `bson:"seq"`
+	Timestamp     time.Time             `bson:"timestamp"`
+	Type          string                `bson:"type"`
+	Payload       []byte                `bson:"payload"`
+	Recalled      bool                  `bson:"recalled"`
+	StreamID      string                `bson:"stream_id,omitempty"`
+	StreamSeq     int                   `bson:"stream_seq,omitempty"`
+	StreamStatus  string                `bson:"stream_status,omitempty"`
+	IsStreaming   bool                  `bson:"is_streaming,omitempty"`
+	ExpireAt      *time.Time            `bson:"expire_at,omitempty"`
+	BurnAfterRead bool                  `bson:"burn_after_read,omitempty"`
+	Edited        bool                  `bson:"edited,omitempty"`
+	Version       int                   `bson:"version,omitempty"`
+	EditedAt      *time.Time            `bson:"edited_at,omitempty"`
+	ReplyTo       string                `bson:"reply_to,omitempty"`
+	ThreadRoot    string                `bson:"thread_root,omitempty"`
+	Quote         *models.QuotedMessage `bson:"quote,omitempty"`
+	ForwardedFrom *models.ForwardInfo   `bson:"forward_from,omitempty"`
+	Previews      []*models.LinkPreview `bson:"previews,omitempty"`
+}
+
+// mongoReaction 表情回应文档（conv_id+server_msg_id+emoji+user_id 唯一）
+type mongoReaction struct {
+	ConvID      string    `bson:"conv_id"`
+	ServerMsgID string    `bson:"server_msg_id"`
+	Emoji       string    `bson:"emoji"`
+	UserID      string    `bson:"user_id"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+// mongoRevision 消息历史版本文档（server_msg_id+version 唯一）
+type mongoRevision struct {
+	ServerMsgID string    `bson:"server_msg_id"`
+	ConvID      string    `bson:"conv_id"`
+	Version     int       `bson:"version"`
+	Payload     []byte    `bson:"payload"`
+	EditedBy    string    `bson:"edited_by"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+func (doc *mongoMessage) toModel() *models.Message {
+	return &models.Message{
+		ServerMsgID:   doc.ServerMsgID,
+		ClientMsgID:   doc.ClientMsgID,
+		ConvID:        doc.ConvID,
+		ConvType:      models.ConversationType(doc.ConvType),
+		FromUserID:    doc.FromUserID,
+		ToUserID:      doc.ToUserID,
+		GroupID:       doc.GroupID,
+		Seq:           doc.Seq,
+		Timestamp:     doc.Timestamp,
+		Type:          doc.Type,
+		Payload:       doc.Payload,
+		Recalled:      doc.Recalled,
+		StreamID:      doc.StreamID,
+		StreamSeq:     doc.StreamSeq,
+		StreamStatus:  doc.StreamStatus,
+		IsStreaming:   doc.IsStreaming,
+		ExpireAt:      doc.ExpireAt,
+		BurnAfterRead: doc.BurnAfterRead,
+		Edited:        doc.Edited,
+		Version:       doc.Version,
+		EditedAt:      doc.EditedAt,
+		ReplyTo:       doc.ReplyTo,
+		ThreadRoot:    doc.ThreadRoot,
+		Quote:         doc.Quote,
+		ForwardedFrom: doc.ForwardedFrom,
+		Previews:      doc.Previews,
+	}
 }
 
 // MongoDB 会话删除水位文档
@@ -76,7 +163,15 @@ func (s *MongoMessageStore) deleteCollection() *mongo.Collection {
 	return s.DB.Collection("conv_deletes")
 }
 
-// Append 幂等写入消息（upsert + $setOnInsert）。
+func (s *MongoMessageStore) revisionCollection() *mongo.Collection {
+	return s.DB.Collection("message_revisions")
+}
+
+func (s *MongoMessageStore) reactionCollection() *mongo.Collection {
+	return s.DB.Collection("message_reactions")
+}
+
+// Append 幂等写入消息（upsert + $setOnInsert），未新插入时返回 ErrDuplicateMessage。
 func (s *MongoMessageStore) Append(ctx context.Context, m *models.Message) error {
 	doc := &mongoMessage{
 		ServerMsgID:   m.ServerMsgID,
@@ -97,6 +192,10 @@ func (s *MongoMessageStore) Append(ctx context.Context, m *models.Message) error
 		IsStreaming:   m.IsStreaming,
 		ExpireAt:      m.ExpireAt,
 		BurnAfterRead: m.BurnAfterRead,
+		ReplyTo:       m.ReplyTo,
+		ThreadRoot:    m.ThreadRoot,
+		Quote:         m.Quote,
+		ForwardedFrom: m.ForwardedFrom,
 	}
 
 	// 创建唯一索引确保幂等性（容错：重复创建无害）
@@ -114,8 +213,14 @@ func (s *MongoMessageStore) Append(ctx context.Context, m *models.Message) error
 	update := bson.D{{Key: "$setOnInsert", Value: doc}}
 	opts := options.Update().SetUpsert(true)
 
-	_, err := s.collection().UpdateOne(ctx, filter, update, opts)
-	return err
+	res, err := s.collection().UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return err
+	}
+	if res.UpsertedCount == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
 }
 
 // Recall 按 server_msg_id 撤回。
@@ -157,13 +262,50 @@ func (s *MongoMessageStore) DeleteConversation(ctx context.Context, ownerID, con
 	return err
 }
 
-// List 增量拉取历史：过滤 recalled 与已过期。
-func (s *MongoMessageStore) List(ctx context.Context, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+// DeleteWatermarks 批量查询用户在各会话的删除水位。
+func (s *MongoMessageStore) DeleteWatermarks(ctx context.Context, ownerID string, convIDs []string) (map[string]time.Time, error) {
+	res := make(map[string]time.Time)
+	if len(convIDs) == 0 {
+		return res, nil
+	}
+	filter := bson.D{{Key: "owner_id", Value: ownerID}, {Key: "conv_id", Value: bson.D{{Key: "$in", Value: convIDs}}}}
+	cursor, err := s.deleteCollection().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc mongoConvDelete
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		res[doc.ConvID] = doc.DeletedAt
+	}
+	return res, cursor.Err()
+}
+
+// withWatermark 追加 owner 删除水位过滤（ownerID 为空或无水位时原样返回）。
+func (s *MongoMessageStore) withWatermark(ctx context.Context, filter bson.D, ownerID, convID string) (bson.D, error) {
+	if ownerID == "" {
+		return filter, nil
+	}
+	wms, err := s.DeleteWatermarks(ctx, ownerID, []string{convID})
+	if err != nil {
+		return nil, err
+	}
+	if wm, ok := wms[convID]; ok {
+		filter = append(filter, bson.E{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: wm}}})
+	}
+	return filter, nil
+}
+
+// List 增量拉取历史：过滤 recalled、已过期，以及 owner 删除水位及之前的消息。
+func (s *MongoMessageStore) List(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
 	}
 
-	filter := bson.D{
+	filter, err := s.withWatermark(ctx, bson.D{
 		{Key: "conv_id", Value: convID},
 		{Key: "seq", Value: bson.D{{Key: "$gt", Value: fromSeq}}},
 		{Key: "recalled", Value: false},
@@ -171,6 +313,9 @@ func (s *MongoMessageStore) List(ctx context.Context, convID string, fromSeq int
 			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$eq", Value: nil}}}},
 			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
 		}},
+	}, ownerID, convID)
+	if err != nil {
+		return nil, err
 	}
 	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
 
@@ -180,36 +325,101 @@ func (s *MongoMessageStore) List(ctx context.Context, convID string, fromSeq int
 	}
 	defer cursor.Close(ctx)
 
+	return decodeMessages(ctx, cursor)
+}
+
+// ListForSync 按会话增量拉取（含已撤回/已过期消息，仅过滤 owner 删除水位），供离线同步下发墓碑。
+func (s *MongoMessageStore) ListForSync(ctx context.Context, ownerID, convID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	filter, err := s.withWatermark(ctx, bson.D{
+		{Key: "conv_id", Value: convID},
+		{Key: "seq", Value: bson.D{{Key: "$gt", Value: fromSeq}}},
+	}, ownerID, convID)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := s.collection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	return decodeMessages(ctx, cursor)
+}
+
+// ListBefore 向前翻页：返回 seq<beforeSeq 的最近 limit 条（beforeSeq<=0 表示从最新开始），结果按 seq 升序。
+func (s *MongoMessageStore) ListBefore(ctx context.Context, ownerID, convID string, beforeSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if beforeSeq <= 0 {
+		beforeSeq = math.MaxInt64
+	}
+
+	filter, err := s.withWatermark(ctx, bson.D{
+		{Key: "conv_id", Value: convID},
+		{Key: "seq", Value: bson.D{{Key: "$lt", Value: beforeSeq}}},
+		{Key: "recalled", Value: false},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$eq", Value: nil}}}},
+			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
+		}},
+	}, ownerID, convID)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: -1}}).SetLimit(int64(limit))
+
+	cursor, err := s.collection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	result, err := decodeMessages(ctx, cursor)
+	if err != nil {
+		return nil, err
+	}
+	reverseMessages(result)
+	return result, nil
+}
+
+// ListThread 拉取话题内回复：thread_root=rootID 且 seq>fromSeq，按 seq 升序。
+func (s *MongoMessageStore) ListThread(ctx context.Context, convID, rootID string, fromSeq int64, limit int) ([]*models.Message, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	filter := bson.D{
+		{Key: "conv_id", Value: convID},
+		{Key: "thread_root", Value: rootID},
+		{Key: "seq", Value: bson.D{{Key: "$gt", Value: fromSeq}}},
+		{Key: "recalled", Value: false},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$eq", Value: nil}}}},
+			bson.D{{Key: "expire_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
+		}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := s.collection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	return decodeMessages(ctx, cursor)
+}
+
+// decodeMessages 逐条解码游标结果（解码失败的文档跳过）。
+func decodeMessages(ctx context.Context, cursor *mongo.Cursor) ([]*models.Message, error) {
 	var result []*models.Message
 	for cursor.Next(ctx) {
 		var doc mongoMessage
 		if err := cursor.Decode(&doc); err != nil {
 			continue
 		}
-
-		msg := &models.Message{
-			ServerMsgID:   doc.ServerMsgID,
-			ClientMsgID:   doc.ClientMsgID,
-			ConvID:        doc.ConvID,
-			ConvType:      models.ConversationType(doc.ConvType),
-			FromUserID:    doc.FromUserID,
-			ToUserID:      doc.ToUserID,
-			GroupID:       doc.GroupID,
-			Seq:           doc.Seq,
-			Timestamp:     doc.Timestamp,
-			Type:          doc.Type,
-			Payload:       doc.Payload,
-			Recalled:      doc.Recalled,
-			StreamID:      doc.StreamID,
-			StreamSeq:     doc.StreamSeq,
-			StreamStatus:  doc.StreamStatus,
-			IsStreaming:   doc.IsStreaming,
-			ExpireAt:      doc.ExpireAt,
-			BurnAfterRead: doc.BurnAfterRead,
-		}
-		result = append(result, msg)
+		result = append(result, doc.toModel())
 	}
-
 	return result, cursor.Err()
 }
 
@@ -220,6 +430,59 @@ func (s *MongoMessageStore) DeleteExpired(ctx context.Context, before time.Time)
 	return err
 }
 
+// ListRetentionConvs 列出存在早于 before 的消息的会话（Distinct 后按 convId 排序分页）。
+func (s *MongoMessageStore) ListRetentionConvs(ctx context.Context, before time.Time, afterConvID string, limit int) ([]string, error) {
+	filter := bson.D{
+		{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: before}}},
+		{Key: "conv_id", Value: bson.D{{Key: "$gt", Value: afterConvID}}},
+	}
+	vals, err := s.collection().Distinct(ctx, "conv_id", filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if id, ok := v.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+// ListOlderThan 拉取会话内早于 before 的消息（不过滤撤回/过期），按 seq 升序。
+func (s *MongoMessageStore) ListOlderThan(ctx context.Context, convID string, before time.Time, limit int) ([]*models.Message, error) {
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "timestamp", Value: bson.D{{Key: "$lt", Value: before}}}}
+	cursor, err := s.collection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	return decodeMessages(ctx, cursor)
+}
+
+// PurgeMessages 物理删除消息及其编辑历史与表情回应。
+func (s *MongoMessageStore) PurgeMessages(ctx context.Context, convID string, serverMsgIDs []string) (int64, error) {
+	if len(serverMsgIDs) == 0 {
+		return 0, nil
+	}
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: bson.D{{Key: "$in", Value: serverMsgIDs}}}}
+	if _, err := s.reactionCollection().DeleteMany(ctx, filter); err != nil {
+		return 0, err
+	}
+	if _, err := s.revisionCollection().DeleteMany(ctx, filter); err != nil {
+		return 0, err
+	}
+	res, err := s.collection().DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
 // RecallBySeq 按 seq 撤回，仅当 burn_after_read=true。
 func (s *MongoMessageStore) RecallBySeq(ctx context.Context, convID string, seq int64) error {
 	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "seq", Value: seq}, {Key: "burn_after_read", Value: true}}
@@ -236,25 +499,190 @@ func (s *MongoMessageStore) GetBySeq(ctx context.Context, convID string, seq int
 	if err != nil {
 		return nil, err
 	}
-	msg := &models.Message{
-		ServerMsgID:   doc.ServerMsgID,
-		ClientMsgID:   doc.ClientMsgID,
-		ConvID:        doc.ConvID,
-		ConvType:      models.ConversationType(doc.ConvType),
-		FromUserID:    doc.FromUserID,
-		ToUserID:      doc.ToUserID,
-		GroupID:       doc.GroupID,
-		Seq:           doc.Seq,
-		Timestamp:     doc.Timestamp,
-		Type:          doc.Type,
-		Payload:       doc.Payload,
-		Recalled:      doc.Recalled,
-		StreamID:      doc.StreamID,
-		StreamSeq:     doc.StreamSeq,
-		StreamStatus:  doc.StreamStatus,
-		IsStreaming:   doc.IsStreaming,
-		ExpireAt:      doc.ExpireAt,
-		BurnAfterRead: doc.BurnAfterRead,
+	return doc.toModel(), nil
+}
+
+// MaxSeq 查询会话已入库消息的最大 seq（序列生成器冷启动下限）。
+func (s *MongoMessageStore) MaxSeq(ctx context.Context, convID string) (int64, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(bson.D{{Key: "seq", Value: 1}})
+	var doc mongoMessage
+	err := s.collection().FindOne(ctx, bson.D{{Key: "conv_id", Value: convID}}, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// GetByClientID 按 convId + clientMsgId 查询单条消息（幂等重发时取回已入库的消息）。
+func (s *MongoMessageStore) GetByClientID(ctx context.Context, convID, clientMsgID string) (*models.Message, error) {
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "client_msg_id", Value: clientMsgID}}
+	var doc mongoMessage
+	if err := s.collection().FindOne(ctx, filter).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.toModel(), nil
+}
+
+// GetByID 按 convId + serverMsgId 查询单条消息（不过滤撤回状态，由调用方判断）。
+func (s *MongoMessageStore) GetByID(ctx context.Context, convID, serverMsgID string) (*models.Message, error) {
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: serverMsgID}}
+	var doc mongoMessage
+	if err := s.collection().FindOne(ctx, filter).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.toModel(), nil
+}
+
+// SetPreviews 回填链接预览（previews 为空时清空），以 version 防止覆盖编辑后的消息。
+func (s *MongoMessageStore) SetPreviews(ctx context.Context, convID, serverMsgID string, version int, previews []*models.LinkPreview) (bool, error) {
+	var versionCond interface{} = version
+	if version == 0 {
+		versionCond = bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+	}
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: serverMsgID}, {Key: "version", Value: versionCond}}
+	var update bson.D
+	if len(previews) > 0 {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "previews", Value: previews}}}}
+	} else {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "previews", Value: ""}}}}
+	}
+	res, err := s.collection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// Edit 替换消息载荷：先按 (server_msg_id, version) 幂等写入旧版本，再以 version 做乐观锁更新。
+func (s *MongoMessageStore) Edit(ctx context.Context, convID, serverMsgID string, payload []byte, fromVersion int, editorID string, at time.Time) error {
+	old, err := s.GetByID(ctx, convID, serverMsgID)
+	if err != nil {
+		return err
+	}
+	if old.Version != fromVersion || old.Recalled {
+		return ErrVersionConflict
+	}
+
+	rev := &mongoRevision{ServerMsgID: serverMsgID, ConvID: convID, Version: fromVersion, Payload: old.Payload, EditedBy: editorID, CreatedAt: at}
+	revFilter := bson.D{{Key: "server_msg_id", Value: serverMsgID}, {Key: "version", Value: fromVersion}}
+	if _, err := s.revisionCollection().UpdateOne(ctx, revFilter, bson.D{{Key: "$setOnInsert", Value: rev}}, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	// version 为 0 时历史文档可能不存在该字段（omitempty），null 同时匹配缺失字段
+	var versionCond interface{} = fromVersion
+	if fromVersion == 0 {
+		versionCond = bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+	}
+	filter := bson.D{
+		{Key: "conv_id", Value: convID},
+		{Key: "server_msg_id", Value: serverMsgID},
+		{Key: "version", Value: versionCond},
+		{Key: "recalled", Value: false},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "payload", Value: payload},
+		{Key: "edited", Value: true},
+		{Key: "version", Value: fromVersion + 1},
+		{Key: "edited_at", Value: at},
+	}}}
+	res, err := s.collection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// ListRevisions 列出消息的历史版本（按版本升序）。
+func (s *MongoMessageStore) ListRevisions(ctx context.Context, convID, serverMsgID string) ([]*models.MessageRevision, error) {
+	filter := bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: serverMsgID}}
+	cursor, err := s.revisionCollection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var res []*models.MessageRevision
+	for cursor.Next(ctx) {
+		var doc mongoRevision
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		res = append(res, &models.MessageRevision{ServerMsgID: doc.ServerMsgID, ConvID: doc.ConvID, Version: doc.Version, Payload: doc.Payload, EditedBy: doc.EditedBy, CreatedAt: doc.CreatedAt})
+	}
+	return res, cursor.Err()
+}
+
+// AddReaction 添加表情回应（upsert）；已存在时返回 false。
+func (s *MongoMessageStore) AddReaction(ctx context.Context, r *models.MessageReaction) (bool, error) {
+	filter := bson.D{
+		{Key: "conv_id", Value: r.ConvID},
+		{Key: "server_msg_id", Value: r.ServerMsgID},
+		{Key: "emoji", Value: r.Emoji},
+		{Key: "user_id", Value: r.UserID},
+	}
+	doc := &mongoReaction{ConvID: r.ConvID, ServerMsgID: r.ServerMsgID, Emoji: r.Emoji, UserID: r.UserID, CreatedAt: r.CreatedAt}
+	res, err := s.reactionCollection().UpdateOne(ctx, filter, bson.D{{Key: "$setOnInsert", Value: doc}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// RemoveReaction 取消表情回应；不存在时返回 false。
+func (s *MongoMessageStore) RemoveReaction(ctx context.Context, convID, serverMsgID, emoji, userID string) (bool, error) {
+	filter := bson.D{
+		{Key: "conv_id", Value: convID},
+		{Key: "server_msg_id", Value: serverMsgID},
+		{Key: "emoji", Value: emoji},
+		{Key: "user_id", Value: userID},
+	}
+	res, err := s.reactionCollection().DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// CountReactions 按消息聚合表情回应计数（按首次回应时间排序），userID 用于标记当前用户是否回应过。
+func (s *MongoMessageStore) CountReactions(ctx context.Context, convID string, serverMsgIDs []string, userID string) (map[string][]*models.ReactionCount, error) {
+	res := make(map[string][]*models.ReactionCount)
+	if len(serverMsgIDs) == 0 {
+		return res, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: bson.D{{Key: "$in", Value: serverMsgIDs}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "msg", Value: "$server_msg_id"}, {Key: "emoji", Value: "$emoji"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "mine", Value: bson.D{{Key: "$max", Value: bson.D{{Key: "$eq", Value: bson.A{"$user_id", userID}}}}}},
+			{Key: "first", Value: bson.D{{Key: "$min", Value: "$created_at"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "first", Value: 1}}}},
+	}
+	cursor, err := s.reactionCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Msg   string `bson:"msg"`
+				Emoji string `bson:"emoji"`
+			} `bson:"_id"`
+			Count int  `bson:"count"`
+			Mine  bool `bson:"mine"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		res[row.ID.Msg] = append(res[row.ID.Msg], &models.ReactionCount{Emoji: row.ID.Emoji, Count: row.Count, Reacted: row.Mine})
 	}
-	return msg, nil
+	return res, cursor.Err()
 }
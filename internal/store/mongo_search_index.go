@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoSearchIndex 基于 message_terms 集合的倒排索引（每个词项一条文档）。
+type MongoSearchIndex struct{ DB *mongo.Database }
+
+func NewMongoSearchIndex(db *mongo.Database) *MongoSearchIndex {
+	idx := &MongoSearchIndex{DB: db}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = idx.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "term", Value: 1}, {Key: "conv_id", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName("uniq_term_conv_seq"),
+		},
+		{
+			Keys:    bson.D{{Key: "conv_id", Value: 1}, {Key: "server_msg_id", Value: 1}},
+			Options: options.Index().SetName("idx_conv_msg"),
+		},
+	})
+	return idx
+}
+
+type mongoTerm struct {
+	Term        string    `bson:"term"`
+	ConvID      string    `bson:"conv_id"`
+	Seq         int64     `bson:"seq"`
+	ServerMsgID string    `bson:"server_msg_id"`
+	FromUserID  string    `bson:"from_user_id"`
+	Ts          time.Time `bson:"ts"`
+}
+
+func (s *MongoSearchIndex) collection() *mongo.Collection {
+	return s.DB.Collection("message_terms")
+}
+
+// Index 批量 upsert 词项（唯一索引保证幂等）。
+func (s *MongoSearchIndex) Index(ctx context.Context, p *SearchPosting, terms []string) error {
+	if len(terms) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(terms))
+	for _, t := range terms {
+		doc := &mongoTerm{Term: t, ConvID: p.ConvID, Seq: p.Seq, ServerMsgID: p.ServerMsgID, FromUserID: p.FromUserID, Ts: p.Timestamp}
+		filter := bson.D{{Key: "term", Value: t}, {Key: "conv_id", Value: p.ConvID}, {Key: "seq", Value: p.Seq}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.D{{Key: "$setOnInsert", Value: doc}}).SetUpsert(true))
+	}
+	_, err := s.collection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// Remove 删除一条消息的全部词项。
+func (s *MongoSearchIndex) Remove(ctx context.Context, convID, serverMsgID string) error {
+	_, err := s.collection().DeleteMany(ctx, bson.D{{Key: "conv_id", Value: convID}, {Key: "server_msg_id", Value: serverMsgID}})
+	return err
+}
+
+// Search 聚合：按 (conv_id, seq) 分组，要求命中的不同词项数等于查询词项数。
+func (s *MongoSearchIndex) Search(ctx context.Context, q *SearchQuery) ([]*SearchPosting, error) {
+	if len(q.Terms) == 0 || len(q.ConvIDs) == 0 {
+		return nil, nil
+	}
+	match := bson.D{
+		{Key: "term", Value: bson.D{{Key: "$in", Value: q.Terms}}},
+		{Key: "conv_id", Value: bson.D{{Key: "$in", Value: q.ConvIDs}}},
+	}
+	if q.From != "" {
+		match = append(match, bson.E{Key: "from_user_id", Value: q.From})
+	}
+	ts := bson.D{}
+	if !q.Start.IsZero() {
+		ts = append(ts, bson.E{Key: "$gte", Value: q.Start})
+	}
+	if !q.End.IsZero() {
+		ts = append(ts, bson.E{Key: "$lt", Value: q.End})
+	}
+	if len(ts) > 0 {
+		match = append(match, bson.E{Key: "ts", Value: ts})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "conv_id", Value: "$conv_id"}, {Key: "seq", Value: "$seq"}}},
+			{Key: "terms", Value: bson.D{{Key: "$addToSet", Value: "$term"}}},
+			{Key: "server_msg_id", Value: bson.D{{Key: "$first", Value: "$server_msg_id"}}},
+			{Key: "from_user_id", Value: bson.D{{Key: "$first", Value: "$from_user_id"}}},
+			{Key: "ts", Value: bson.D{{Key: "$first", Value: "$ts"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "terms", Value: bson.D{{Key: "$size", Value: len(q.Terms)}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "ts", Value: -1}}}},
+		{{Key: "$skip", Value: q.Offset}},
+		{{Key: "$limit", Value: q.Limit}},
+	}
+	cursor, err := s.collection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var res []*SearchPosting
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				ConvID string `bson:"conv_id"`
+				Seq    int64  `bson:"seq"`
+			} `bson:"_id"`
+			ServerMsgID string    `bson:"server_msg_id"`
+			FromUserID  string    `bson:"from_user_id"`
+			Ts          time.Time `bson:"ts"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		res = append(res, &SearchPosting{ConvID: row.ID.ConvID, Seq: row.ID.Seq, ServerMsgID: row.ServerMsgID, FromUserID: row.FromUserID, Timestamp: row.Ts})
+	}
+	return res, cursor.Err()
+}
@@ -19,6 +19,53 @@ func (s *ReceiptStore) UpsertReadSeq(ctx context.Context, userID, convID string,
 	return err
 }
 
+// 推进已读水位并返回推进前的值（行锁保证多端并发上报时不重复计算增量）
+func (s *ReceiptStore) AdvanceReadSeq(ctx context.Context, userID, convID string, seq int64) (int64, error) {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var prev int64
+	err = tx.QueryRowContext(ctx, `SELECT seq FROM read_receipts WHERE user_id=? AND conv_id=? FOR UPDATE`, userID, convID).Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if seq > prev {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO read_receipts(user_id, conv_id, seq) VALUES(?,?,?) ON DUPLICATE KEY UPDATE seq=IF(VALUES(seq) > seq, VALUES(seq), seq)`, userID, convID, seq); err != nil {
+			return 0, err
+		}
+	}
+	return prev, tx.Commit()
+}
+
+// 批量查询多个用户在会话中的已读 seq（未读过的用户不在结果中）
+func (s *ReceiptStore) ListReadSeqs(ctx context.Context, convID string, userIDs []string) (map[string]int64, error) {
+	res := make(map[string]int64, len(userIDs))
+	if len(userIDs) == 0 {
+		return res, nil
+	}
+	args := make([]any, 0, len(userIDs)+1)
+	args = append(args, convID)
+	for _, id := range userIDs {
+		args = append(args, id)
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT user_id, seq FROM read_receipts WHERE conv_id=? AND user_id IN (`+placeholders(len(userIDs))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		var seq int64
+		if err := rows.Scan(&uid, &seq); err != nil {
+			return nil, err
+		}
+		res[uid] = seq
+	}
+	return res, rows.Err()
+}
+
 func (s *ReceiptStore) GetReadSeq(ctx context.Context, userID, convID string) (int64, error) {
 	var seq sql.NullInt64
 	err := s.DB.QueryRowContext(ctx, `SELECT seq FROM read_receipts WHERE user_id=? AND conv_id=?`, userID, convID).Scan(&seq)
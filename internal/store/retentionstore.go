@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"go-im/internal/models"
+)
+
+// 消息保留策略存储（主库）
+type RetentionStore struct{ DB *sql.DB }
+
+func NewRetentionStore(db *sql.DB) *RetentionStore { return &RetentionStore{DB: db} }
+
+// 新增或更新策略（按 scope + target_id 唯一）
+func (s *RetentionStore) Upsert(ctx context.Context, p *models.RetentionPolicy) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO retention_policies(scope, target_id, days, action, updated_by, updated_at) VALUES(?,?,?,?,?,?) ON DUPLICATE KEY UPDATE days=VALUES(days), action=VALUES(action), updated_by=VALUES(updated_by), updated_at=VALUES(updated_at)`, p.Scope, p.TargetID, p.Days, p.Action, p.UpdatedBy, p.UpdatedAt)
+	return err
+}
+
+// 删除策略（回退到上一级策略）；不存在返回 false
+func (s *RetentionStore) Delete(ctx context.Context, scope, targetID string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM retention_policies WHERE scope=? AND target_id=?`, scope, targetID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 全部策略
+func (s *RetentionStore) List(ctx context.Context) ([]*models.RetentionPolicy, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT scope, target_id, days, action, updated_by, updated_at FROM retention_policies ORDER BY scope, target_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*models.RetentionPolicy
+	for rows.Next() {
+		p := &models.RetentionPolicy{}
+		if err := rows.Scan(&p.Scope, &p.TargetID, &p.Days, &p.Action, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
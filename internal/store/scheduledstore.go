@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go-im/internal/models"
+)
+
+// 定时消息存储（主库）；状态流转均以 status 作为 CAS 条件，避免编辑/取消与发送并发冲突。
+type ScheduledStore struct{ DB *sql.DB }
+
+func NewScheduledStore(db *sql.DB) *ScheduledStore { return &ScheduledStore{DB: db} }
+
+const scheduledColumns = `id, user_id, conv_id, conv_type, to_user_id, group_id, type, payload, send_at, status, server_msg_id, error, created_at, updated_at`
+
+func scanScheduled(sc interface{ Scan(dest ...any) error }) (*models.ScheduledMessage, error) {
+	m := &models.ScheduledMessage{}
+	var convType string
+	if err := sc.Scan(&m.ID, &m.UserID, &m.ConvID, &convType, &m.ToUserID, &m.GroupID, &m.Type, &m.Payload, &m.SendAt, &m.Status, &m.ServerMsgID, &m.Error, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return nil, err
+	}
+	m.ConvType = models.ConversationType(convType)
+	return m, nil
+}
+
+// 新建定时消息
+func (s *ScheduledStore) Create(ctx context.Context, m *models.ScheduledMessage) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO scheduled_messages(`+scheduledColumns+`) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`, m.ID, m.UserID, m.ConvID, string(m.ConvType), m.ToUserID, m.GroupID, m.Type, m.Payload, m.SendAt, m.Status, m.ServerMsgID, m.Error, m.CreatedAt, m.UpdatedAt)
+	return err
+}
+
+// 按 ID 查询（限定所属用户）
+func (s *ScheduledStore) Get(ctx context.Context, userID, id string) (*models.ScheduledMessage, error) {
+	return scanScheduled(s.DB.QueryRowContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id=? AND user_id=?`, id, userID))
+}
+
+// 用户定时消息列表（按发送时间升序）；status 为空时返回全部
+func (s *ScheduledStore) ListByUser(ctx context.Context, userID, status string, limit int) ([]*models.ScheduledMessage, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := `SELECT ` + scheduledColumns + ` FROM scheduled_messages WHERE user_id=?`
+	args := []any{userID}
+	if status != "" {
+		q += ` AND status=?`
+		args = append(args, status)
+	}
+	q += ` ORDER BY send_at ASC LIMIT ?`
+	args = append(args, limit)
+	rows, err := s.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*models.ScheduledMessage
+	for rows.Next() {
+		m, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// 用户待发送的定时消息数
+func (s *ScheduledStore) CountPending(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, `SELECT COUNT(1) FROM scheduled_messages WHERE user_id=? AND status=?`, userID, models.ScheduledStatusPending).Scan(&n)
+	return n, err
+}
+
+// 编辑待发送的定时消息（载荷与发送时间）；非 pending 返回 false
+func (s *ScheduledStore) UpdatePending(ctx context.Context, userID, id string, payload []byte, sendAt time.Time) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `UPDATE scheduled_messages SET payload=?, send_at=?, updated_at=? WHERE id=? AND user_id=? AND status=?`, payload, sendAt, time.Now(), id, userID, models.ScheduledStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 取消待发送的定时消息；非 pending 返回 false
+func (s *ScheduledStore) Cancel(ctx context.Context, userID, id string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `UPDATE scheduled_messages SET status=?, updated_at=? WHERE id=? AND user_id=? AND status=?`, models.ScheduledStatusCanceled, time.Now(), id, userID, models.ScheduledStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 到期待发送的定时消息（按发送时间升序）
+func (s *ScheduledStore) ListDue(ctx context.Context, now time.Time, limit int) ([]*models.ScheduledMessage, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE status=? AND send_at<=? ORDER BY send_at ASC LIMIT ?`, models.ScheduledStatusPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*models.ScheduledMessage
+	for rows.Next() {
+		m, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// 领取一条到期消息（pending → sending）；已被领取/编辑/取消返回 false
+func (s *ScheduledStore) Claim(ctx context.Context, id string, now time.Time) (bool, error) {
+	res, err := s.DB.ExecContext(ctx, `UPDATE scheduled_messages SET status=?, updated_at=? WHERE id=? AND status=? AND send_at<=?`, models.ScheduledStatusSending, time.Now(), id, models.ScheduledStatusPending, now)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 记录发送结果（sending → sent/failed）
+func (s *ScheduledStore) Finish(ctx context.Context, id, status, serverMsgID, errCode string) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE scheduled_messages SET status=?, server_msg_id=?, error=?, updated_at=? WHERE id=? AND status=?`, status, serverMsgID, errCode, time.Now(), id, models.ScheduledStatusSending)
+	return err
+}
+
+// 将长时间停留在 sending 的记录退回 pending（实例在发送中途退出，发送可能已成功）；返回处理条数
+func (s *ScheduledStore) RequeueStale(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.DB.ExecContext(ctx, `UPDATE scheduled_messages SET status=?, updated_at=? WHERE status=? AND updated_at<?`, models.ScheduledStatusPending, time.Now(), models.ScheduledStatusSending, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SearchPosting 倒排索引中的一条记录：词项 → 会话内消息。
+type SearchPosting struct {
+	ConvID      string
+	ServerMsgID string
+	Seq         int64
+	FromUserID  string
+	Timestamp   time.Time
+}
+
+// SearchQuery 倒排索引查询条件：Terms 之间为 AND 关系，ConvIDs 必填（调用方负责按会话权限收敛）。
+type SearchQuery struct {
+	Terms   []string
+	ConvIDs []string
+	From    string    // 可选：发送者
+	Start   time.Time // 可选：起始时间（含）
+	End     time.Time // 可选：结束时间（不含）
+	Offset  int
+	Limit   int
+}
+
+// SearchIndex 消息全文检索的倒排索引存储，与消息存储放在同一数据库（SQL/Mongo 各一份实现）。
+type SearchIndex interface {
+	// Index 写入一条消息的全部词项（幂等）。
+	Index(ctx context.Context, p *SearchPosting, terms []string) error
+	// Remove 删除一条消息的全部词项（编辑重建索引时使用）。
+	Remove(ctx context.Context, convID, serverMsgID string) error
+	// Search 返回同时命中全部词项的消息，按时间倒序。
+	Search(ctx context.Context, q *SearchQuery) ([]*SearchPosting, error)
+}
+
+// SQLSearchIndex 基于 message_search_index 表的倒排索引（MySQL/TiDB）。
+type SQLSearchIndex struct{ DB *sql.DB }
+
+func NewSQLSearchIndex(db *sql.DB) *SQLSearchIndex { return &SQLSearchIndex{DB: db} }
+
+// Index 批量写入词项；主键 (term, conv_id, seq) 保证重复写入无副作用。
+func (s *SQLSearchIndex) Index(ctx context.Context, p *SearchPosting, terms []string) error {
+	if len(terms) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(`INSERT IGNORE INTO message_search_index(term, conv_id, seq, server_msg_id, from_user_id, ts) VALUES`)
+	args := make([]any, 0, len(terms)*6)
+	for i, t := range terms {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString("(?,?,?,?,?,?)")
+		args = append(args, t, p.ConvID, p.Seq, p.ServerMsgID, p.FromUserID, p.Timestamp)
+	}
+	_, err := s.DB.ExecContext(ctx, sb.String(), args...)
+	return err
+}
+
+// Remove 删除一条消息的全部词项。
+func (s *SQLSearchIndex) Remove(ctx context.Context, convID, serverMsgID string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM message_search_index WHERE conv_id=? AND server_msg_id=?`, convID, serverMsgID)
+	return err
+}
+
+// Search 以 term IN (...) 取候选，按消息分组后要求命中全部词项。
+func (s *SQLSearchIndex) Search(ctx context.Context, q *SearchQuery) ([]*SearchPosting, error) {
+	if len(q.Terms) == 0 || len(q.ConvIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]any, 0, len(q.Terms)+len(q.ConvIDs)+6)
+	for _, t := range q.Terms {
+		args = append(args, t)
+	}
+	for _, id := range q.ConvIDs {
+		args = append(args, id)
+	}
+	where := `term IN (` + placeholders(len(q.Terms)) + `) AND conv_id IN (` + placeholders(len(q.ConvIDs)) + `)`
+	if q.From != "" {
+		where += ` AND from_user_id=?`
+		args = append(args, q.From)
+	}
+	if !q.Start.IsZero() {
+		where += ` AND ts>=?`
+		args = append(args, q.Start)
+	}
+	if !q.End.IsZero() {
+		where += ` AND ts<?`
+		args = append(args, q.End)
+	}
+	args = append(args, len(q.Terms), q.Limit, q.Offset)
+	rows, err := s.DB.QueryContext(ctx, `SELECT conv_id, seq, MAX(server_msg_id), MAX(from_user_id), MAX(ts) AS t FROM message_search_index WHERE `+where+` GROUP BY conv_id, seq HAVING COUNT(DISTINCT term)=? ORDER BY t DESC LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*SearchPosting
+	for rows.Next() {
+		p := &SearchPosting{}
+		if err := rows.Scan(&p.ConvID, &p.Seq, &p.ServerMsgID, &p.FromUserID, &p.Timestamp); err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
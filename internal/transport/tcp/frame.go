@@ -0,0 +1,104 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 帧格式（大端序）：
+//
+//	+----------+---------+---------+---------+---------+----------+-----------+
+//	| len(4)   | ver(1)  | cmd(1)  | codec(1)| flags(1)| seq(4)   | body(len) |
+//	+----------+---------+---------+---------+---------+----------+-----------+
+//
+// - len 仅为 body 长度，不含 12 字节头部
+// - seq 由客户端为每个请求递增分配，服务端应答（CmdAuthAck/CmdHeartbeatAck/CmdResponse）原样带回；服务端推送 seq=0
+// - codec 标识 body 编码，当前仅支持 CodecJSON；flags 保留，须为 0
+const (
+	HeaderSize     = 12
+	ProtocolV1     = 1
+	CodecJSON      = 0
+	DefaultMaxBody = 1 << 20
+)
+
+// 帧命令
+const (
+	CmdAuth         byte = 0x01 // c→s 认证：{"token","deviceId"}，须为连接的第一帧
+	CmdAuthAck      byte = 0x02 // s→c 认证成功：{"userId","deviceId","heartbeatSec","idleTimeoutSec"}
+	CmdHeartbeat    byte = 0x03 // c→s 心跳（body 可为空）
+	CmdHeartbeatAck byte = 0x04 // s→c 心跳应答：{"ts"}
+	CmdRequest      byte = 0x10 // c→s 上行动作：{"action","data"}，与 WebSocket 上行完全一致
+	CmdResponse     byte = 0x11 // s→c 处理该请求产生的应答（ack/error/sync_batch 等，seq 同请求）
+	CmdPush         byte = 0x12 // s→c 下行推送（新消息与各类事件，负载同 WebSocket 下行）
+	CmdClose        byte = 0x7F // 双向 优雅关闭：{"code","reason"}，发送方随后关闭连接
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("tcp: frame too large")
+	ErrUnsupportedVersion = errors.New("tcp: unsupported protocol version")
+	ErrUnsupportedCodec   = errors.New("tcp: unsupported codec")
+)
+
+// Frame 一个协议帧。
+type Frame struct {
+	Version byte
+	Cmd     byte
+	Codec   byte
+	Flags   byte
+	Seq     uint32
+	Body    []byte
+}
+
+// ReadFrame 读取一帧；body 超过 maxBody 返回 ErrFrameTooLarge（此时连接应关闭）。
+func ReadFrame(r io.Reader, maxBody int) (*Frame, error) {
+	var h [HeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(h[0:4])
+	f := &Frame{Version: h[4], Cmd: h[5], Codec: h[6], Flags: h[7], Seq: binary.BigEndian.Uint32(h[8:12])}
+	if f.Version != ProtocolV1 {
+		return f, ErrUnsupportedVersion
+	}
+	if maxBody > 0 && int64(n) > int64(maxBody) {
+		return f, ErrFrameTooLarge
+	}
+	if f.Codec != CodecJSON {
+		return f, ErrUnsupportedCodec
+	}
+	if n > 0 {
+		f.Body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// WriteFrame 写出一帧（头部与 body 合并为一次写，避免被拆成两个 TCP 段）。
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf, err := EncodeFrame(f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// EncodeFrame 将一帧编码为头部 + body。
+func EncodeFrame(f *Frame) ([]byte, error) {
+	if uint64(len(f.Body)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("tcp: body too large: %d", len(f.Body))
+	}
+	buf := make([]byte, HeaderSize+len(f.Body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(f.Body)))
+	buf[4] = f.Version
+	buf[5] = f.Cmd
+	buf[6] = f.Codec
+	buf[7] = f.Flags
+	binary.BigEndian.PutUint32(buf[8:12], f.Seq)
+	copy(buf[HeaderSize:], f.Body)
+	return buf, nil
+}
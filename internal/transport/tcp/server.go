@@ -3,52 +3,311 @@ package tcp
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"net"
-	"strings"
+	"sync"
+	"time"
 
 	"go-im/internal/auth"
-	"go-im/internal/cache"
+	"go-im/internal/transport/ws"
 )
 
+// 连接默认参数（可通过 Server 字段覆盖）
+const (
+	defaultHeartbeat   = 30 * time.Second
+	defaultIdleTimeout = 90 * time.Second
+	authTimeout        = 10 * time.Second
+	writeTimeout       = 10 * time.Second
+)
+
+// 关闭原因码（CmdClose 的 code）
+const (
+	CloseNormal             = "NORMAL"
+	CloseAuthRequired       = "AUTH_REQUIRED"
+	CloseUnauthorized       = "UNAUTHORIZED"
+	CloseProtocolError      = "PROTOCOL_ERROR"
+	CloseFrameTooLarge      = "FRAME_TOO_LARGE"
+	CloseUnsupportedVersion = "UNSUPPORTED_VERSION"
+	CloseUnsupportedCodec   = "UNSUPPORTED_CODEC"
+	CloseIdleTimeout        = "IDLE_TIMEOUT"
+	CloseServerShutdown     = "SERVER_SHUTDOWN"
+	CloseSlowConsumer       = "SLOW_CONSUMER" // 下行队列写满被断开，客户端应重连并 sync
+)
+
+// Server 基于长度前缀帧的 TCP 接入（协议见 frame.go），供原生移动端/IoT 客户端绕过 WebSocket：
+// - 第一帧须为 CmdAuth（JWT + deviceId），认证后上线，断开时下线
+// - CmdRequest 的动作与 WebSocket 完全一致，由 Gateway（ws.Server）的 Session 统一处理，应答以 CmdResponse 带回请求 seq
+// - 下行投递经 Gateway 的节点 Hub 扇出，以 CmdPush 推送，投递确认（deliver_ack）与重投同 WebSocket；推送与应答经连接的有界下行队列批量写出，队列写满按 Gateway 的慢连接策略丢弃或以 SLOW_CONSUMER 断开
+// - 客户端按 heartbeatSec 发送 CmdHeartbeat（同时续期设备在线状态）；IdleTimeout 内未收到任何帧即关闭连接
+// - 任一方可发送 CmdClose 优雅关闭；ctx 取消时向所有连接发送 SERVER_SHUTDOWN 后关闭
 type Server struct {
 	Addr      string
 	JWTSecret string
+	Gateway   *ws.Server // 上行动作处理（与 WebSocket 共用）
+
+	Heartbeat   time.Duration // 建议客户端心跳间隔（认证应答中下发）
+	IdleTimeout time.Duration // 读空闲超时
+	MaxBody     int           // 单帧 body 上限（字节）
+
+	wg sync.WaitGroup
 }
 
 func (s *Server) Start(ctx context.Context) error {
 	if s.Addr == "" {
 		return nil
 	}
+	if s.Gateway == nil {
+		return errors.New("tcp: gateway is required")
+	}
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
+	log.Printf("TCP listening: addr=%s", s.Addr)
 	go func() { <-ctx.Done(); ln.Close() }()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				s.wg.Wait()
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
 			return err
 		}
-		go s.handleConn(ctx, conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) heartbeat() time.Duration {
+	if s.Heartbeat > 0 {
+		return s.Heartbeat
+	}
+	return defaultHeartbeat
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func (s *Server) maxBody() int {
+	if s.MaxBody > 0 {
+		return s.MaxBody
+	}
+	return DefaultMaxBody
+}
+
+// frameConn 帧写通道：写锁串行化，每次写设置写超时。
+// 推送与请求应答经 queue 入队，由写协程将同一批帧合并为一次 writev 写出；认证、心跳应答与关闭帧直接写。
+type frameConn struct {
+	conn  net.Conn
+	mu    sync.Mutex
+	queue *ws.SendQueue
+}
+
+func (c *frameConn) write(cmd byte, seq uint32, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return WriteFrame(c.conn, &Frame{Version: ProtocolV1, Cmd: cmd, Codec: CodecJSON, Seq: seq, Body: body})
+}
+
+func (c *frameConn) writeJSON(cmd byte, seq uint32, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(cmd, seq, b)
+}
+
+// close 发送 CmdClose 后关闭连接。
+func (c *frameConn) close(code, reason string) {
+	_ = c.writeJSON(CmdClose, 0, map[string]string{"code": code, "reason": reason})
+	c.conn.Close()
+}
+
+// flush 写协程写出一批已编码的帧。
+func (c *frameConn) flush(batch [][]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	bufs := net.Buffers(batch)
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+// evict 慢连接：先打断阻塞中的写协程，再发送 SLOW_CONSUMER 后关闭。
+func (c *frameConn) evict() {
+	c.conn.SetWriteDeadline(time.Now())
+	c.close(CloseSlowConsumer, "slow consumer, resync required")
+}
+
+// frame 将下行信封按 JSON 编码为帧（新消息为裸 Deliver，同 WebSocket JSON 协议）。
+func (c *frameConn) frame(cmd byte, seq uint32, envelope []byte) ([]byte, error) {
+	b, _ := ws.JSONCodec.Encode(envelope)
+	return EncodeFrame(&Frame{Version: ProtocolV1, Cmd: cmd, Codec: CodecJSON, Seq: seq, Body: b})
+}
+
+func (c *frameConn) send(cmd byte, seq uint32, envelope []byte) error {
+	b, err := c.frame(cmd, seq, envelope)
+	if err != nil {
+		return err
 	}
+	return c.queue.Push(b)
+}
+
+func (c *frameConn) sendWait(ctx context.Context, cmd byte, seq uint32, envelope []byte) error {
+	b, err := c.frame(cmd, seq, envelope)
+	if err != nil {
+		return err
+	}
+	return c.queue.PushWait(ctx, b)
+}
+
+// pushConn 下行推送（实现 ws.Conn）。
+type pushConn struct{ c *frameConn }
+
+func (p pushConn) Send(envelope []byte) error { return p.c.send(CmdPush, 0, envelope) }
+
+// replyConn 请求应答（实现 ws.Conn），带回请求 seq；离线同步等大批量应答队列满时等待。
+type replyConn struct {
+	c   *frameConn
+	seq uint32
+}
+
+func (r replyConn) Send(envelope []byte) error { return r.c.send(CmdResponse, r.seq, envelope) }
+
+func (r replyConn) SendWait(ctx context.Context, envelope []byte) error {
+	return r.c.sendWait(ctx, CmdResponse, r.seq, envelope)
+}
+
+// authPayload CmdAuth 负载
+type authPayload struct {
+	Token    string `json:"token"`
+	DeviceID string `json:"deviceId"`
 }
 
 func (s *Server) handleConn(ctx context.Context, c net.Conn) {
+	fc := &frameConn{conn: c}
 	defer c.Close()
 	reader := bufio.NewReader(c)
-	line, _ := reader.ReadString('\n')
-	line = strings.TrimSpace(line)
-	cl, err := auth.ParseJWT(s.JWTSecret, line)
+
+	// 认证：第一帧须在 authTimeout 内到达
+	c.SetReadDeadline(time.Now().Add(authTimeout))
+	f, err := ReadFrame(reader, s.maxBody())
+	if err != nil {
+		fc.close(closeCodeFor(err), err.Error())
+		return
+	}
+	if f.Cmd != CmdAuth {
+		fc.close(CloseAuthRequired, "first frame must be auth")
+		return
+	}
+	var ap authPayload
+	_ = json.Unmarshal(f.Body, &ap)
+	claims, err := auth.ParseJWT(s.JWTSecret, ap.Token)
 	if err != nil {
+		fc.close(CloseUnauthorized, "invalid token")
 		return
 	}
-	sub := cache.Client().Subscribe(ctx, cache.DeliverChannel(cl.UserID))
+	userID, deviceID := claims.UserID, ap.DeviceID
+	if deviceID == "" {
+		deviceID = "tcp-" + time.Now().Format("150405.000")
+	}
+	if err := fc.writeJSON(CmdAuthAck, f.Seq, map[string]any{"userId": userID, "deviceId": deviceID, "heartbeatSec": int(s.heartbeat() / time.Second), "idleTimeoutSec": int(s.idleTimeout() / time.Second)}); err != nil {
+		return
+	}
+	log.Printf("TCP connected: user=%s device=%s remote=%s", userID, deviceID, c.RemoteAddr())
+	defer log.Printf("TCP disconnected: user=%s device=%s", userID, deviceID)
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// 下行队列与写协程：写出失败时断开（读循环随之退出）
+	fc.queue = s.Gateway.NewSendQueue("tcp", fc.flush, fc.evict)
+	defer fc.queue.Close()
+	go func() {
+		if err := fc.queue.Run(); err != nil {
+			log.Printf("TCP write error: user=%s err=%v", userID, err)
+			c.Close()
+		}
+	}()
+	// 会话：上线（在线状态按 Gateway.PresenceTTL 过期，心跳帧续期）并登记到节点 Hub，下行投递以 CmdPush 推送；退出时注销并下线
+	sess := s.Gateway.NewSession(connCtx, userID, deviceID, pushConn{fc})
+	defer sess.Close()
+
+	// 服务关闭：通知客户端后断开（读循环随之退出）
+	go func() {
+		<-connCtx.Done()
+		if ctx.Err() != nil {
+			fc.close(CloseServerShutdown, "server shutting down")
+		}
+	}()
+
+	// 读循环：每帧刷新空闲超时
 	for {
-		msg, err := sub.ReceiveMessage(ctx)
+		c.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		f, err := ReadFrame(reader, s.maxBody())
 		if err != nil {
+			var ne net.Error
+			switch {
+			case ctx.Err() != nil:
+			case errors.As(err, &ne) && ne.Timeout():
+				fc.close(CloseIdleTimeout, "no frame received within idle timeout")
+			case errors.Is(err, ErrFrameTooLarge), errors.Is(err, ErrUnsupportedVersion), errors.Is(err, ErrUnsupportedCodec):
+				fc.close(closeCodeFor(err), err.Error())
+			default:
+				log.Printf("TCP read error: user=%s err=%v", userID, err)
+			}
 			return
 		}
-		c.Write([]byte(msg.Payload))
-		c.Write([]byte("\n"))
+		switch f.Cmd {
+		case CmdHeartbeat:
+			sess.Heartbeat(connCtx)
+			if err := fc.writeJSON(CmdHeartbeatAck, f.Seq, map[string]int64{"ts": time.Now().UnixMilli()}); err != nil {
+				return
+			}
+		case CmdRequest:
+			var m ws.WSMessage
+			if err := json.Unmarshal(f.Body, &m); err != nil || m.Action == "" {
+				_ = fc.writeJSON(CmdResponse, f.Seq, map[string]any{"action": "error", "data": map[string]string{"code": "INVALID_REQUEST"}})
+				continue
+			}
+			log.Printf("TCP inbound: user=%s action=%s seq=%d size=%d", userID, m.Action, f.Seq, len(f.Body))
+			sess.Dispatch(connCtx, &m, replyConn{c: fc, seq: f.Seq})
+		case CmdClose:
+			fc.close(CloseNormal, "")
+			return
+		default:
+			fc.close(CloseProtocolError, "unexpected command")
+			return
+		}
+	}
+}
+
+// closeCodeFor 将读帧错误映射为关闭原因码。
+func closeCodeFor(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, ErrFrameTooLarge):
+		return CloseFrameTooLarge
+	case errors.Is(err, ErrUnsupportedVersion):
+		return CloseUnsupportedVersion
+	case errors.Is(err, ErrUnsupportedCodec):
+		return CloseUnsupportedCodec
+	case errors.As(err, &ne) && ne.Timeout():
+		return CloseAuthRequired
 	}
+	return CloseProtocolError
 }
@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/models"
+	"go-im/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 投递确认默认参数（可通过 Server.AckTimeout/AckMaxRetries/AckWindow 覆盖）
+const (
+	defaultAckTimeout    = 5 * time.Second
+	defaultAckMaxRetries = 3
+	defaultAckWindow     = 256
+	deliveredMarkTTL     = 24 * time.Hour // delivered 去重标记保留时长（多端只通知一次）
+)
+
+// DeliverAckPayload 客户端确认已收到（已渲染）的下行消息，支持单条或批量。
+type DeliverAckPayload struct {
+	ConvID       string   `json:"convId,omitempty"`
+	ServerMsgID  string   `json:"serverMsgId,omitempty"`
+	ServerMsgIDs []string `json:"serverMsgIds,omitempty"`
+}
+
+// deliveryHeader 从下行信封中识别消息投递（action=message 且已入库的消息）。
+type deliveryHeader struct {
+	ServerMsgID string                  `json:"serverMsgId"`
+	ConvID      string                  `json:"convId"`
+	ConvType    models.ConversationType `json:"convType"`
+	From        string                  `json:"from"`
+	Seq         int64                   `json:"seq"`
+}
+
+// pendingDelivery 等待 deliver_ack 的一条下行消息。
+type pendingDelivery struct {
+	header   deliveryHeader
+	payload  []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// ackWindow 单个连接（设备）的待确认窗口：
+// - 超时未确认按原负载重投，达到最大次数后放弃（客户端可通过 sync 补齐）
+// - 窗口已满时淘汰最早的一条，避免慢客户端无限占用内存
+type ackWindow struct {
+	mu      sync.Mutex
+	items   map[string]*pendingDelivery
+	order   []string
+	limit   int
+	timeout time.Duration
+	retries int
+}
+
+func newAckWindow(limit int, timeout time.Duration, retries int) *ackWindow {
+	return &ackWindow{items: make(map[string]*pendingDelivery), limit: limit, timeout: timeout, retries: retries}
+}
+
+// track 记录一条已写出的下行信封（重投时按连接编码重新编码）；非消息投递（事件、流式分片）返回 false。
+func (w *ackWindow) track(payload []byte) bool {
+	var env services.Envelope
+	if err := json.Unmarshal(payload, &env); err != nil || env.Action != services.ActionMessage {
+		return false
+	}
+	var h deliveryHeader
+	if err := json.Unmarshal(env.Data, &h); err != nil || h.ServerMsgID == "" || h.Seq <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.items[h.ServerMsgID]; !ok {
+		if len(w.order) >= w.limit {
+			delete(w.items, w.order[0])
+			w.order = w.order[1:]
+		}
+		w.order = append(w.order, h.ServerMsgID)
+	}
+	w.items[h.ServerMsgID] = &pendingDelivery{header: h, payload: payload, sentAt: time.Now()}
+	return true
+}
+
+// ack 确认并移出窗口，返回被确认的消息。
+func (w *ackWindow) ack(ids []string) []deliveryHeader {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var acked []deliveryHeader
+	for _, id := range ids {
+		p, ok := w.items[id]
+		if !ok {
+			continue
+		}
+		delete(w.items, id)
+		acked = append(acked, p.header)
+	}
+	if len(acked) > 0 {
+		kept := w.order[:0]
+		for _, id := range w.order {
+			if _, ok := w.items[id]; ok {
+				kept = append(kept, id)
+			}
+		}
+		w.order = kept
+	}
+	return acked
+}
+
+// due 取出已超时需要重投的负载；超过最大重投次数的条目直接丢弃。
+func (w *ackWindow) due(now time.Time) [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out [][]byte
+	kept := w.order[:0]
+	for _, id := range w.order {
+		p := w.items[id]
+		if now.Sub(p.sentAt) < w.timeout {
+			kept = append(kept, id)
+			continue
+		}
+		if p.attempts >= w.retries {
+			log.Printf("WS deliver give up: convId=%s serverMsgId=%s attempts=%d", p.header.ConvID, id, p.attempts)
+			delete(w.items, id)
+			continue
+		}
+		p.attempts++
+		p.sentAt = now
+		out = append(out, p.payload)
+		kept = append(kept, id)
+	}
+	w.order = kept
+	return out
+}
+
+// newAckWindowFor 按 Server 配置创建连接的待确认窗口。
+func (s *Server) newAckWindowFor() *ackWindow {
+	timeout, retries, limit := s.AckTimeout, s.AckMaxRetries, s.AckWindow
+	if timeout <= 0 {
+		timeout = defaultAckTimeout
+	}
+	if retries <= 0 {
+		retries = defaultAckMaxRetries
+	}
+	if limit <= 0 {
+		limit = defaultAckWindow
+	}
+	return newAckWindow(limit, timeout, retries)
+}
+
+// redeliverLoop 定期重投超时未确认的消息，连接关闭（done）后退出。
+func (s *Server) redeliverLoop(userID string, conn Conn, w *ackWindow, done <-chan struct{}) {
+	ticker := time.NewTicker(w.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, b := range w.due(now) {
+				if err := conn.Send(b); err != nil {
+					log.Printf("WS redeliver write error: user=%s err=%v", userID, err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleDeliverAck 处理 deliver_ack：移出待确认窗口；C2C 消息由接收方首次确认时向发送者推送 delivered 事件。
+func (s *Server) handleDeliverAck(ctx context.Context, userID, deviceID string, w *ackWindow, p *DeliverAckPayload) {
+	ids := p.ServerMsgIDs
+	if p.ServerMsgID != "" {
+		ids = append(ids, p.ServerMsgID)
+	}
+	for _, h := range w.ack(ids) {
+		if h.ConvType != models.ConversationTypeC2C || h.From == "" || h.From == userID {
+			continue
+		}
+		first, err := cache.Client().SetNX(ctx, "im:delivered:"+h.ServerMsgID, deviceID, deliveredMarkTTL).Result()
+		if err != nil || !first {
+			continue
+		}
+		evt, _ := json.Marshal(gin.H{"action": "delivered", "data": gin.H{"convId": h.ConvID, "serverMsgId": h.ServerMsgID, "seq": h.Seq, "to": userID, "ts": time.Now().UnixMilli()}})
+		if err := cache.DeliverToUser(ctx, h.From, evt); err != nil {
+			log.Printf("WS delivered publish error: from=%s serverMsgId=%s err=%v", h.From, h.ServerMsgID, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"go-im/internal/services"
+
+	"github.com/gorilla/websocket"
+)
+
+// 通过 Sec-WebSocket-Protocol 协商的子协议；客户端未携带或均不支持时使用 JSON
+const (
+	SubprotocolJSON     = "im.json.v1"
+	SubprotocolProtobuf = "im.protobuf.v1"
+)
+
+// ActionBatch 合并帧：data 依次为多个已编码的下行帧（仅对以 batch=1 建立的连接下发）
+const ActionBatch = "batch"
+
+// Codec 连接的线上编码：
+// - Encode 将编码无关的下行信封（services.Envelope 的 JSON，来自投递通道或动作应答）编码为一帧
+// - EncodeBatch 将多个已编码的帧合并为一个 batch 帧
+// - Decode 将一帧上行数据解码为 WSMessage（Data 统一为 JSON，动作处理与编码无关）
+type Codec interface {
+	Subprotocol() string
+	FrameType() int // websocket.TextMessage 或 websocket.BinaryMessage
+	Encode(envelope []byte) ([]byte, error)
+	EncodeBatch(frames [][]byte) ([]byte, error)
+	Decode(frame []byte) (*WSMessage, error)
+}
+
+// JSONCodec 默认编码：事件原样下发 {action, data}，新消息下发裸 Deliver（兼容既有客户端）。
+var JSONCodec Codec = jsonCodec{}
+
+// CodecFor 按协商结果选择编码。
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolProtobuf {
+		return protobufCodec{}
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return SubprotocolJSON }
+
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Encode(envelope []byte) ([]byte, error) {
+	var env services.Envelope
+	if err := json.Unmarshal(envelope, &env); err == nil && env.Action == services.ActionMessage {
+		return env.Data, nil
+	}
+	return envelope, nil
+}
+
+// EncodeBatch {"action":"batch","data":[帧1,帧2,...]}：各帧本身即 JSON，直接拼接。
+func (jsonCodec) EncodeBatch(frames [][]byte) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(`{"action":"` + ActionBatch + `","data":[`)
+	for i, f := range frames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(f)
+	}
+	b.WriteString("]}")
+	return b.Bytes(), nil
+}
+
+func (jsonCodec) Decode(frame []byte) (*WSMessage, error) {
+	var m WSMessage
+	if err := json.Unmarshal(frame, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
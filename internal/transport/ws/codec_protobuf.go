@@ -0,0 +1,324 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"go-im/internal/services"
+	"go-im/internal/transport/ws/impb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// protoUpstream 上行 action → 消息类型（值仅作类型原型，解码时按其类型新建）
+var protoUpstream = map[string]proto.Message{
+	"heartbeat":        &impb.Heartbeat{},
+	"send":             &impb.SendRequest{},
+	"start_stream":     &impb.SendRequest{},
+	"deliver_ack":      &impb.DeliverAck{},
+	"forward":          &impb.ForwardRequest{},
+	"recall":           &impb.MessageRef{},
+	"pin":              &impb.MessageRef{},
+	"unpin":            &impb.MessageRef{},
+	"edit":             &impb.EditRequest{},
+	"reaction_add":     &impb.ReactionRequest{},
+	"reaction_remove":  &impb.ReactionRequest{},
+	"read":             &impb.Read{},
+	"sync":             &impb.SyncRequest{},
+	"subscribe_group":  &impb.SubscribeGroup{},
+	"stream_chunk":     &impb.StreamChunk{},
+	"end_stream":       &impb.StreamEnd{},
+	"typing":           &impb.Typing{},
+	"call_start":       &impb.CallStart{},
+	"call_answer":      &impb.CallControl{},
+	"call_reject":      &impb.CallControl{},
+	"call_end":         &impb.CallControl{},
+	"webrtc_signaling": &impb.Signaling{},
+}
+
+// protoDownstream 下行 action → 消息类型
+var protoDownstream = map[string]proto.Message{
+	services.ActionMessage: &impb.Message{},
+	"ack":                  &impb.Message{},
+	"stream_started":       &impb.Message{},
+	"stream_ended":         &impb.StreamEnd{},
+	"heartbeat_ack":        &impb.Heartbeat{},
+	"error":                &impb.Error{},
+	"forward_ack":          &impb.ForwardAck{},
+	"delivered":            &impb.Delivered{},
+	"recall_ack":           &impb.Recalled{},
+	"recalled":             &impb.Recalled{},
+	"edit_ack":             &impb.Edited{},
+	"edited":               &impb.Edited{},
+	"reaction_ack":         &impb.Reaction{},
+	"reaction":             &impb.Reaction{},
+	"pin_ack":              &impb.PinnedChanged{},
+	"pinned_changed":       &impb.PinnedChanged{},
+	"read_ack":             &impb.Read{},
+	"read_receipt":         &impb.ReadReceipt{},
+	"sync_batch":           &impb.SyncBatch{},
+	"sync_done":            &impb.SyncDone{},
+	"mention":              &impb.Mention{},
+	"message_updated":      &impb.MessageUpdated{},
+	"typing":               &impb.Typing{},
+	"webrtc_signaling":     &impb.Signaling{},
+	"call_started":         &impb.Call{},
+	"call_incoming":        &impb.Call{},
+	"call_answered":        &impb.Call{},
+	"call_rejected":        &impb.Call{},
+	"call_ended":           &impb.Call{},
+	"scheduled_status":     &impb.ScheduledStatus{},
+	"group_notice":         &impb.GroupNotice{},
+}
+
+// protobufCodec Protobuf 编码（impb/im.proto，消息类型由 protoc-gen-go 生成）：每帧为一个 Envelope 二进制帧。
+// - 下行：信封 data 按 action 对应的消息类型编码；schema 未定义或数据与 schema 不符时放入 json 字段原样携带
+// - 上行：按 action 对应的消息类型解码后转换为 JSON，交由与 JSON 协议相同的动作处理
+type protobufCodec struct{}
+
+func (protobufCodec) Subprotocol() string { return SubprotocolProtobuf }
+
+func (protobufCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (protobufCodec) Encode(envelope []byte) ([]byte, error) {
+	var env services.Envelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return nil, err
+	}
+	out := &impb.Envelope{Action: env.Action}
+	if typ, ok := protoDownstream[env.Action]; ok {
+		data, err := marshalProtoData(typ.ProtoReflect().New(), env.Data)
+		if err == nil {
+			out.Data = data
+			return proto.Marshal(out)
+		}
+		log.Printf("WS protobuf encode fallback to json: action=%s err=%v", env.Action, err)
+	}
+	if len(env.Data) > 0 {
+		out.Json = env.Data
+	}
+	return proto.Marshal(out)
+}
+
+func (protobufCodec) EncodeBatch(frames [][]byte) ([]byte, error) {
+	data, err := proto.Marshal(&impb.Batch{Frames: frames})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&impb.Envelope{Action: ActionBatch, Data: data})
+}
+
+func (protobufCodec) Decode(frame []byte) (*WSMessage, error) {
+	var env impb.Envelope
+	if err := proto.Unmarshal(frame, &env); err != nil {
+		return nil, err
+	}
+	m := &WSMessage{Action: env.GetAction()}
+	if raw := env.GetJson(); len(raw) > 0 {
+		m.Data = raw
+		return m, nil
+	}
+	typ, ok := protoUpstream[m.Action]
+	if !ok {
+		return nil, fmt.Errorf("ws: unknown action %q", m.Action)
+	}
+	msg := typ.ProtoReflect().New()
+	if err := proto.Unmarshal(env.GetData(), msg.Interface()); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(protoToJSON(msg))
+	if err != nil {
+		return nil, err
+	}
+	m.Data = data
+	return m, nil
+}
+
+// marshalProtoData 将 JSON 数据填充到消息并编码为 Protobuf（JSON 中多余的字段忽略）。
+func marshalProtoData(msg protoreflect.Message, data json.RawMessage) ([]byte, error) {
+	if len(data) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if v != nil {
+			if err := protoFromJSON(msg, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return proto.Marshal(msg.Interface())
+}
+
+// protoFromJSON 按字段的 JSON 名填充消息；bytes 字段保存该值的原始 JSON。
+func protoFromJSON(m protoreflect.Message, v any) error {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: expected object", m.Descriptor().FullName())
+	}
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		jv, ok := obj[fd.JSONName()]
+		if !ok || jv == nil {
+			continue
+		}
+		switch {
+		case fd.IsMap():
+			entries, ok := jv.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: expected object", fd.FullName())
+			}
+			mp := m.Mutable(fd).Map()
+			for k, e := range entries {
+				key, err := protoMapKey(fd.MapKey(), k)
+				if err != nil {
+					return err
+				}
+				val, err := protoValueFromJSON(fd.MapValue(), e, mp.NewValue)
+				if err != nil {
+					return err
+				}
+				mp.Set(key, val)
+			}
+		case fd.IsList():
+			items, ok := jv.([]any)
+			if !ok {
+				return fmt.Errorf("%s: expected array", fd.FullName())
+			}
+			list := m.Mutable(fd).List()
+			for _, e := range items {
+				val, err := protoValueFromJSON(fd, e, list.NewElement)
+				if err != nil {
+					return err
+				}
+				list.Append(val)
+			}
+		default:
+			val, err := protoValueFromJSON(fd, jv, func() protoreflect.Value { return m.NewField(fd) })
+			if err != nil {
+				return err
+			}
+			m.Set(fd, val)
+		}
+	}
+	return nil
+}
+
+func protoValueFromJSON(fd protoreflect.FieldDescriptor, v any, newMessage func() protoreflect.Value) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		mv := newMessage()
+		if err := protoFromJSON(mv.Message(), v); err != nil {
+			return protoreflect.Value{}, err
+		}
+		return mv, nil
+	case protoreflect.BytesKind:
+		b, err := json.Marshal(v)
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.StringKind:
+		if s, ok := v.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+	case protoreflect.BoolKind:
+		if b, ok := v.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if n, ok := jsonInt(v); ok {
+			return protoreflect.ValueOfInt32(int32(n)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if n, ok := jsonInt(v); ok {
+			return protoreflect.ValueOfInt64(n), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if n, ok := jsonInt(v); ok && n >= 0 {
+			return protoreflect.ValueOfUint32(uint32(n)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if n, ok := jsonInt(v); ok && n >= 0 {
+			return protoreflect.ValueOfUint64(uint64(n)), nil
+		}
+	case protoreflect.DoubleKind, protoreflect.FloatKind:
+		if num, ok := v.(json.Number); ok {
+			if f, err := num.Float64(); err == nil {
+				if fd.Kind() == protoreflect.FloatKind {
+					return protoreflect.ValueOfFloat32(float32(f)), nil
+				}
+				return protoreflect.ValueOfFloat64(f), nil
+			}
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("%s: unexpected value %v", fd.FullName(), v)
+}
+
+func protoMapKey(fd protoreflect.FieldDescriptor, k string) (protoreflect.MapKey, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(k).MapKey(), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(k)
+		return protoreflect.ValueOfBool(b).MapKey(), err
+	}
+	val, err := protoValueFromJSON(fd, json.Number(k), nil)
+	return val.MapKey(), err
+}
+
+func jsonInt(v any) (int64, bool) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if n, err := num.Int64(); err == nil {
+		return n, true
+	}
+	f, err := num.Float64()
+	return int64(f), err == nil
+}
+
+// protoToJSON 将消息转换为 JSON 对象（仅包含已设置的字段）；bytes 字段为合法 JSON 时原样嵌入。
+func protoToJSON(m protoreflect.Message) map[string]any {
+	out := make(map[string]any)
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			entries := make(map[string]any, v.Map().Len())
+			v.Map().Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+				entries[k.String()] = protoValueToJSON(fd.MapValue(), e)
+				return true
+			})
+			out[fd.JSONName()] = entries
+		case fd.IsList():
+			list := v.List()
+			items := make([]any, list.Len())
+			for i := range items {
+				items[i] = protoValueToJSON(fd, list.Get(i))
+			}
+			out[fd.JSONName()] = items
+		default:
+			out[fd.JSONName()] = protoValueToJSON(fd, v)
+		}
+		return true
+	})
+	return out
+}
+
+func protoValueToJSON(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		return protoToJSON(v.Message())
+	case protoreflect.BytesKind:
+		if b := v.Bytes(); json.Valid(b) {
+			return json.RawMessage(b)
+		}
+	}
+	return v.Interface()
+}
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"go-im/internal/models"
+	"go-im/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ForwardPayload 转发负载：从 sourceConvId 选取 serverMsgIds 发往 targets（merged=true 时合并为一条）。
+type ForwardPayload struct {
+	SourceConvID string                   `json:"sourceConvId"`
+	ServerMsgIDs []string                 `json:"serverMsgIds"`
+	Targets      []services.ForwardTarget `json:"targets"`
+	Merged       bool                     `json:"merged"`
+	Title        string                   `json:"title,omitempty"`
+	ClientMsgID  string                   `json:"clientMsgId,omitempty"`
+}
+
+// AuthorizeSend 复用 IsFriend/IsMember 回调校验目标会话的发送权限（供转发等非 send 入口使用）。
+func (s *Server) AuthorizeSend(ctx context.Context, from string, t *services.ForwardTarget) error {
+	switch t.ConvType {
+	case models.ConversationTypeC2C:
+		if s.IsFriend != nil {
+			ok, err := s.IsFriend(ctx, from, t.To)
+			if err != nil {
+				log.Printf("WS isFriend error: user=%s to=%s err=%v", from, t.To, err)
+			}
+			if !ok {
+				return services.ErrNotFriend
+			}
+		}
+	case models.ConversationTypeGroup:
+		if s.IsMember != nil {
+			ok, err := s.IsMember(ctx, t.GroupID, from)
+			if err != nil {
+				log.Printf("WS isMember error: user=%s group=%s err=%v", from, t.GroupID, err)
+			}
+			if !ok {
+				return services.ErrNotGroupMember
+			}
+		}
+	}
+	return nil
+}
+
+// handleForward 处理 forward 动作：返回 forward_ack {results}，各目标会话照常收到新消息。
+func (s *Server) handleForward(ctx context.Context, userID, deviceID string, conn Conn, p *ForwardPayload) {
+	if !s.rateLimitAllow(ctx, userID, deviceID) {
+		conn.Send([]byte(`{"action":"error","data":{"code":"RATE_LIMIT"}}`))
+		return
+	}
+	for i := range p.Targets {
+		p.Targets[i].ConvType = services.ToConvType(string(p.Targets[i].ConvType))
+	}
+	results, err := s.MsgSvc.Forward(ctx, &services.ForwardRequest{
+		From:         userID,
+		SourceConvID: p.SourceConvID,
+		ServerMsgIDs: p.ServerMsgIDs,
+		Targets:      p.Targets,
+		Merged:       p.Merged,
+		Title:        p.Title,
+		ClientMsgID:  p.ClientMsgID,
+	}, s.AuthorizeSend)
+	var b []byte
+	if err != nil {
+		code, _ := services.MessageErrorCode(err)
+		b, _ = json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "clientMsgId": p.ClientMsgID}})
+		log.Printf("WS forward failed: user=%s source=%s err=%v", userID, p.SourceConvID, err)
+	} else {
+		b, _ = json.Marshal(gin.H{"action": "forward_ack", "data": gin.H{"clientMsgId": p.ClientMsgID, "results": results}})
+	}
+	conn.Send(b)
+}
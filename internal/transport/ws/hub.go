@@ -0,0 +1,123 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go-im/internal/cache"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Hub 节点内连接注册表与本地扇出（WebSocket 与 TCP 会话共用）：
+// - 会话按 用户 → 设备 → 连接 登记在本节点，同时在 Redis 路由表登记 设备 → 节点（cache.SetDeviceRoute，带 TTL，心跳续期）
+// - 整个节点只持有一个 Redis 订阅：本节点投递通道（发布方经 cache.DeliverToUsers 每个目标节点发布一次；群消息按成员解析后同样路由）
+// - 收到投递后经 Session.Deliver 放入各会话的下行队列并登记待确认窗口（入队不阻塞，单个慢连接不影响其它连接）
+type Hub struct {
+	NodeID string
+
+	pubsub *redis.PubSub
+	mu     sync.RWMutex
+	users  map[string]map[string]map[*Session]struct{} // userId → deviceId → 会话
+}
+
+// NewHub 创建节点注册表并订阅节点投递通道；nodeID 为空时使用 主机名-进程号（须在集群内唯一）。
+func NewHub(nodeID string) *Hub {
+	if nodeID == "" {
+		host, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return &Hub{
+		NodeID: nodeID,
+		pubsub: cache.Client().Subscribe(context.Background(), cache.NodeChannel(nodeID)),
+		users:  make(map[string]map[string]map[*Session]struct{}),
+	}
+}
+
+// Run 接收节点投递并在本地扇出，直到 ctx 取消（断线由客户端库自动重连并恢复订阅）。
+func (h *Hub) Run(ctx context.Context) {
+	defer h.pubsub.Close()
+	log.Printf("Hub started: node=%s", h.NodeID)
+	ch := h.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			h.deliverRouted([]byte(msg.Payload))
+		}
+	}
+}
+
+func (h *Hub) deliverRouted(b []byte) {
+	var d cache.RoutedDelivery
+	if err := json.Unmarshal(b, &d); err != nil {
+		log.Printf("Hub routed delivery unmarshal error: node=%s err=%v", h.NodeID, err)
+		return
+	}
+	var targets []*Session
+	h.mu.RLock()
+	for _, uid := range d.Users {
+		for _, conns := range h.users[uid] {
+			for sess := range conns {
+				targets = append(targets, sess)
+			}
+		}
+	}
+	h.mu.RUnlock()
+	for _, sess := range targets {
+		_ = sess.Deliver(d.Payload)
+	}
+}
+
+// register 登记会话并写入设备路由（TTL 与设备在线状态一致）。
+func (h *Hub) register(ctx context.Context, sess *Session, ttl time.Duration) {
+	h.mu.Lock()
+	devices := h.users[sess.UserID]
+	if devices == nil {
+		devices = make(map[string]map[*Session]struct{})
+		h.users[sess.UserID] = devices
+	}
+	conns := devices[sess.DeviceID]
+	if conns == nil {
+		conns = make(map[*Session]struct{})
+		devices[sess.DeviceID] = conns
+	}
+	conns[sess] = struct{}{}
+	h.mu.Unlock()
+	if err := cache.SetDeviceRoute(ctx, sess.UserID, sess.DeviceID, h.NodeID, ttl); err != nil {
+		log.Printf("Hub route set error: user=%s device=%s err=%v", sess.UserID, sess.DeviceID, err)
+	}
+}
+
+// unregister 注销会话；设备在本节点已无连接时删除设备路由。
+func (h *Hub) unregister(sess *Session) {
+	h.mu.Lock()
+	lastConn := false
+	if devices := h.users[sess.UserID]; devices != nil {
+		if conns := devices[sess.DeviceID]; conns != nil {
+			delete(conns, sess)
+			if len(conns) == 0 {
+				lastConn = true
+				delete(devices, sess.DeviceID)
+			}
+		}
+		if len(devices) == 0 {
+			delete(h.users, sess.UserID)
+		}
+	}
+	h.mu.Unlock()
+	if lastConn {
+		if err := cache.DelDeviceRoute(context.Background(), sess.UserID, sess.DeviceID, h.NodeID); err != nil {
+			log.Printf("Hub route del error: user=%s device=%s err=%v", sess.UserID, sess.DeviceID, err)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+// Package impb WebSocket Protobuf 协议（子协议 im.protobuf.v1）的消息类型，由 im.proto 生成。
+package impb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative im.proto
@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"go-im/internal/metrics"
+)
+
+// 下行队列默认参数（可通过 Server.SendQueueSize/SendBatchMax/SlowConsumerPolicy 覆盖）
+const (
+	defaultSendQueueSize = 256
+	defaultSendBatchMax  = 32
+)
+
+// 慢连接策略：队列写满时
+// - evict：断开连接（WebSocket 关闭码 CloseSlowConsumer，TCP 关闭原因 SLOW_CONSUMER），客户端重连后 sync 补齐
+// - drop：丢弃该帧；消息投递仍在待确认窗口中，超时后重投（重投仍失败则由客户端 sync 补齐）
+const (
+	SlowConsumerEvict = "evict"
+	SlowConsumerDrop  = "drop"
+)
+
+// CloseSlowConsumer 慢连接被断开时的 WebSocket 关闭码：客户端应重连并发送 sync 补齐消息
+const CloseSlowConsumer = 4001
+
+var (
+	ErrSlowConsumer = errors.New("ws: slow consumer evicted")
+	ErrQueueClosed  = errors.New("ws: send queue closed")
+)
+
+// SendQueue 连接的有界下行队列：
+// - Push 非阻塞入队，订阅循环、群订阅协程等投递方不会被单个慢连接阻塞；队列已满时按慢连接策略丢弃或断开
+// - PushWait 队列满时等待，用于离线同步等由客户端请求触发的大批量下行（背压到该连接自己的读循环）
+// - Run 为该连接唯一的写协程：每次唤醒取出当前积压（至多 maxBatch 帧）一次交给 flush 写出
+type SendQueue struct {
+	transport string
+	items     chan []byte
+	maxBatch  int
+	policy    string
+	flush     func(batch [][]byte) error
+	evict     func()
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	evictOnce sync.Once
+}
+
+// NewSendQueue 按网关配置创建下行队列；flush 写出一批帧，evict 以“需重新同步”的原因断开连接。
+func (s *Server) NewSendQueue(transport string, flush func(batch [][]byte) error, evict func()) *SendQueue {
+	size, maxBatch, policy := s.SendQueueSize, s.SendBatchMax, s.SlowConsumerPolicy
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+	if maxBatch <= 0 {
+		maxBatch = defaultSendBatchMax
+	}
+	if policy != SlowConsumerDrop {
+		policy = SlowConsumerEvict
+	}
+	return &SendQueue{
+		transport: transport,
+		items:     make(chan []byte, size),
+		maxBatch:  maxBatch,
+		policy:    policy,
+		flush:     flush,
+		evict:     evict,
+		closed:    make(chan struct{}),
+	}
+}
+
+func (q *SendQueue) Push(b []byte) error {
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+	select {
+	case q.items <- b:
+		q.enqueued()
+		return nil
+	default:
+	}
+	if q.policy == SlowConsumerDrop {
+		metrics.SendQueueDropped.WithLabelValues(q.transport).Inc()
+		return nil
+	}
+	q.evictOnce.Do(func() {
+		metrics.SlowConsumerEvictions.WithLabelValues(q.transport).Inc()
+		log.Printf("send queue full, evicting slow consumer: transport=%s size=%d", q.transport, cap(q.items))
+		q.Close()
+		// 关闭帧的写出可能等待阻塞中的写协程，放到独立协程，入队方（节点 Hub 等）不被阻塞
+		go q.evict()
+	})
+	return ErrSlowConsumer
+}
+
+func (q *SendQueue) PushWait(ctx context.Context, b []byte) error {
+	select {
+	case q.items <- b:
+		q.enqueued()
+		return nil
+	case <-q.closed:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *SendQueue) enqueued() {
+	metrics.SendQueueFrames.WithLabelValues(q.transport).Inc()
+	metrics.SendQueueDepth.WithLabelValues(q.transport).Observe(float64(len(q.items)))
+}
+
+// Run 写协程：直到 Close 或写出失败（返回该错误）。退出时丢弃未写出的帧。
+func (q *SendQueue) Run() error {
+	defer q.discard()
+	batch := make([][]byte, 0, q.maxBatch)
+	for {
+		select {
+		case <-q.closed:
+			return nil
+		case b := <-q.items:
+			batch = append(batch[:0], b)
+		drain:
+			for len(batch) < q.maxBatch {
+				select {
+				case b := <-q.items:
+					batch = append(batch, b)
+				default:
+					break drain
+				}
+			}
+			metrics.SendQueueFrames.WithLabelValues(q.transport).Sub(float64(len(batch)))
+			metrics.SendBatchSize.WithLabelValues(q.transport).Observe(float64(len(batch)))
+			if err := q.flush(batch); err != nil {
+				q.Close()
+				return err
+			}
+		}
+	}
+}
+
+func (q *SendQueue) discard() {
+	for {
+		select {
+		case <-q.items:
+			metrics.SendQueueFrames.WithLabelValues(q.transport).Dec()
+		default:
+			return
+		}
+	}
+}
+
+// Close 停止写协程，之后的入队返回 ErrQueueClosed（可重复调用）。
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// blockingSender 支持背压的下行通道（见 SendQueue.PushWait）
+type blockingSender interface {
+	SendWait(ctx context.Context, envelope []byte) error
+}
+
+// sendWait 连接支持时等待队列空位，否则退化为 Send。
+func sendWait(ctx context.Context, conn Conn, envelope []byte) error {
+	if bs, ok := conn.(blockingSender); ok {
+		return bs.SendWait(ctx, envelope)
+	}
+	return conn.Send(envelope)
+}
@@ -8,12 +8,10 @@ import (
 	"log"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"go-im/internal/auth"
 	"go-im/internal/cache"
-	"go-im/internal/metrics"
 	"go-im/internal/models"
 	"go-im/internal/ratelimit"
 	"go-im/internal/services"
@@ -25,14 +23,15 @@ import (
 
 // Server 是 WebSocket 网关服务。
 // - 注入消息服务 MsgSvc 以完成消息入库与分发
-// - 注入权限回调 IsFriend/IsMember 做发送前的快速业务校验
+// - 注入权限回调 IsFriend/IsMember 做输入状态、通话、转发等的快速业务校验（消息发送权限由 MsgSvc 拦截器链校验）
 // - 基于 Redis 令牌桶对上行发送做速率限制，防止滥用
 // - 每个连接使用单独的写锁，避免并发写触发 gorilla/websocket 冲突
 type Server struct {
 	JWTSecret string
 	MsgSvc    *services.MessageService
-	WebRTCSvc *services.WebRTCService // WebRTC 服务
-	Receipt   *store.ReceiptStore     // 已读回执存储
+	WebRTCSvc *services.WebRTCService  // WebRTC 服务
+	Receipt   *store.ReceiptStore      // 已读回执存储
+	ReadSvc   *services.ReceiptService // 已读回执服务（设置后 read 同时推送群消息 read_receipt 增量）
 	// 权限回调：用于校验单聊是否好友、群聊是否成员
 	IsFriend func(ctx context.Context, a, b string) (bool, error)
 	IsMember func(ctx context.Context, gid, uid string) (bool, error)
@@ -41,21 +40,42 @@ type Server struct {
 	SendQPS   int
 	SendBurst int
 	Limiter   *ratelimit.TokenBucketLimiter
+
+	// 投递确认：下行消息等待 deliver_ack 的超时、最大重投次数与每设备窗口大小
+	AckTimeout    time.Duration
+	AckMaxRetries int
+	AckWindow     int
+
+	// 心跳：服务端 ping 间隔、读超时（期间未收到 pong 或任何上行帧即断开）、设备在线状态 TTL（心跳续期）
+	PingInterval time.Duration
+	PongWait     time.Duration
+	PresenceTTL  time.Duration
+
+	// 下行队列：每连接队列容量、写协程单次最多取出的帧数、队列写满时的慢连接策略（evict/drop）
+	SendQueueSize      int
+	SendBatchMax       int
+	SlowConsumerPolicy string
+
+	// 节点注册表与本地扇出（必填）：连接登记在本节点，下行投递经路由表与节点通道到达
+	Hub *Hub
 }
 
+// upgrader 按服务端偏好顺序协商子协议（Protobuf 优先），客户端未携带时为 JSON
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{SubprotocolProtobuf, SubprotocolJSON},
 }
 
 // WSMessage 统一封装上行的动作与数据载荷。
-// action 示例：send、recall、read、subscribe_group、start_stream、stream_chunk、end_stream、webrtc_signaling
+// action 示例：send、deliver_ack、forward、recall、edit、reaction_add、reaction_remove、pin、unpin、read、sync、subscribe_group、start_stream、stream_chunk、end_stream、webrtc_signaling
 type WSMessage struct {
-	Action string          `json:"action"` // send, recall, read, subscribe_group, start_stream, stream_chunk, end_stream, call_start, call_answer, call_reject, call_end, webrtc_signaling
+	Action string          `json:"action"` // send, deliver_ack, forward, recall, edit, reaction_add, reaction_remove, pin, unpin, read, sync, subscribe_group, start_stream, stream_chunk, end_stream, call_start, call_answer, call_reject, call_end, webrtc_signaling
 	Data   json.RawMessage `json:"data"`
 }
 
 // SendPayload 客户端发送消息时的载荷。
 // - 支持 burnAfterRead（阅后即焚）与 expireAtMs（定时自毁）
+// - 支持 replyTo/replyToSeq（引用回复）与 threadRoot（话题内回复）
 // - convId/convType 指明路由维度，c2c 需提供 to，group 需提供 groupId
 type SendPayload struct {
 	ConvID   string          `json:"convId"`
@@ -68,6 +88,20 @@ type SendPayload struct {
 	// 自毁/过期
 	ExpireAtMS    int64 `json:"expireAtMs,omitempty"`    // 过期时间戳（毫秒）
 	BurnAfterRead bool  `json:"burnAfterRead,omitempty"` // 阅后即焚
+	// 引用回复/话题：replyTo（serverMsgId）或 replyToSeq 指定被引用消息，threadRoot 指定话题根
+	ReplyTo    string `json:"replyTo,omitempty"`
+	ReplyToSeq int64  `json:"replyToSeq,omitempty"`
+	ThreadRoot string `json:"threadRoot,omitempty"`
+}
+
+// Request 转换为服务层发送请求（WS send 与 HTTP 发送接口共用）。
+func (p *SendPayload) Request(from string) *services.SendRequest {
+	var expireAt *time.Time
+	if p.ExpireAtMS > 0 {
+		t := time.UnixMilli(p.ExpireAtMS)
+		expireAt = &t
+	}
+	return &services.SendRequest{ConvID: p.ConvID, ConvType: services.ToConvType(p.ConvType), ClientID: p.ClientID, From: from, To: p.To, GroupID: p.GroupID, Type: p.Type, Payload: p.Payload, ExpireAt: expireAt, BurnAfterRead: p.BurnAfterRead, ReplyTo: p.ReplyTo, ReplyToSeq: p.ReplyToSeq, ThreadRoot: p.ThreadRoot}
 }
 
 // 撤回负载
@@ -76,13 +110,33 @@ type RecallPayload struct {
 	ServerMsgID string `json:"serverMsgId"`
 }
 
+// 编辑负载（仅文本消息，payload 为新的 TextPayload）
+type EditPayload struct {
+	ConvID      string          `json:"convId"`
+	ServerMsgID string          `json:"serverMsgId"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// 表情回应负载
+type ReactionPayload struct {
+	ConvID      string `json:"convId"`
+	ServerMsgID string `json:"serverMsgId"`
+	Emoji       string `json:"emoji"`
+}
+
+// 置顶消息负载
+type PinPayload struct {
+	ConvID      string `json:"convId"`
+	ServerMsgID string `json:"serverMsgId"`
+}
+
 // 已读回执负载
 type ReadPayload struct {
 	ConvID string `json:"convId"`
 	Seq    int64  `json:"seq"`
 }
 
-// 订阅群聊负载
+// 订阅群聊负载（subscribe_group 已废弃，群成员自动接收群消息）
 type SubscribeGroupPayload struct {
 	GroupID string `json:"groupId"`
 }
@@ -139,8 +193,9 @@ type WebRTCSignalingPayload struct {
 
 // Handle 处理 HTTP 升级为 WebSocket，以及该连接的读/写循环。
 // - 认证：支持 URL 查询参数或 Authorization: Bearer 传递 JWT
-// - 上线/下线：多设备在线集合，连接退出自动下线
-// - 下行：订阅个人投递通道，将 Redis 消息写回客户端
+// - 上线/下线：多设备在线集合（带 TTL，心跳续期），连接退出自动下线
+// - 编码：通过 Sec-WebSocket-Protocol 协商 im.protobuf.v1（二进制帧）或 im.json.v1（默认，文本帧）
+// - 下行：节点 Hub 按路由扇出到本连接，信封进入连接的有界下行队列，由写协程按连接编码写回（batch=1 时合并小帧），队列写满按慢连接策略丢弃或以关闭码 4001 断开，客户端重连后 sync 补齐
 func (s *Server) Handle(c *gin.Context) {
 	ctx := c.Request.Context()
 	token := c.Query("token")
@@ -166,72 +221,104 @@ func (s *Server) Handle(c *gin.Context) {
 	}
 	defer conn.Close()
 	userID := claims.UserID
-	log.Printf("WS connected: user=%s device=%s", userID, deviceID)
-	_ = cache.SetDeviceOnline(ctx, userID, deviceID)
-	defer func() {
-		cache.SetDeviceOffline(context.Background(), userID, deviceID)
-		log.Printf("WS disconnected: user=%s device=%s", userID, deviceID)
+	codec := CodecFor(conn.Subprotocol())
+	log.Printf("WS connected: user=%s device=%s codec=%s", userID, deviceID, codec.Subprotocol())
+	defer log.Printf("WS disconnected: user=%s device=%s", userID, deviceID)
+
+	// 连接级上下文：读循环退出（断开、读超时）时取消，结束写循环与该连接的订阅
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 下行队列与写协程：写出失败或慢连接被断开时结束该连接
+	wc := s.newWSConn(conn, codec, c.Query("batch") == "1")
+	defer wc.queue.Close()
+	go func() {
+		if err := wc.queue.Run(); err != nil {
+			log.Printf("WS write error: user=%s err=%v", userID, err)
+		}
+		cancel()
 	}()
 
-	// 每个连接的写锁，序列化所有写操作，避免 concurrent write
-	writeMu := &sync.Mutex{}
+	// 会话：上线并登记到节点 Hub（下行投递由 Hub 放入下行队列），退出时注销并下线；下行消息在收到 deliver_ack 前定时重投
+	sess := s.NewSession(connCtx, userID, deviceID, wc)
+	defer sess.Close()
 
-	// 订阅个人下发通道
-	sub := cache.Client().Subscribe(ctx, cache.DeliverChannel(userID))
-	defer sub.Close()
+	// 心跳：每 PingInterval 发送 ping；PongWait 内未收到 pong 或任何上行帧即判定连接失效
+	pongWait := s.pongWait()
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		sess.Heartbeat(connCtx)
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(s.pingInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-connCtx.Done():
+				return
+			case <-ticker.C:
+				if err := wc.ping(); err != nil {
+					log.Printf("WS ping error: user=%s device=%s err=%v", userID, deviceID, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
 
-	// 读循环：处理客户端上行动作
+	// 读循环：处理客户端上行动作，任一上行帧都刷新读超时；连接在读循环退出或写出失败时结束
 	go func() {
+		defer cancel()
 		for {
 			msgType, data, err := conn.ReadMessage()
 			if err != nil {
 				log.Printf("WS read error: user=%s err=%v", userID, err)
 				return
 			}
+			conn.SetReadDeadline(time.Now().Add(pongWait))
 			if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
 				continue
 			}
-			var m WSMessage
-			if err := json.Unmarshal(data, &m); err != nil {
-				log.Printf("WS unmarshal error: user=%s err=%v data=%q", userID, err, string(data))
+			m, err := codec.Decode(data)
+			if err != nil {
+				log.Printf("WS decode error: user=%s codec=%s err=%v size=%d", userID, codec.Subprotocol(), err, len(data))
 				continue
 			}
-			metrics.WSMessagesTotal.WithLabelValues(m.Action).Inc()
 			log.Printf("WS inbound: user=%s action=%s size=%d", userID, m.Action, len(data))
-			s.handleInbound(ctx, userID, deviceID, conn, writeMu, &m)
+			sess.Dispatch(connCtx, m, nil)
 		}
 	}()
 
-	// 写循环：将 Redis 收到的消息发给客户端
-	for {
-		msg, err := sub.ReceiveMessage(ctx)
-		if err != nil {
-			log.Printf("WS redis receive error: user=%s err=%v", userID, err)
-			return
-		}
-		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		writeMu.Lock()
-		err = conn.WriteMessage(websocket.TextMessage, []byte(msg.Payload))
-		writeMu.Unlock()
-		if err != nil {
-			log.Printf("WS write error: user=%s err=%v", userID, err)
-			return
-		}
+	<-connCtx.Done()
+}
+
+// groups 群成员存储（群投递解析成员用）。
+func (s *Server) groups() *store.GroupStore {
+	if s.MsgSvc == nil {
+		return nil
 	}
+	return s.MsgSvc.GroupStore
 }
 
-// rateLimitAllow 使用 Redis 令牌桶对用户+设备维度的发送做限速。
-// - 默认 QPS=20，突发=40，可通过配置调整
-// - 出错时当前实现放行（可按需调整策略）
-func (s *Server) rateLimitAllow(ctx context.Context, userID, deviceID string) bool {
-	qps := s.SendQPS
-	burst := s.SendBurst
+// SendRate 返回发送限速参数（未配置时默认 QPS=20，突发=40）；HTTP 发送接口复用同一参数。
+func (s *Server) SendRate() (qps, burst int) {
+	qps, burst = s.SendQPS, s.SendBurst
 	if qps <= 0 {
 		qps = 20
 	}
 	if burst <= 0 {
 		burst = 40
 	}
+	return qps, burst
+}
+
+// rateLimitAllow 使用 Redis 令牌桶对用户+设备维度的发送做限速。
+// - 参数见 SendRate，可通过配置调整
+// - 出错时当前实现放行（可按需调整策略）
+func (s *Server) rateLimitAllow(ctx context.Context, userID, deviceID string) bool {
+	qps, burst := s.SendRate()
 	if s.Limiter == nil {
 		return true
 	}
@@ -240,18 +327,20 @@ func (s *Server) rateLimitAllow(ctx context.Context, userID, deviceID string) bo
 }
 
 // handleInbound 处理上行动作，入口统一在这里分发：
-// - send：权限校验 → 调用 MsgSvc.Send 入库与分发 → 返回 ack
-// - read：写入已读回执 →（若阅后即焚）按 seq 撤回并广播 recalled 事件
-// - subscribe_group：订阅群通道（演示模式，生产建议服务端 fan-out 至用户私有通道）
+// - send：调用 MsgSvc.Send 校验载荷、执行发送拦截器链（权限/禁言/审核等）、入库与分发 → 返回 ack（载荷错误附带 field）
+// - forward：逐条/合并转发到多个目标会话（目标权限复用 IsFriend/IsMember）→ 返回 forward_ack
+// - recall：撤回消息（发送者限时，群主/管理员不限）→ 返回 recall_ack，并向会话广播 recalled 事件
+// - edit：发送者编辑文本消息 → 返回 edit_ack，并向会话广播 edited 事件
+// - reaction_add/reaction_remove：表情回应增删 → 返回 reaction_ack，并向会话广播 reaction 事件
+// - pin/unpin：会话内置顶消息（群聊仅群主/管理员）→ 返回 pin_ack，并向会话广播 pinned_changed 事件
+// - read：写入已读回执（群消息向原发送者推送 read_receipt）→（若阅后即焚）按 seq 撤回并广播 recalled 事件
 // - 其它：typing、WebRTC 信令等
-func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, conn *websocket.Conn, writeMu *sync.Mutex, m *WSMessage) {
+func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, conn Conn, m *WSMessage) {
 	switch m.Action {
 	case "send":
 		log.Printf("WS handleInbound SEND start: user=%s deviceId=%s", userID, deviceID)
 		if !s.rateLimitAllow(ctx, userID, deviceID) {
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"RATE_LIMIT"}}`))
-			writeMu.Unlock()
+			conn.Send([]byte(`{"action":"error","data":{"code":"RATE_LIMIT"}}`))
 			log.Printf("WS send blocked by rate limit: user=%s device=%s", userID, deviceID)
 			return
 		}
@@ -262,83 +351,38 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 			return
 		}
 		log.Printf("WS payload unmarshaled: user=%s payload=%+v", userID, p)
-		convType := services.ToConvType(p.ConvType)
 		log.Printf("WS send: user=%s convId=%s convType=%s to=%s group=%s clientMsgId=%s", userID, p.ConvID, p.ConvType, p.To, p.GroupID, p.ClientID)
-		// 发送权限校验
-		log.Printf("WS permission check: user=%s convType=%s to=%s group=%s", userID, p.ConvType, p.To, p.GroupID)
-		if convType == models.ConversationTypeC2C && s.IsFriend != nil {
-			log.Printf("WS checking friend relationship: user=%s to=%s", userID, p.To)
-			ok, ferr := s.IsFriend(ctx, userID, p.To)
-			if ferr != nil {
-				log.Printf("WS isFriend error: user=%s to=%s err=%v", userID, p.To, ferr)
-			}
-			log.Printf("WS isFriend result: user=%s to=%s isFriend=%v err=%v", userID, p.To, ok, ferr)
-			if !ok {
-				writeMu.Lock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"NOT_FRIEND"}}`))
-				writeMu.Unlock()
-				log.Printf("WS send denied NOT_FRIEND: user=%s to=%s", userID, p.To)
-				return
-			}
-		}
-		if convType == models.ConversationTypeGroup && s.IsMember != nil {
-			ok, merr := s.IsMember(ctx, p.GroupID, userID)
-			if merr != nil {
-				log.Printf("WS isMember error: user=%s group=%s err=%v", userID, p.GroupID, merr)
-			}
-			if !ok {
-				writeMu.Lock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"NOT_GROUP_MEMBER"}}`))
-				writeMu.Unlock()
-				log.Printf("WS send denied NOT_GROUP_MEMBER: user=%s group=%s", userID, p.GroupID)
-				return
-			}
-		}
-		log.Printf("WS permission check passed: user=%s", userID)
-		start := time.Now()
-		var expireAtPtr *time.Time
-		if p.ExpireAtMS > 0 {
-			t := time.UnixMilli(p.ExpireAtMS)
-			expireAtPtr = &t
-		}
+		// 权限、禁言、审核、提及提醒与指标均由 MsgSvc 的发送拦截器链处理
 		log.Printf("WS calling MsgSvc.Send: user=%s convId=%s", userID, p.ConvID)
-		d, err := s.MsgSvc.Send(ctx, &services.SendRequest{ConvID: p.ConvID, ConvType: convType, ClientID: p.ClientID, From: userID, To: p.To, GroupID: p.GroupID, Type: p.Type, Payload: p.Payload, ExpireAt: expireAtPtr, BurnAfterRead: p.BurnAfterRead})
+		d, err := s.MsgSvc.Send(ctx, p.Request(userID))
 		log.Printf("WS MsgSvc.Send result: user=%s convId=%s err=%v", userID, p.ConvID, err)
-		metrics.MessageSendLatency.Observe(float64(time.Since(start).Milliseconds()))
 		if err == nil {
 			b, _ := json.Marshal(gin.H{"action": "ack", "data": d})
-			writeMu.Lock()
-			werr := conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			werr := conn.Send(b)
 			log.Printf("WS send ack: user=%s convId=%s seq=%d writeErr=%v", userID, p.ConvID, d.Seq, werr)
-			// 解析 mentions 并下发提醒
-			var body map[string]interface{}
-			if json.Unmarshal(p.Payload, &body) == nil {
-				if arr, ok := body["mentions"].([]interface{}); ok && convType == models.ConversationTypeGroup {
-					for _, v := range arr {
-						if uid, ok := v.(string); ok && uid != "" {
-							tip := gin.H{"action": "mention", "data": gin.H{"groupId": p.GroupID, "convId": p.ConvID, "from": userID, "seq": d.Seq}}
-							tipb, _ := json.Marshal(tip)
-							err2 := cache.Client().Publish(ctx, cache.DeliverChannel(uid), tipb).Err()
-							if err2 != nil {
-								log.Printf("WS mention publish error: to=%s err=%v", uid, err2)
-							}
-						}
-					}
-				}
-			}
 		} else {
-			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "SEND_FAILED", "message": err.Error()}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			code, _ := services.MessageErrorCode(err)
+			if code == "INTERNAL" {
+				code = "SEND_FAILED"
+			}
+			data := gin.H{"code": code, "message": err.Error(), "clientMsgId": p.ClientID}
+			if field := services.PayloadErrorField(err); field != "" {
+				data["field"] = field
+			}
+			b, _ := json.Marshal(gin.H{"action": "error", "data": data})
+			conn.Send(b)
 			log.Printf("WS send failed: user=%s convId=%s err=%v", userID, p.ConvID, err)
 		}
+	case "forward":
+		var p ForwardPayload
+		if err := json.Unmarshal(m.Data, &p); err != nil {
+			log.Printf("WS forward unmarshal error: user=%s err=%v", userID, err)
+			return
+		}
+		s.handleForward(ctx, userID, deviceID, conn, &p)
 	case "start_stream":
 		if !s.rateLimitAllow(ctx, userID, deviceID) {
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"RATE_LIMIT"}}`))
-			writeMu.Unlock()
+			conn.Send([]byte(`{"action":"error","data":{"code":"RATE_LIMIT"}}`))
 			return
 		}
 		var p StartStreamPayload
@@ -346,36 +390,21 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 			return
 		}
 		convType := services.ToConvType(p.ConvType)
-		// 发送权限校验
-		if convType == models.ConversationTypeC2C && s.IsFriend != nil {
-			ok, _ := s.IsFriend(ctx, userID, p.To)
-			if !ok {
-				writeMu.Lock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"NOT_FRIEND"}}`))
-				writeMu.Unlock()
-				return
-			}
-		}
-		if convType == models.ConversationTypeGroup && s.IsMember != nil {
-			ok, _ := s.IsMember(ctx, p.GroupID, userID)
-			if !ok {
-				writeMu.Lock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"NOT_GROUP_MEMBER"}}`))
-				writeMu.Unlock()
-				return
-			}
-		}
 		d, err := s.MsgSvc.StartStream(ctx, &services.SendRequest{ConvID: p.ConvID, ConvType: convType, ClientID: p.ClientID, From: userID, To: p.To, GroupID: p.GroupID, Type: p.Type, Payload: p.Payload})
 		if err == nil {
 			b, _ := json.Marshal(gin.H{"action": "stream_started", "data": d})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			conn.Send(b)
 		} else {
-			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "STREAM_START_FAILED", "message": err.Error()}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			code, _ := services.MessageErrorCode(err)
+			if code == "INTERNAL" {
+				code = "STREAM_START_FAILED"
+			}
+			data := gin.H{"code": code, "message": err.Error()}
+			if field := services.PayloadErrorField(err); field != "" {
+				data["field"] = field
+			}
+			b, _ := json.Marshal(gin.H{"action": "error", "data": data})
+			conn.Send(b)
 		}
 	case "stream_chunk":
 		var p StreamChunkPayload
@@ -385,9 +414,7 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		err := s.MsgSvc.SendStreamChunk(ctx, p.StreamID, p.Delta, p.Metadata)
 		if err != nil {
 			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "STREAM_ERROR", "message": err.Error()}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			conn.Send(b)
 		}
 	case "end_stream":
 		var p EndStreamPayload
@@ -397,16 +424,12 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		err := s.MsgSvc.EndStream(ctx, p.StreamID, p.FinalText, p.Error)
 		if err == nil {
 			b, _ := json.Marshal(gin.H{"action": "stream_ended", "data": gin.H{"streamId": p.StreamID}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			conn.Send(b)
 		}
 	// WebRTC 通话控制（省略其他分支中相同写操作，均加锁）
 	case "call_start":
 		if s.WebRTCSvc == nil || !s.WebRTCSvc.Enabled {
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"WEBRTC_DISABLED"}}`))
-			writeMu.Unlock()
+			conn.Send([]byte(`{"action":"error","data":{"code":"WEBRTC_DISABLED"}}`))
 			return
 		}
 		var p CallStartPayload
@@ -416,31 +439,23 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		if s.IsFriend != nil {
 			ok, _ := s.IsFriend(ctx, userID, p.To)
 			if !ok {
-				writeMu.Lock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"NOT_FRIEND"}}`))
-				writeMu.Unlock()
+				conn.Send([]byte(`{"action":"error","data":{"code":"NOT_FRIEND"}}`))
 				return
 			}
 		}
 		call, err := s.WebRTCSvc.StartCall(ctx, userID, p.To, p.Type)
 		if err != nil {
 			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "CALL_FAILED", "message": err.Error()}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			conn.Send(b)
 			return
 		}
 		b, _ := json.Marshal(gin.H{"action": "call_started", "data": call})
-		writeMu.Lock()
-		conn.WriteMessage(websocket.TextMessage, b)
-		writeMu.Unlock()
+		conn.Send(b)
 		notifyData, _ := json.Marshal(gin.H{"action": "call_incoming", "data": call})
-		cache.Client().Publish(ctx, cache.DeliverChannel(p.To), notifyData)
+		cache.DeliverToUser(ctx, p.To, notifyData)
 	case "call_answer":
 		if s.WebRTCSvc == nil || !s.WebRTCSvc.Enabled {
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":{"code":"WEBRTC_DISABLED"}}`))
-			writeMu.Unlock()
+			conn.Send([]byte(`{"action":"error","data":{"code":"WEBRTC_DISABLED"}}`))
 			return
 		}
 		var p CallControlPayload
@@ -450,16 +465,12 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		call, err := s.WebRTCSvc.AnswerCall(ctx, p.CallID, userID)
 		if err != nil {
 			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "CALL_ANSWER_FAILED", "message": err.Error()}})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, b)
-			writeMu.Unlock()
+			conn.Send(b)
 			return
 		}
 		answerData, _ := json.Marshal(gin.H{"action": "call_answered", "data": call})
-		writeMu.Lock()
-		conn.WriteMessage(websocket.TextMessage, answerData)
-		writeMu.Unlock()
-		cache.Client().Publish(ctx, cache.DeliverChannel(call.FromUserID), answerData)
+		conn.Send(answerData)
+		cache.DeliverToUser(ctx, call.FromUserID, answerData)
 	case "call_reject":
 		if s.WebRTCSvc == nil {
 			return
@@ -471,10 +482,8 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		call, err := s.WebRTCSvc.RejectCall(ctx, p.CallID, userID)
 		if err == nil {
 			rejectData, _ := json.Marshal(gin.H{"action": "call_rejected", "data": call})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, rejectData)
-			writeMu.Unlock()
-			cache.Client().Publish(ctx, cache.DeliverChannel(call.FromUserID), rejectData)
+			conn.Send(rejectData)
+			cache.DeliverToUser(ctx, call.FromUserID, rejectData)
 		}
 	case "call_end":
 		if s.WebRTCSvc == nil {
@@ -487,14 +496,12 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		call, err := s.WebRTCSvc.EndCall(ctx, p.CallID, userID)
 		if err == nil {
 			endData, _ := json.Marshal(gin.H{"action": "call_ended", "data": call})
-			writeMu.Lock()
-			conn.WriteMessage(websocket.TextMessage, endData)
-			writeMu.Unlock()
+			conn.Send(endData)
 			otherUserID := call.FromUserID
 			if call.FromUserID == userID {
 				otherUserID = call.ToUserID
 			}
-			cache.Client().Publish(ctx, cache.DeliverChannel(otherUserID), endData)
+			cache.DeliverToUser(ctx, otherUserID, endData)
 		}
 	case "webrtc_signaling":
 		if s.WebRTCSvc == nil {
@@ -530,12 +537,12 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		notify := gin.H{"action": "typing", "data": gin.H{"convId": p.ConvID, "convType": p.ConvType, "from": userID, "to": p.To, "groupId": p.GroupID, "typing": p.Typing, "ts": time.Now().UnixMilli()}}
 		b, _ := json.Marshal(notify)
 		if convType == models.ConversationTypeC2C {
-			err := cache.Client().Publish(ctx, cache.DeliverChannel(p.To), b).Err()
+			err := cache.DeliverToUser(ctx, p.To, b)
 			if err != nil {
 				log.Printf("WS typing publish error: user=%s to=%s err=%v", userID, p.To, err)
 			}
 		} else if convType == models.ConversationTypeGroup {
-			err := cache.Client().Publish(ctx, cache.DeliverChannel(p.GroupID), b).Err()
+			err := services.DeliverToGroup(ctx, s.groups(), p.GroupID, b)
 			if err != nil {
 				log.Printf("WS typing publish error: user=%s group=%s err=%v", userID, p.GroupID, err)
 			}
@@ -545,22 +552,90 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 		if err := json.Unmarshal(m.Data, &p); err != nil {
 			return
 		}
-		_ = s.MsgSvc.Recall(ctx, p.ConvID, p.ServerMsgID)
+		evt, err := s.MsgSvc.Recall(ctx, userID, p.ConvID, p.ServerMsgID)
+		if err != nil {
+			code, _ := services.MessageErrorCode(err)
+			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "convId": p.ConvID, "serverMsgId": p.ServerMsgID}})
+			conn.Send(b)
+			log.Printf("WS recall denied: user=%s convId=%s serverMsgId=%s err=%v", userID, p.ConvID, p.ServerMsgID, err)
+			return
+		}
+		b, _ := json.Marshal(gin.H{"action": "recall_ack", "data": evt})
+		conn.Send(b)
+	case "edit":
+		var p EditPayload
+		if err := json.Unmarshal(m.Data, &p); err != nil {
+			log.Printf("WS edit unmarshal error: user=%s err=%v", userID, err)
+			return
+		}
+		evt, err := s.MsgSvc.Edit(ctx, userID, p.ConvID, p.ServerMsgID, p.Payload)
+		if err != nil {
+			code, _ := services.MessageErrorCode(err)
+			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "convId": p.ConvID, "serverMsgId": p.ServerMsgID}})
+			conn.Send(b)
+			log.Printf("WS edit denied: user=%s convId=%s serverMsgId=%s err=%v", userID, p.ConvID, p.ServerMsgID, err)
+			return
+		}
+		b, _ := json.Marshal(gin.H{"action": "edit_ack", "data": evt})
+		conn.Send(b)
+	case "reaction_add", "reaction_remove":
+		var p ReactionPayload
+		if err := json.Unmarshal(m.Data, &p); err != nil {
+			log.Printf("WS %s unmarshal error: user=%s err=%v", m.Action, userID, err)
+			return
+		}
+		evt, err := s.MsgSvc.React(ctx, userID, p.ConvID, p.ServerMsgID, p.Emoji, m.Action == "reaction_add")
+		if err != nil {
+			code, _ := services.MessageErrorCode(err)
+			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "convId": p.ConvID, "serverMsgId": p.ServerMsgID}})
+			conn.Send(b)
+			log.Printf("WS %s denied: user=%s convId=%s serverMsgId=%s err=%v", m.Action, userID, p.ConvID, p.ServerMsgID, err)
+			return
+		}
+		b, _ := json.Marshal(gin.H{"action": "reaction_ack", "data": evt})
+		conn.Send(b)
+	case "pin", "unpin":
+		var p PinPayload
+		if err := json.Unmarshal(m.Data, &p); err != nil {
+			log.Printf("WS %s unmarshal error: user=%s err=%v", m.Action, userID, err)
+			return
+		}
+		evt, err := s.MsgSvc.Pin(ctx, userID, p.ConvID, p.ServerMsgID, m.Action == "pin")
+		if err != nil {
+			code, _ := services.MessageErrorCode(err)
+			b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "convId": p.ConvID, "serverMsgId": p.ServerMsgID}})
+			conn.Send(b)
+			log.Printf("WS %s denied: user=%s convId=%s serverMsgId=%s err=%v", m.Action, userID, p.ConvID, p.ServerMsgID, err)
+			return
+		}
+		b, _ := json.Marshal(gin.H{"action": "pin_ack", "data": evt})
+		conn.Send(b)
 	case "read":
 		var p ReadPayload
 		if err := json.Unmarshal(m.Data, &p); err != nil {
 			return
 		}
-		// 1) 本地 ACK
-		b, _ := json.Marshal(gin.H{"action": "read_ack", "data": p})
-		writeMu.Lock()
-		conn.WriteMessage(websocket.TextMessage, b)
-		writeMu.Unlock()
-		// 1.5) 写入已读回执并更新缓存
-		if s.Receipt != nil {
-			_ = s.Receipt.UpsertReadSeq(ctx, userID, p.ConvID, p.Seq)
+		// 1) 写入已读回执并更新缓存（群消息向原发送者推送 read_receipt）；失败（含非会话参与方）时返回错误，不应答 read_ack 也不触发阅后即焚
+		if s.ReadSvc != nil {
+			if err := s.ReadSvc.MarkRead(ctx, userID, p.ConvID, p.Seq); err != nil {
+				log.Printf("WS read mark error: user=%s convId=%s seq=%d err=%v", userID, p.ConvID, p.Seq, err)
+				code, _ := services.MessageErrorCode(err)
+				b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": code, "convId": p.ConvID, "seq": p.Seq}})
+				conn.Send(b)
+				return
+			}
+		} else if s.Receipt != nil {
+			if err := s.Receipt.UpsertReadSeq(ctx, userID, p.ConvID, p.Seq); err != nil {
+				log.Printf("WS read mark error: user=%s convId=%s seq=%d err=%v", userID, p.ConvID, p.Seq, err)
+				b, _ := json.Marshal(gin.H{"action": "error", "data": gin.H{"code": "INTERNAL", "convId": p.ConvID, "seq": p.Seq}})
+				conn.Send(b)
+				return
+			}
 			cache.Client().Set(ctx, fmt.Sprintf("im:readseq:%s:%s", userID, p.ConvID), p.Seq, 10*time.Minute)
 		}
+		// 1.5) 本地 ACK
+		b, _ := json.Marshal(gin.H{"action": "read_ack", "data": p})
+		conn.Send(b)
 		// 2) 如果为阅后即焚，尝试按 seq 撤回，并广播给相关用户
 		if s.MsgSvc != nil && s.MsgSvc.Store != nil {
 			msg, err := s.MsgSvc.Store.GetBySeq(ctx, p.ConvID, p.Seq)
@@ -568,43 +643,14 @@ func (s *Server) handleInbound(ctx context.Context, userID, deviceID string, con
 				if err2 := s.MsgSvc.Store.RecallBySeq(ctx, p.ConvID, p.Seq); err2 == nil {
 					evt, _ := json.Marshal(gin.H{"action": "recalled", "data": gin.H{"convId": p.ConvID, "seq": p.Seq}})
 					if msg.ConvType == models.ConversationTypeC2C {
-						if msg.ToUserID != "" {
-							_ = cache.Client().Publish(ctx, cache.DeliverChannel(msg.ToUserID), evt).Err()
-						}
-						if msg.FromUserID != "" {
-							_ = cache.Client().Publish(ctx, cache.DeliverChannel(msg.FromUserID), evt).Err()
-						}
+						_ = cache.DeliverToUsers(ctx, []string{msg.ToUserID, msg.FromUserID}, evt)
 					} else if msg.ConvType == models.ConversationTypeGroup {
 						if msg.GroupID != "" {
-							_ = cache.Client().Publish(ctx, cache.DeliverChannel(msg.GroupID), evt).Err()
+							_ = services.DeliverToGroup(ctx, s.groups(), msg.GroupID, evt)
 						}
 					}
 				}
 			}
 		}
-	case "subscribe_group":
-		var p SubscribeGroupPayload
-		if err := json.Unmarshal(m.Data, &p); err != nil {
-			log.Printf("WS subscribe_group unmarshal error: user=%s err=%v", userID, err)
-			return
-		}
-		log.Printf("WS subscribe_group: user=%s group=%s", userID, p.GroupID)
-		go func(gid string) {
-			sub := cache.Client().Subscribe(ctx, cache.DeliverChannel(gid))
-			for {
-				msg, err := sub.ReceiveMessage(ctx)
-				if err != nil {
-					log.Printf("WS group sub receive error: user=%s group=%s err=%v", userID, gid, err)
-					return
-				}
-				writeMu.Lock()
-				err = conn.WriteMessage(websocket.TextMessage, []byte(msg.Payload))
-				writeMu.Unlock()
-				if err != nil {
-					log.Printf("WS group sub write error: user=%s group=%s err=%v", userID, gid, err)
-					return
-				}
-			}
-		}(p.GroupID)
 	}
 }
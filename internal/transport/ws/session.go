@@ -0,0 +1,264 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-im/internal/cache"
+	"go-im/internal/metrics"
+	"go-im/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout 单次下行写超时
+const wsWriteTimeout = 10 * time.Second
+
+// 心跳默认参数（可通过 Server.PingInterval/PongWait/PresenceTTL 覆盖）
+const (
+	defaultPingInterval = 25 * time.Second
+	defaultPongWait     = 60 * time.Second
+)
+
+func (s *Server) pingInterval() time.Duration {
+	if s.PingInterval > 0 {
+		return s.PingInterval
+	}
+	return defaultPingInterval
+}
+
+// pongWait 读超时：须大于 ping 间隔，否则按两倍 ping 间隔处理。
+func (s *Server) pongWait() time.Duration {
+	wait := s.PongWait
+	if wait <= 0 {
+		wait = defaultPongWait
+	}
+	if ping := s.pingInterval(); wait <= ping {
+		wait = 2 * ping
+	}
+	return wait
+}
+
+func (s *Server) presenceTTL() time.Duration {
+	if s.PresenceTTL > 0 {
+		return s.PresenceTTL
+	}
+	return cache.DefaultPresenceTTL
+}
+
+// ping 发送 WebSocket ping 控制帧（WriteControl 可与 WriteMessage 并发调用）。
+func (c *wsConn) ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// Conn 下行写通道：动作处理、离线同步、重投等只通过 Conn 写出编码无关的信封 {action, data}（services.Envelope），
+// 由实现按连接的编码写出；WebSocket 与 TCP 帧协议（internal/transport/tcp）共用同一套动作处理。
+// 实现须保证并发安全且不阻塞（连接经 SendQueue 入队，慢连接按策略丢弃或断开）。
+type Conn interface {
+	Send(envelope []byte) error
+}
+
+// batchMaxBytes 合并帧的大小上限：达到该大小的帧单独写出，不参与合并
+const batchMaxBytes = 16 << 10
+
+// wsConn WebSocket 连接：Send 只入队，由队列的写协程按协商的 Codec 编码并写出（数据帧只有写协程写，ping/关闭帧走并发安全的 WriteControl）。
+// batching 为 true（连接以 batch=1 建立）时，写协程将同一批中的小帧合并为 batch 帧。
+type wsConn struct {
+	conn     *websocket.Conn
+	codec    Codec
+	batching bool
+	queue    *SendQueue
+}
+
+func (s *Server) newWSConn(conn *websocket.Conn, codec Codec, batching bool) *wsConn {
+	c := &wsConn{conn: conn, codec: codec, batching: batching}
+	c.queue = s.NewSendQueue("ws", c.flush, c.evict)
+	return c
+}
+
+func (c *wsConn) Send(envelope []byte) error {
+	return c.queue.Push(envelope)
+}
+
+func (c *wsConn) SendWait(ctx context.Context, envelope []byte) error {
+	return c.queue.PushWait(ctx, envelope)
+}
+
+// flush 写协程写出一批信封。
+func (c *wsConn) flush(batch [][]byte) error {
+	frames := make([][]byte, 0, len(batch))
+	for _, envelope := range batch {
+		b, err := c.codec.Encode(envelope)
+		if err != nil {
+			log.Printf("WS encode error: codec=%s err=%v", c.codec.Subprotocol(), err)
+			continue
+		}
+		frames = append(frames, b)
+	}
+	if c.batching && len(frames) > 1 {
+		frames = c.coalesce(frames)
+	}
+	for _, b := range frames {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := c.conn.WriteMessage(c.codec.FrameType(), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesce 按顺序将相邻小帧合并为不超过 batchMaxBytes 的 batch 帧。
+func (c *wsConn) coalesce(frames [][]byte) [][]byte {
+	out := make([][]byte, 0, len(frames))
+	var group [][]byte
+	size := 0
+	emit := func() {
+		if len(group) > 1 {
+			if b, err := c.codec.EncodeBatch(group); err == nil {
+				out = append(out, b)
+			} else {
+				out = append(out, group...)
+			}
+		} else {
+			out = append(out, group...)
+		}
+		group, size = nil, 0
+	}
+	for _, b := range frames {
+		if len(b) >= batchMaxBytes {
+			emit()
+			out = append(out, b)
+			continue
+		}
+		if size+len(b) > batchMaxBytes {
+			emit()
+		}
+		group = append(group, b)
+		size += len(b)
+	}
+	emit()
+	return out
+}
+
+// evict 慢连接：发送关闭码 CloseSlowConsumer 并断开，同时打断阻塞中的写协程。
+func (c *wsConn) evict() {
+	msg := websocket.FormatCloseMessage(CloseSlowConsumer, "slow consumer, resync required")
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+// Session 已认证的一个设备连接：
+// - 创建时上线（设备在线状态带 TTL）并登记到节点 Hub（下行投递经 Hub 扇出），Heartbeat 续期，Close 时注销、下线并停止重投协程
+// - Deliver 写出下行投递并登记到待确认窗口，超时未确认由后台协程重投
+// - Dispatch 处理一条上行动作（heartbeat、deliver_ack、sync（独立协程）或 handleInbound 支持的全部动作；subscribe_group 已废弃，忽略）
+// - 连接级心跳（WebSocket ping/pong、TCP 心跳帧）由接入层负责
+type Session struct {
+	UserID   string
+	DeviceID string
+
+	token     string // 连接令牌：写入设备心跳键，下线时仅删除自己写入的在线状态
+	srv       *Server
+	conn      Conn
+	acks      *ackWindow
+	done      chan struct{}
+	once      sync.Once
+	lastTouch atomic.Int64 // 上次续期在线状态的时间（毫秒）
+	syncing   atomic.Bool  // 离线同步进行中（同一会话同时只进行一次）
+}
+
+// NewSession 为已认证的连接创建会话：标记设备上线、登记到 Hub 并启动重投协程。
+func (s *Server) NewSession(ctx context.Context, userID, deviceID string, conn Conn) *Session {
+	sess := &Session{UserID: userID, DeviceID: deviceID, token: uuid.NewString(), srv: s, conn: conn, acks: s.newAckWindowFor(), done: make(chan struct{})}
+	if err := cache.SetDeviceOnline(ctx, userID, deviceID, sess.token, s.presenceTTL()); err != nil {
+		log.Printf("WS presence online error: user=%s device=%s err=%v", userID, deviceID, err)
+	}
+	sess.lastTouch.Store(time.Now().UnixMilli())
+	s.Hub.register(ctx, sess, s.presenceTTL())
+	go s.redeliverLoop(userID, conn, sess.acks, sess.done)
+	return sess
+}
+
+// Heartbeat 收到心跳（pong、heartbeat 动作或 TCP 心跳帧）时续期在线状态与投递路由（路由已被清理或过期时写回）；每 TTL/3 最多写一次 Redis。
+func (sess *Session) Heartbeat(ctx context.Context) {
+	ttl := sess.srv.presenceTTL()
+	now := time.Now().UnixMilli()
+	if now-sess.lastTouch.Load() < ttl.Milliseconds()/3 {
+		return
+	}
+	sess.lastTouch.Store(now)
+	if err := cache.SetDeviceOnline(ctx, sess.UserID, sess.DeviceID, sess.token, ttl); err != nil {
+		log.Printf("WS presence refresh error: user=%s device=%s err=%v", sess.UserID, sess.DeviceID, err)
+	}
+	if err := cache.TouchDeviceRoute(ctx, sess.UserID, sess.DeviceID, sess.srv.Hub.NodeID, ttl); err != nil {
+		log.Printf("WS route refresh error: user=%s device=%s err=%v", sess.UserID, sess.DeviceID, err)
+	}
+}
+
+// Deliver 写出一条下行信封（来自投递通道），消息投递进入待确认窗口。
+func (sess *Session) Deliver(payload []byte) error {
+	if err := sess.conn.Send(payload); err != nil {
+		return err
+	}
+	sess.acks.track(payload)
+	return nil
+}
+
+// Dispatch 处理一条上行动作；reply 为该动作的应答通道（为空时使用连接本身）。
+func (sess *Session) Dispatch(ctx context.Context, m *WSMessage, reply Conn) {
+	if reply == nil {
+		reply = sess.conn
+	}
+	metrics.WSMessagesTotal.WithLabelValues(m.Action).Inc()
+	switch m.Action {
+	case "heartbeat":
+		// 应用层心跳：供无法收发 ping/pong 控制帧的客户端（或中间代理会吞掉控制帧的场景）保活
+		sess.Heartbeat(ctx)
+		reply.Send(services.NewEnvelope("heartbeat_ack", gin.H{"ts": time.Now().UnixMilli(), "intervalSec": int(sess.srv.pingInterval() / time.Second)}))
+	case "deliver_ack":
+		var p DeliverAckPayload
+		if err := json.Unmarshal(m.Data, &p); err == nil {
+			sess.srv.handleDeliverAck(ctx, sess.UserID, sess.DeviceID, sess.acks, &p)
+		}
+	case "subscribe_group":
+		// 已废弃：群消息按成员路由投递给全体成员，无需订阅；保留该动作以兼容旧客户端
+	case "sync":
+		sess.startSync(ctx, m, reply)
+	default:
+		sess.srv.handleInbound(ctx, sess.UserID, sess.DeviceID, reply, m)
+	}
+}
+
+// startSync 在独立协程中执行离线同步：补发可能需要等待下行队列空位，读循环不被阻塞（心跳、pong 照常处理）。
+// 同一会话同时只进行一次同步，进行中再次请求返回 SYNC_IN_PROGRESS。
+func (sess *Session) startSync(ctx context.Context, m *WSMessage, reply Conn) {
+	var p SyncPayload
+	if err := json.Unmarshal(m.Data, &p); err != nil {
+		log.Printf("WS sync unmarshal error: user=%s err=%v", sess.UserID, err)
+		return
+	}
+	if !sess.syncing.CompareAndSwap(false, true) {
+		reply.Send(services.NewEnvelope("error", gin.H{"code": "SYNC_IN_PROGRESS", "syncId": p.SyncID}))
+		return
+	}
+	go func() {
+		defer sess.syncing.Store(false)
+		sess.srv.handleSync(ctx, sess.UserID, reply, &p)
+	}()
+}
+
+// Close 从 Hub 注销、下线设备并停止重投协程（可重复调用）。
+func (sess *Session) Close() {
+	sess.once.Do(func() {
+		sess.srv.Hub.unregister(sess)
+		close(sess.done)
+		if err := cache.SetDeviceOffline(context.Background(), sess.UserID, sess.DeviceID, sess.token); err != nil {
+			log.Printf("WS presence offline error: user=%s device=%s err=%v", sess.UserID, sess.DeviceID, err)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go-im/internal/models"
+	"go-im/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 离线同步参数：每页条数与单会话最多补发条数（超出后 hasMore=true，客户端改走 /api/messages/history）
+const (
+	syncPageSize       = 100
+	syncMaxPerConv     = 1000
+	syncMaxConvsListed = 200
+)
+
+// SyncPayload 离线同步请求负载。
+// - cursors：{convId: lastSeq}，服务端补发 seq > lastSeq 的消息
+// - cursors 为空时，按用户会话列表 + 已读水位补发
+type SyncPayload struct {
+	SyncID  string           `json:"syncId,omitempty"`
+	Cursors map[string]int64 `json:"cursors"`
+}
+
+// handleSync 处理 sync 动作：逐会话分页补发离线消息（sync_batch），最后下发 sync_done。
+// - 每个会话仅在确认用户为参与方（单聊双方/群成员）后才补发
+// - 已撤回/已过期的消息以墓碑下发（recalled=true、无载荷），客户端删除本地副本，seq 也保持连续
+// - 由 Session.startSync 在独立协程中调用，ctx 为连接上下文
+func (s *Server) handleSync(ctx context.Context, userID string, conn Conn, p *SyncPayload) {
+	cursors := p.Cursors
+	if len(cursors) == 0 {
+		cursors = s.defaultSyncCursors(ctx, userID)
+	}
+	cursorsOut := make(map[string]int64, len(cursors))
+	total := 0
+	for convID, lastSeq := range cursors {
+		cursorsOut[convID] = lastSeq
+		if convID == "" {
+			continue
+		}
+		fromSeq := lastSeq
+		sent := 0
+		allowed := false
+		for sent < syncMaxPerConv {
+			msgs, err := s.MsgSvc.ListForSync(ctx, userID, convID, fromSeq, syncPageSize)
+			if err != nil {
+				log.Printf("WS sync list error: user=%s convId=%s err=%v", userID, convID, err)
+				break
+			}
+			if len(msgs) == 0 {
+				break
+			}
+			if !allowed {
+				if !s.canAccessConv(ctx, userID, msgs[0]) {
+					log.Printf("WS sync denied: user=%s convId=%s", userID, convID)
+					break
+				}
+				allowed = true
+			}
+			now := time.Now()
+			items := make([]*services.Deliver, 0, len(msgs))
+			for _, m := range msgs {
+				if m.Recalled || (m.ExpireAt != nil && !m.ExpireAt.After(now)) {
+					items = append(items, services.ToTombstone(m))
+				} else {
+					items = append(items, services.ToDeliver(m))
+				}
+			}
+			fromSeq = msgs[len(msgs)-1].Seq
+			sent += len(msgs)
+			hasMore := len(msgs) == syncPageSize && sent >= syncMaxPerConv
+			b, _ := json.Marshal(gin.H{"action": "sync_batch", "data": gin.H{"syncId": p.SyncID, "convId": convID, "messages": items, "cursor": fromSeq, "hasMore": hasMore}})
+			err = sendWait(ctx, conn, b)
+			if err != nil {
+				log.Printf("WS sync write error: user=%s convId=%s err=%v", userID, convID, err)
+				return
+			}
+			if len(msgs) < syncPageSize {
+				break
+			}
+		}
+		cursorsOut[convID] = fromSeq
+		total += sent
+	}
+	b, _ := json.Marshal(gin.H{"action": "sync_done", "data": gin.H{"syncId": p.SyncID, "cursors": cursorsOut, "total": total}})
+	sendWait(ctx, conn, b)
+	log.Printf("WS sync done: user=%s convs=%d total=%d", userID, len(cursors), total)
+}
+
+// defaultSyncCursors 客户端未携带游标时，以用户会话列表与已读水位作为起点。
+func (s *Server) defaultSyncCursors(ctx context.Context, userID string) map[string]int64 {
+	cursors := make(map[string]int64)
+	if s.MsgSvc == nil || s.MsgSvc.ConvStore == nil {
+		return cursors
+	}
+	rows, err := s.MsgSvc.ConvStore.ListByUser(ctx, userID, syncMaxConvsListed)
+	if err != nil {
+		log.Printf("WS sync list conversations error: user=%s err=%v", userID, err)
+		return cursors
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var convID, convType string
+		var peerID, groupID, draft sql.NullString
+		var pinned, muted int
+		var updatedAt time.Time
+		if err := rows.Scan(&convID, &convType, &peerID, &groupID, &pinned, &muted, &draft, &updatedAt); err != nil {
+			continue
+		}
+		var readSeq int64
+		if s.Receipt != nil {
+			readSeq, _ = s.Receipt.GetReadSeq(ctx, userID, convID)
+		}
+		cursors[convID] = readSeq
+	}
+	return cursors
+}
+
+// canAccessConv 判断用户是否为消息所在会话的参与方。
+func (s *Server) canAccessConv(ctx context.Context, userID string, m *models.Message) bool {
+	switch m.ConvType {
+	case models.ConversationTypeC2C:
+		return m.FromUserID == userID || m.ToUserID == userID
+	case models.ConversationTypeGroup:
+		if s.IsMember == nil {
+			return true
+		}
+		ok, _ := s.IsMember(ctx, m.GroupID, userID)
+		return ok
+	}
+	return false
+}